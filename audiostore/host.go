@@ -0,0 +1,236 @@
+package audiostore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"live2ddriver/live2ddriver"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Host serves the audios of a Store at <baseURL>/audio/<id>.
+type Host struct {
+	store   Store
+	baseURL string
+}
+
+// NewHost returns a Host of the store. baseURL is where the views reach
+// the HTTP server serving the Routes, e.g. http://192.168.1.2:9002.
+func NewHost(store Store, baseURL string) *Host {
+	return &Host{
+		store:   store,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// URL of the hosted audio of the id.
+func (h *Host) URL(id string) string {
+	return h.baseURL + "/audio/" + id
+}
+
+// id returns the id of the audio if the url is of a hosted audio.
+func (h *Host) id(url string) (string, bool) {
+	prefix := h.baseURL + "/audio/"
+	if !strings.HasPrefix(url, prefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(url, prefix)
+	return id, validID(id)
+}
+
+// Put the audio data into the store. The contentType is sniffed from the
+// data if it's not an audio type.
+func (h *Host) Put(data []byte, contentType string) (Audio, error) {
+	contentType, ok := audioContentType(contentType, data)
+	if !ok {
+		return Audio{}, fmt.Errorf("%w: %s", ErrNotAudio, contentType)
+	}
+	return h.store.Put(data, contentType)
+}
+
+var ErrNotAudio = errors.New("not an audio")
+
+// audioContentType returns the media type of the audio data: the declared
+// one if it's audio/*, otherwise sniffed from the data.
+func audioContentType(declared string, data []byte) (string, bool) {
+	if mt, _, err := mime.ParseMediaType(declared); err == nil && strings.HasPrefix(mt, "audio/") {
+		return mt, true
+	}
+	sniffed, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	return sniffed, strings.HasPrefix(sniffed, "audio/")
+}
+
+// region HTTP
+
+// Routes registers the APIs of the hosted audios:
+//
+//	POST /audio: upload an audio (raw body, or the "file" of a multipart form).
+//	             Responds 201 {"id", "url", "contentType", "size", "expires"}.
+//	GET /audio/:id: the audio.
+//
+// It is a wsforwarder.RouteRegister.
+func (h *Host) Routes(router gin.IRouter) {
+	router.POST("/audio", h.serveUpload)
+	router.GET("/audio/:id", h.serveAudio)
+}
+
+// uploaded is the response of POST /audio.
+type uploaded struct {
+	Audio
+	URL string `json:"url"`
+}
+
+func (h *Host) serveUpload(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, live2ddriver.MaxAudioSize)
+
+	var data []byte
+	var contentType string
+	var err error
+
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		data, contentType, err = formFile(c, "file")
+	} else {
+		contentType = c.GetHeader("Content-Type")
+		data, err = io.ReadAll(c.Request.Body)
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case len(data) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty audio"})
+		return
+	}
+
+	audio, err := h.Put(data, contentType)
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrNotAudio):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, uploaded{Audio: audio, URL: h.URL(audio.ID)})
+}
+
+// formFile reads the file of the multipart form.
+func formFile(c *gin.Context, name string) ([]byte, string, error) {
+	fh, err := c.FormFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	return data, fh.Header.Get("Content-Type"), err
+}
+
+func (h *Host) serveAudio(c *gin.Context) {
+	audio, data, err := h.store.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	// views may analyze the audio with WebAudio, which requires CORS.
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Content-Type", audio.ContentType)
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(time.Until(audio.Expires).Seconds())))
+
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(data))
+}
+
+// endregion HTTP
+
+// region drivers
+
+// hostLoader loads the hosted audios from the store, and other srcs by next.
+type hostLoader struct {
+	host *Host
+	next live2ddriver.AudioLoader
+}
+
+// Loader returns a live2ddriver.AudioLoader that loads hosted audios (by
+// their urls) from the store, and other srcs by next (nil for none).
+func (h *Host) Loader(next live2ddriver.AudioLoader) live2ddriver.AudioLoader {
+	return &hostLoader{host: h, next: next}
+}
+
+func (l *hostLoader) Load(src string) ([]byte, error) {
+	if id, ok := l.host.id(src); ok {
+		_, data, err := l.host.store.Get(id)
+		return data, err
+	}
+	if l.next == nil {
+		return nil, live2ddriver.ErrRemoteAudio
+	}
+	return l.next.Load(src)
+}
+
+// rewriteDriver is a Live2DDriver that moves the inline audios of speak
+// requests into the store.
+type rewriteDriver struct {
+	host *Host
+	next live2ddriver.Live2DDriver
+}
+
+// Driver returns a live2ddriver.Live2DDriver that drives requests by next
+// (nil to skip), and then rewrites the data URI audios of speak requests to
+// the urls of them hosted, so that the messages broadcast (and kept in the
+// history) stay small.
+//
+// Audios failing to be hosted (e.g. too large) are kept inline.
+func (h *Host) Driver(next live2ddriver.Live2DDriver) live2ddriver.Live2DDriver {
+	return &rewriteDriver{host: h, next: next}
+}
+
+func (d *rewriteDriver) Drive(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+	if d.next != nil {
+		req = d.next.Drive(req)
+	}
+
+	if req.Speak == nil || !strings.HasPrefix(req.Speak.Audio, "data:") {
+		return req
+	}
+
+	data, mediaType, err := live2ddriver.DecodeDataURI(req.Speak.Audio)
+	if err != nil {
+		log.Printf("WARN audiostore: decode data URI: %v. Keep it inline.", err)
+		return req
+	}
+
+	audio, err := d.host.Put(data, mediaType)
+	if err != nil {
+		log.Printf("WARN audiostore: host audio: %v. Keep it inline.", err)
+		return req
+	}
+
+	speak := *req.Speak // don't modify the request of the caller
+	speak.Audio = d.host.URL(audio.ID)
+	req.Speak = &speak
+
+	return req
+}
+
+// endregion drivers
@@ -0,0 +1,134 @@
+package audiostore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"live2ddriver/live2ddriver"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testWAV is the header of a WAV, enough to be sniffed as audio/wave.
+var testWAV = []byte("RIFF\x24\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+
+func serveHost(t *testing.T, h *Host) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	h.Routes(router)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestHost_Routes(t *testing.T) {
+	h := NewHost(NewMemoryStore(Options{MaxSize: 64}), "http://example.com/")
+	ts := serveHost(t, h)
+
+	upload := func(body io.Reader, contentType string) (*http.Response, uploaded) {
+		t.Helper()
+		resp, err := http.Post(ts.URL+"/audio", contentType, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var u uploaded
+		_ = json.NewDecoder(resp.Body).Decode(&u)
+		return resp, u
+	}
+
+	t.Run("Raw", func(t *testing.T) {
+		resp, u := upload(bytes.NewReader(testWAV), "application/octet-stream")
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /audio status = %d, want 201", resp.StatusCode)
+		}
+		if u.URL != "http://example.com/audio/"+u.ID || u.ContentType != "audio/wave" {
+			t.Errorf("POST /audio = %+v, want sniffed audio/wave at http://example.com/audio/<id>", u)
+		}
+
+		resp, err := http.Get(ts.URL + "/audio/" + u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(data, testWAV) || resp.Header.Get("Content-Type") != "audio/wave" {
+			t.Errorf("GET /audio/:id = %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), data)
+		}
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		form := func(data []byte) (io.Reader, string) {
+			var body bytes.Buffer
+			w := multipart.NewWriter(&body)
+			part, _ := w.CreateFormFile("file", "a.wav")
+			_, _ = part.Write(data)
+			_ = w.Close()
+			return &body, w.FormDataContentType()
+		}
+
+		if resp, u := upload(form(testWAV)); resp.StatusCode != http.StatusCreated || u.Size != int64(len(testWAV)) {
+			t.Errorf("POST /audio (form) = %d %+v, want 201", resp.StatusCode, u)
+		}
+		if resp, _ := upload(form([]byte("hello"))); resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("POST /audio (not an audio) status = %d, want 415", resp.StatusCode)
+		}
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		if resp, _ := upload(bytes.NewReader(make([]byte, 65)), "audio/wav"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST /audio (65 bytes) status = %d, want 413", resp.StatusCode)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/audio/0123456789abcdef0123456789abcdef")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET /audio/:id status = %d, want 404", resp.StatusCode)
+		}
+	})
+}
+
+func TestHost_Driver(t *testing.T) {
+	h := NewHost(NewMemoryStore(Options{MaxSize: 64}), "http://example.com")
+	driver := h.Driver(nil)
+
+	uri := "data:audio/wav;base64," + base64.StdEncoding.EncodeToString(testWAV)
+	req := live2ddriver.Live2DRequest{Speak: &live2ddriver.Speaking{Audio: uri, Text: "hi"}}
+
+	got := driver.Drive(req)
+	if !strings.HasPrefix(got.Speak.Audio, "http://example.com/audio/") || got.Speak.Text != "hi" {
+		t.Fatalf("Drive() speak = %+v, want the hosted url", got.Speak)
+	}
+	if req.Speak.Audio != uri {
+		t.Errorf("Drive() modified the request of the caller")
+	}
+
+	// the hosted audio loads back for the analyzing
+	data, err := h.Loader(nil).Load(got.Speak.Audio)
+	if err != nil || !bytes.Equal(data, testWAV) {
+		t.Errorf("Loader().Load(%s) = %q, %v", got.Speak.Audio, data, err)
+	}
+
+	// too large: kept inline
+	large := "data:audio/wav;base64," + base64.StdEncoding.EncodeToString(make([]byte, 65))
+	if got := driver.Drive(live2ddriver.Live2DRequest{Speak: &live2ddriver.Speaking{Audio: large}}); got.Speak.Audio != large {
+		t.Errorf("Drive(too large) audio = %.40s, want kept inline", got.Speak.Audio)
+	}
+
+	// not data URIs: passed through
+	remote := "https://example.org/a.wav"
+	if got := driver.Drive(live2ddriver.Live2DRequest{Speak: &live2ddriver.Speaking{Audio: remote}}); got.Speak.Audio != remote {
+		t.Errorf("Drive(remote) audio = %s, want %s", got.Speak.Audio, remote)
+	}
+}
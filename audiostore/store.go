@@ -0,0 +1,279 @@
+// Package audiostore keeps short-lived audios (e.g. TTS outputs) in memory
+// or on disk, and serves them over HTTP, so that speak requests can refer
+// to them by urls instead of carrying the audios inline.
+package audiostore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of Options.
+const (
+	MaxSize  = 10 << 20  // max size of an audio
+	MaxTotal = 200 << 20 // max total size of the audios kept
+	TTL      = 10 * time.Minute
+)
+
+var (
+	ErrTooLarge = errors.New("audio too large")
+	ErrNotFound = errors.New("audio not found")
+)
+
+// Options of a Store. Zero values for the defaults.
+type Options struct {
+	MaxSize  int64         // max size of an audio
+	MaxTotal int64         // max total size of the audios kept. The oldest are evicted to make room.
+	TTL      time.Duration // audios expire TTL after they are put
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxSize <= 0 {
+		o.MaxSize = MaxSize
+	}
+	if o.MaxTotal <= 0 {
+		o.MaxTotal = MaxTotal
+	}
+	if o.MaxTotal < o.MaxSize {
+		o.MaxTotal = o.MaxSize
+	}
+	if o.TTL <= 0 {
+		o.TTL = TTL
+	}
+	return o
+}
+
+// Audio is an audio kept in a Store.
+type Audio struct {
+	ID          string    `json:"id"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Store keeps audios until they expire.
+type Store interface {
+	// Put keeps the data of the contentType (e.g. audio/wav).
+	// ErrTooLarge if the data exceeds the MaxSize.
+	Put(data []byte, contentType string) (Audio, error)
+	// Get the audio of the id. ErrNotFound if it's not found or expired.
+	Get(id string) (Audio, []byte, error)
+}
+
+// blobs are where a store keeps the data of audios.
+type blobs interface {
+	write(id string, data []byte) error
+	read(id string) ([]byte, error)
+	remove(id string)
+}
+
+// store is the Store of expiring audios, whose data are kept in blobs.
+type store struct {
+	opts  Options
+	blobs blobs
+
+	audios map[string]Audio
+	total  int64
+	mu     sync.Mutex
+
+	now func() time.Time // for testing
+}
+
+func newStore(blobs blobs, opts Options) *store {
+	return &store{
+		opts:   opts.withDefaults(),
+		blobs:  blobs,
+		audios: map[string]Audio{},
+		now:    time.Now,
+	}
+}
+
+// NewMemoryStore returns a Store that keeps audios in memory.
+func NewMemoryStore(opts Options) Store {
+	return newStore(&memoryBlobs{data: map[string][]byte{}}, opts)
+}
+
+// NewDiskStore returns a Store that keeps audios as files under dir, which
+// is created if not exists. Audio files left by former runs are removed.
+func NewDiskStore(dir string, opts Options) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+diskExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		_ = os.Remove(path)
+	}
+
+	return newStore(&diskBlobs{dir: dir}, opts), nil
+}
+
+func (s *store) Put(data []byte, contentType string) (Audio, error) {
+	size := int64(len(data))
+	if size > s.opts.MaxSize {
+		return Audio{}, fmt.Errorf("%w: %d bytes, max %d", ErrTooLarge, size, s.opts.MaxSize)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Audio{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	s.evict(size)
+
+	if err := s.blobs.write(id, data); err != nil {
+		return Audio{}, err
+	}
+
+	audio := Audio{
+		ID:          id,
+		ContentType: contentType,
+		Size:        size,
+		Expires:     s.now().Add(s.opts.TTL),
+	}
+	s.audios[id] = audio
+	s.total += size
+
+	return audio, nil
+}
+
+func (s *store) Get(id string) (Audio, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+
+	audio, ok := s.audios[id]
+	if !ok || !validID(id) {
+		return Audio{}, nil, fmt.Errorf("%w: %q", ErrNotFound, id)
+	}
+
+	data, err := s.blobs.read(id)
+	if err != nil {
+		s.delete(id)
+		return Audio{}, nil, fmt.Errorf("%w: %q: %v", ErrNotFound, id, err)
+	}
+
+	return audio, data, nil
+}
+
+// expire deletes the expired audios. s.mu must be held.
+func (s *store) expire() {
+	now := s.now()
+	for id, audio := range s.audios {
+		if !now.Before(audio.Expires) {
+			s.delete(id)
+		}
+	}
+}
+
+// evict deletes the oldest audios until there is room for size bytes.
+// s.mu must be held.
+func (s *store) evict(size int64) {
+	if s.total+size <= s.opts.MaxTotal {
+		return
+	}
+
+	oldest := make([]Audio, 0, len(s.audios))
+	for _, audio := range s.audios {
+		oldest = append(oldest, audio)
+	}
+	sort.Slice(oldest, func(i, j int) bool {
+		return oldest[i].Expires.Before(oldest[j].Expires)
+	})
+
+	for _, audio := range oldest {
+		if s.total+size <= s.opts.MaxTotal {
+			break
+		}
+		s.delete(audio.ID)
+	}
+}
+
+// delete the audio. s.mu must be held.
+func (s *store) delete(id string) {
+	audio, ok := s.audios[id]
+	if !ok {
+		return
+	}
+	delete(s.audios, id)
+	s.total -= audio.Size
+	s.blobs.remove(id)
+}
+
+// newID returns a random id, hard to guess, of 32 hex digits.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id may be made by newID.
+// It keeps ids from the outside (urls) away from the file paths.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	return strings.Trim(id, "0123456789abcdef") == ""
+}
+
+// region blobs
+
+type memoryBlobs struct {
+	data map[string][]byte
+}
+
+func (b *memoryBlobs) write(id string, data []byte) error {
+	b.data[id] = append([]byte(nil), data...)
+	return nil
+}
+
+func (b *memoryBlobs) read(id string) ([]byte, error) {
+	return b.data[id], nil
+}
+
+func (b *memoryBlobs) remove(id string) {
+	delete(b.data, id)
+}
+
+// diskExt is the extension of the audio files of diskBlobs.
+const diskExt = ".audio"
+
+type diskBlobs struct {
+	dir string
+}
+
+func (b *diskBlobs) path(id string) string {
+	return filepath.Join(b.dir, id+diskExt)
+}
+
+func (b *diskBlobs) write(id string, data []byte) error {
+	return os.WriteFile(b.path(id), data, 0o644)
+}
+
+func (b *diskBlobs) read(id string) ([]byte, error) {
+	return os.ReadFile(b.path(id))
+}
+
+func (b *diskBlobs) remove(id string) {
+	_ = os.Remove(b.path(id))
+}
+
+// endregion blobs
@@ -0,0 +1,103 @@
+package audiostore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	stores := map[string]func(t *testing.T, opts Options) Store{
+		"Memory": func(t *testing.T, opts Options) Store {
+			return NewMemoryStore(opts)
+		},
+		"Disk": func(t *testing.T, opts Options) Store {
+			s, err := NewDiskStore(t.TempDir(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t, Options{MaxSize: 4, MaxTotal: 8, TTL: time.Minute})
+			now := time.Now()
+			s.(*store).now = func() time.Time { return now }
+
+			a, err := s.Put([]byte("abcd"), "audio/wav")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !validID(a.ID) || a.Size != 4 || a.ContentType != "audio/wav" || !a.Expires.Equal(now.Add(time.Minute)) {
+				t.Errorf("Put() = %+v", a)
+			}
+
+			got, data, err := s.Get(a.ID)
+			if err != nil || got != a || string(data) != "abcd" {
+				t.Errorf("Get() = %+v, %q, %v, want %+v, abcd", got, data, err, a)
+			}
+
+			if _, err := s.Put([]byte("abcde"), "audio/wav"); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Put(5 bytes) error = %v, want ErrTooLarge", err)
+			}
+
+			// the oldest is evicted to make room
+			now = now.Add(time.Second)
+			b, _ := s.Put([]byte("efgh"), "audio/wav")
+			now = now.Add(time.Second)
+			c, _ := s.Put([]byte("ijkl"), "audio/wav")
+			if _, _, err := s.Get(a.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(evicted) error = %v, want ErrNotFound", err)
+			}
+			if _, _, err := s.Get(b.ID); err != nil {
+				t.Errorf("Get(b) error = %v", err)
+			}
+
+			// expired
+			now = now.Add(time.Minute - time.Second/2)
+			if _, _, err := s.Get(b.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(expired) error = %v, want ErrNotFound", err)
+			}
+			if _, _, err := s.Get(c.ID); err != nil {
+				t.Errorf("Get(c) error = %v", err)
+			}
+
+			if _, _, err := s.Get("../../etc/passwd"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(bad id) error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestNewDiskStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audio")
+
+	s, err := NewDiskStore(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Put([]byte("abcd"), "audio/wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, a.ID+diskExt)); err != nil {
+		t.Errorf("audio file not written: %v", err)
+	}
+
+	// stale audio files are removed, others kept
+	other := filepath.Join(dir, "keep.txt")
+	_ = os.WriteFile(other, nil, 0o644)
+	if _, err := NewDiskStore(dir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, a.ID+diskExt)); !os.IsNotExist(err) {
+		t.Errorf("stale audio file not removed: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("other file removed: %v", err)
+	}
+}
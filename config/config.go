@@ -0,0 +1,677 @@
+// Package config is the whole-server configuration of live2ddriver:
+// listeners, input sources and model profiles, loaded from a YAML or JSON
+// file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"live2ddriver/audiostore"
+	"live2ddriver/live2ddriver"
+	"live2ddriver/macro"
+	"live2ddriver/wsforwarder"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the whole-server configuration.
+//
+// Example (YAML):
+//
+//	ws: ":9001"
+//	inputs:
+//	  http: ":9002"
+//	  driver: ":9004"
+//	  stdin: false
+//	verbose: true
+//	forwarder:
+//	  queueSize: 8
+//	  overflowPolicy: dropOldest
+//	  sendTimeout: 0s
+//	  historySize: 256
+//	  maxRooms: 64
+//	  pingInterval: 15s
+//	  idleTimeout: 45s
+//	  writeTimeout: 10s
+//	  speechQueue: true
+//	  filters:
+//	    builtin: true
+//	    rules:
+//	      - name: noIdleAfterEmotion
+//	        models: [shizuku]
+//	        match: {motion: idle}
+//	        after: {motion: "*", emotion: true}
+//	        within: 2s
+//	        action: strip
+//	  arbiter:
+//	    enabled: true
+//	    defaultPriority: chat
+//	    motionHold: 3s
+//	    expressionDwell: 5s
+//	    cooldowns: {shake: 10s}
+//	speakEmotion:
+//	  enabled: true
+//	  sentences: true
+//	tts:
+//	  backend: exec
+//	  command: [piper, --model, zh.onnx, --output_file, "{out}"]
+//	  timeout: 30s
+//	audio:
+//	  analyze: true
+//	  dir: ./audio
+//	  envelopeRate: 30
+//	  textLipSync:
+//	    enabled: true
+//	    speechRate: 1
+//	    volume: 1
+//	  host:
+//	    store: memory
+//	    maxSize: 10485760
+//	    maxTotal: 209715200
+//	    ttl: 10m
+//	    publicURL: http://192.168.1.2:9002
+//	    rewriteDataURI: true
+//	macros:
+//	  dir: ./macros
+//	record:
+//	  file: ./traffic.jsonl
+//	replay:
+//	  file: ""
+//	  speed: 1
+//	  direction: out
+//	defaultProfile: shizuku
+//	profiles:
+//	  shizuku:
+//	    model: https://example.com/shizuku/shizuku.model.json
+//	    emoMapper:
+//	      type: stateful
+//	      config:
+//	        motionFromEmotion: {happiness: tap_body, surprise: shake}
+//	        expressionFromPolarity: {positive: f04, negative: f02}
+//	    idle:
+//	      enabled: true
+//	      after: 30
+//	      minInterval: 8
+//	      maxInterval: 20
+//	      motions: {idle: 3, flick_head: 1}
+//	      expressions: {f01: 1}
+//	      expressionChance: 0.2
+type Config struct {
+	WsAddr  string `json:"ws" yaml:"ws"` // (out) Live2DViews connect to ws://WsAddr/live2d
+	Inputs  Inputs `json:"inputs" yaml:"inputs"`
+	Verbose bool   `json:"verbose" yaml:"verbose"`
+
+	Forwarder    Forwarder    `json:"forwarder" yaml:"forwarder"`
+	SpeakEmotion SpeakEmotion `json:"speakEmotion" yaml:"speakEmotion"`
+	TTS          TTS          `json:"tts" yaml:"tts"`
+	Audio        Audio        `json:"audio" yaml:"audio"`
+	Macros       Macros       `json:"macros" yaml:"macros"`
+	Record       Record       `json:"record" yaml:"record"`
+	Replay       Replay       `json:"replay" yaml:"replay"`
+
+	// DefaultProfile is the profile in use before any model switching.
+	DefaultProfile string `json:"defaultProfile" yaml:"defaultProfile"`
+	// Profiles: name => Profile. The profile matching the model of a
+	// {"model": ...} request takes over the emotion mapping.
+	Profiles map[string]live2ddriver.Profile `json:"profiles" yaml:"profiles"`
+}
+
+// Inputs are the input sources of messages.
+type Inputs struct {
+	HTTPAddr   string `json:"http" yaml:"http"`     // (in) forward Live2DRequests from HTTP (/live2d). Empty to disable.
+	DriverAddr string `json:"driver" yaml:"driver"` // (in) text-in driver (/driver). Empty to disable.
+	Stdin      bool   `json:"stdin" yaml:"stdin"`   // (in) forward messages from stdin
+}
+
+// Forwarder configures the messageForwarder.
+type Forwarder struct {
+	QueueSize      int                        `json:"queueSize" yaml:"queueSize"`           // per-client send queue size
+	OverflowPolicy wsforwarder.OverflowPolicy `json:"overflowPolicy" yaml:"overflowPolicy"` // dropOldest | dropNewest | coalesce | disconnect
+	SendTimeout    Duration                   `json:"sendTimeout" yaml:"sendTimeout"`       // wait for a full send queue before applying the OverflowPolicy
+	HistorySize    int                        `json:"historySize" yaml:"historySize"`       // recent messages kept for resuming clients
+	MaxRooms       int                        `json:"maxRooms" yaml:"maxRooms"`             // cap of the number of rooms. 0 for no cap.
+
+	PingInterval Duration `json:"pingInterval" yaml:"pingInterval"` // ping clients every pingInterval. 0 to disable.
+	IdleTimeout  Duration `json:"idleTimeout" yaml:"idleTimeout"`   // evict clients that send nothing (not even pongs) for idleTimeout. 0 to disable.
+	WriteTimeout Duration `json:"writeTimeout" yaml:"writeTimeout"` // evict clients that fail to take a message in writeTimeout. 0 to disable.
+
+	SpeechQueue bool `json:"speechQueue" yaml:"speechQueue"` // serialize speak requests so that audios never overlap
+
+	Filters Filters `json:"filters" yaml:"filters"` // filter the driven messages before forwarding
+	Arbiter Arbiter `json:"arbiter" yaml:"arbiter"` // arbitrate motions & expressions by priorities, after the filters
+}
+
+// Arbiter configures the arbitration of motions & expressions.
+// See wsforwarder.NewArbiter.
+type Arbiter struct {
+	Enabled         bool                  `json:"enabled" yaml:"enabled"`
+	DefaultPriority live2ddriver.Priority `json:"defaultPriority" yaml:"defaultPriority"` // of requests without a priority: idle | chat | emotion | manual
+	MotionHold      Duration              `json:"motionHold" yaml:"motionHold"`           // a motion holds against lower priorities
+	ExpressionDwell Duration              `json:"expressionDwell" yaml:"expressionDwell"` // an expression holds against lower priorities
+	Cooldown        Duration              `json:"cooldown" yaml:"cooldown"`               // between motions of the same group
+	Cooldowns       map[string]Duration   `json:"cooldowns" yaml:"cooldowns"`             // motion group => cooldown
+}
+
+func (a Arbiter) config() wsforwarder.ArbiterConfig {
+	cooldowns := make(map[string]time.Duration, len(a.Cooldowns))
+	for group, d := range a.Cooldowns {
+		cooldowns[group] = time.Duration(d)
+	}
+	return wsforwarder.ArbiterConfig{
+		DefaultPriority: a.DefaultPriority,
+		MotionHold:      time.Duration(a.MotionHold),
+		ExpressionDwell: time.Duration(a.ExpressionDwell),
+		Cooldown:        time.Duration(a.Cooldown),
+		Cooldowns:       cooldowns,
+	}
+}
+
+// Filters configures the message filter pipeline of the messageForwarder.
+type Filters struct {
+	Builtin bool         `json:"builtin" yaml:"builtin"` // the built-in rules first, see wsforwarder.DefaultFilters
+	Rules   []FilterRule `json:"rules" yaml:"rules"`     // then the rules, in order
+}
+
+// FilterRule is a wsforwarder.FilterRule in the config file.
+type FilterRule struct {
+	Name        string                   `json:"name" yaml:"name"`
+	Models      []string                 `json:"models" yaml:"models"` // substrings of the model srcs to apply to. Empty for all.
+	Match       wsforwarder.Match        `json:"match" yaml:"match"`
+	After       *wsforwarder.Match       `json:"after" yaml:"after"`             // only within after a message matching after
+	Within      Duration                 `json:"within" yaml:"within"`           //
+	Immediately bool                     `json:"immediately" yaml:"immediately"` // only right after, with no other message in between
+	Action      wsforwarder.FilterAction `json:"action" yaml:"action"`           // drop | strip
+}
+
+func (r FilterRule) rule() wsforwarder.FilterRule {
+	return wsforwarder.FilterRule{
+		Name:        r.Name,
+		Models:      r.Models,
+		Match:       r.Match,
+		After:       r.After,
+		Within:      time.Duration(r.Within),
+		Immediately: r.Immediately,
+		Action:      r.Action,
+	}
+}
+
+// Filters returns the filters in order.
+func (f Filters) Filters() []wsforwarder.Filter {
+	var filters []wsforwarder.Filter
+	if f.Builtin {
+		filters = append(filters, wsforwarder.DefaultFilters()...)
+	}
+	for _, r := range f.Rules {
+		filters = append(filters, wsforwarder.NewRuleFilter(r.rule()))
+	}
+	return filters
+}
+
+// Options of the messageForwarder.
+func (f Forwarder) Options() []wsforwarder.Option {
+	return []wsforwarder.Option{
+		wsforwarder.WithQueueSize(f.QueueSize),
+		wsforwarder.WithOverflowPolicy(f.OverflowPolicy),
+		wsforwarder.WithSendTimeout(time.Duration(f.SendTimeout)),
+		wsforwarder.WithHistorySize(f.HistorySize),
+		wsforwarder.WithMaxRooms(f.MaxRooms),
+		wsforwarder.WithPingInterval(time.Duration(f.PingInterval)),
+		wsforwarder.WithIdleTimeout(time.Duration(f.IdleTimeout)),
+		wsforwarder.WithWriteTimeout(time.Duration(f.WriteTimeout)),
+		wsforwarder.WithSpeechQueue(f.SpeechQueue, nil),
+		wsforwarder.WithFilters(f.filters()...),
+	}
+}
+
+// filters of the messageForwarder: the filters, and then the arbiter.
+func (f Forwarder) filters() []wsforwarder.Filter {
+	filters := f.Filters.Filters()
+	if f.Arbiter.Enabled {
+		filters = append(filters, wsforwarder.NewArbiter(f.Arbiter.config()))
+	}
+	return filters
+}
+
+// SpeakEmotion configures the picking of the expression & motion of speak
+// requests from the emotion of their text.
+type SpeakEmotion struct {
+	Enabled   bool `json:"enabled" yaml:"enabled"`     // analyze speak.text, and map by the current profile
+	Sentences bool `json:"sentences" yaml:"sentences"` // analyze every sentence into a timeline of expression & motion changes
+}
+
+// Driver wraps the driver (can be the mapper, or drivers chained after it)
+// to fill the expression & motion of speak requests by the emotion of their
+// text, analyzed by the analyzer and mapped by the mapper (the profile
+// driver). Returns the driver as it is if disabled.
+func (s SpeakEmotion) Driver(driver, mapper live2ddriver.Live2DDriver, analyzer live2ddriver.EmotionAnalyzer) live2ddriver.Live2DDriver {
+	if !s.Enabled {
+		return driver
+	}
+	return live2ddriver.NewSpeakEmotionDriver(driver, mapper, analyzer, s.Sentences)
+}
+
+// TTS configures the synthesizing of speak requests with text but no audio.
+type TTS struct {
+	Backend string   `json:"backend" yaml:"backend"` // exec | http | mock. Empty to disable.
+	Command []string `json:"command" yaml:"command"` // exec: the command & arguments, with placeholders {text} {rate} {out}
+	URL     string   `json:"url" yaml:"url"`         // http: POST {"text", "speechRate"} to url for the audio
+	Timeout Duration `json:"timeout" yaml:"timeout"` // give up & speak without audio after timeout. 0 for no timeout.
+}
+
+// Backends of TTS.
+const (
+	ExecTTS = "exec"
+	HTTPTTS = "http"
+	MockTTS = "mock"
+)
+
+// backend creates the TTS backend. nil if disabled or unknown.
+func (t TTS) backend() live2ddriver.TTS {
+	switch t.Backend {
+	case ExecTTS:
+		return live2ddriver.NewExecTTS(t.Command...)
+	case HTTPTTS:
+		return live2ddriver.NewHTTPTTS(t.URL)
+	case MockTTS:
+		return live2ddriver.NewMockTTS()
+	}
+	return nil
+}
+
+// Driver wraps the driver (can be nil) to synthesize the audios of speak
+// requests after it. Returns the driver as it is if the TTS is disabled.
+func (t TTS) Driver(driver live2ddriver.Live2DDriver) live2ddriver.Live2DDriver {
+	backend := t.backend()
+	if backend == nil {
+		return driver
+	}
+	return live2ddriver.NewTTSDriver(driver, backend, time.Duration(t.Timeout))
+}
+
+// Audio configures the analyzing & hosting of speak audios.
+type Audio struct {
+	Analyze      bool        `json:"analyze" yaml:"analyze"`           // fill the duration & lip sync envelope of speak requests from the audio
+	Dir          string      `json:"dir" yaml:"dir"`                   // analyze local audio files under dir. Empty for data URIs only.
+	EnvelopeRate int         `json:"envelopeRate" yaml:"envelopeRate"` // frames per second of the lip sync envelope
+	TextLipSync  TextLipSync `json:"textLipSync" yaml:"textLipSync"`
+	Host         AudioHost   `json:"host" yaml:"host"`
+}
+
+// TextLipSync configures the synthesizing of lip sync keyframes from the
+// text of speak requests without audio.
+type TextLipSync struct {
+	Enabled    bool    `json:"enabled" yaml:"enabled"`
+	SpeechRate float64 `json:"speechRate" yaml:"speechRate"` // 1 for normal. Overridden by speak.speechRate.
+	Volume     float64 `json:"volume" yaml:"volume"`         // 0 ~ 1: how open the mouth gets. Overridden by speak.volume.
+}
+
+// AudioHost configures the hosting of short-lived audios on the http input:
+// POST /audio to upload, GET /audio/:id to fetch.
+type AudioHost struct {
+	Store     string   `json:"store" yaml:"store"`         // memory | disk. Empty to disable.
+	Dir       string   `json:"dir" yaml:"dir"`             // dir of the disk store
+	MaxSize   int64    `json:"maxSize" yaml:"maxSize"`     // max bytes of an audio
+	MaxTotal  int64    `json:"maxTotal" yaml:"maxTotal"`   // max bytes of all the audios kept. The oldest are evicted.
+	TTL       Duration `json:"ttl" yaml:"ttl"`             // audios expire ttl after uploaded
+	PublicURL string   `json:"publicURL" yaml:"publicURL"` // where the views reach the http input. Empty for http://localhost<inputs.http>.
+
+	RewriteDataURI bool `json:"rewriteDataURI" yaml:"rewriteDataURI"` // host the data URI audios of speak requests, and broadcast their urls instead
+}
+
+// Store types of AudioHost.
+const (
+	MemoryStore = "memory"
+	DiskStore   = "disk"
+)
+
+// AudioHost creates the audio host. nil if the hosting is disabled.
+func (c *Config) AudioHost() (*audiostore.Host, error) {
+	h := c.Audio.Host
+	opts := audiostore.Options{
+		MaxSize:  h.MaxSize,
+		MaxTotal: h.MaxTotal,
+		TTL:      time.Duration(h.TTL),
+	}
+
+	var store audiostore.Store
+	switch h.Store {
+	case "":
+		return nil, nil
+	case MemoryStore:
+		store = audiostore.NewMemoryStore(opts)
+	case DiskStore:
+		var err error
+		if store, err = audiostore.NewDiskStore(h.Dir, opts); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown audio store %q", ErrInvalidConfig, h.Store)
+	}
+
+	publicURL := h.PublicURL
+	if publicURL == "" {
+		publicURL = localURL(c.Inputs.HTTPAddr)
+	}
+
+	return audiostore.NewHost(store, publicURL), nil
+}
+
+// localURL returns the http url of the listening addr on this host.
+func localURL(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "http://localhost" + addr
+	}
+	return "http://" + addr
+}
+
+// Driver wraps the driver (can be nil) to analyze the audios of speak
+// requests after it (or synthesize the lip sync from the text if no audio),
+// and then to rewrite the data URI audios to the urls hosted by host (nil
+// if the hosting is disabled).
+// Returns the driver as it is if none is on.
+func (a Audio) Driver(driver live2ddriver.Live2DDriver, host *audiostore.Host) live2ddriver.Live2DDriver {
+	if a.Analyze {
+		loader := live2ddriver.NewAudioLoader(a.Dir)
+		if host != nil {
+			loader = host.Loader(loader)
+		}
+		driver = live2ddriver.NewAudioDriver(driver, loader, a.EnvelopeRate)
+	}
+	if a.TextLipSync.Enabled {
+		driver = live2ddriver.NewTextLipSyncDriver(driver, a.TextLipSync.SpeechRate, a.TextLipSync.Volume)
+	}
+	if host != nil && a.Host.RewriteDataURI {
+		driver = host.Driver(driver)
+	}
+	return driver
+}
+
+// Macros configures the named choreography scripts, see package macro.
+type Macros struct {
+	Dir string `json:"dir" yaml:"dir"` // dir of the scripts: <name>.yaml | .json | .jsonl. Empty to disable.
+}
+
+func (c *Config) validateMacros() error {
+	if c.Macros.Dir == "" {
+		return nil
+	}
+	if c.Inputs.HTTPAddr == "" {
+		return fmt.Errorf("%w: macros require the http input", ErrInvalidConfig)
+	}
+	macros, err := macro.LoadAll(c.Macros.Dir)
+	if err != nil {
+		return fmt.Errorf("%w: macros: %v", ErrInvalidConfig, err)
+	}
+	// speeches are waited for in the speech queue: without it, macros
+	// would run on at once
+	for name, steps := range macros {
+		for i, s := range steps {
+			if s.WaitSpeech && !c.Forwarder.SpeechQueue {
+				return fmt.Errorf("%w: macro %q: step %d: waitSpeech requires the forwarder speechQueue", ErrInvalidConfig, name, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Record configures the recording of the traffic, see
+// wsforwarder.WithRecorder.
+type Record struct {
+	File string `json:"file" yaml:"file"` // append the inbound & outbound messages to the JSONL file. Empty to disable.
+}
+
+// Replay configures the replay mode: a recording is re-forwarded once a
+// view connects. See wsforwarder.Replay.
+type Replay struct {
+	File      string                `json:"file" yaml:"file"`           // the JSONL recording. Empty to disable.
+	Speed     float64               `json:"speed" yaml:"speed"`         // 1: the recorded pacing, 2: twice as fast, 0: no pacing
+	Direction wsforwarder.Direction `json:"direction" yaml:"direction"` // out: what the views got, as is | in: the inputs, driven again
+	Room      string                `json:"room" yaml:"room"`           // replay into the room, rather than the recorded rooms
+}
+
+// Options returns the wsforwarder.ReplayOptions.
+func (r Replay) Options() wsforwarder.ReplayOptions {
+	return wsforwarder.ReplayOptions{
+		Speed: r.Speed,
+		Dir:   r.Direction,
+		Room:  r.Room,
+	}
+}
+
+func (c *Config) validateReplay() error {
+	if c.Replay.File == "" {
+		return nil
+	}
+	if err := c.Replay.Options().Validate(); err != nil {
+		return fmt.Errorf("%w: replay: %v", ErrInvalidConfig, err)
+	}
+	if filepath.Clean(c.Replay.File) == filepath.Clean(c.Record.File) {
+		return fmt.Errorf("%w: replay file %q is the record file", ErrInvalidConfig, c.Replay.File)
+	}
+	if _, err := wsforwarder.LoadRecords(c.Replay.File); err != nil {
+		return fmt.Errorf("%w: replay: %v", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// Default returns the default Config, the same as the defaults of CLI flags.
+func Default() *Config {
+	return &Config{
+		WsAddr: ":9001",
+		Inputs: Inputs{
+			HTTPAddr: ":9002",
+		},
+		Forwarder: Forwarder{
+			QueueSize:      wsforwarder.BufferSize,
+			OverflowPolicy: wsforwarder.DropOldest,
+			HistorySize:    wsforwarder.HistorySize,
+			MaxRooms:       wsforwarder.MaxRooms,
+			PingInterval:   Duration(wsforwarder.PingInterval),
+			IdleTimeout:    Duration(wsforwarder.IdleTimeout),
+			WriteTimeout:   Duration(wsforwarder.WriteTimeout),
+			Filters: Filters{
+				Builtin: true,
+			},
+			Arbiter: Arbiter{
+				DefaultPriority: live2ddriver.PriorityChat,
+				MotionHold:      Duration(3 * time.Second),
+				ExpressionDwell: Duration(5 * time.Second),
+			},
+		},
+		TTS: TTS{
+			Timeout: Duration(30 * time.Second),
+		},
+		Audio: Audio{
+			Analyze:      true,
+			EnvelopeRate: live2ddriver.DefaultEnvelopeRate,
+			TextLipSync: TextLipSync{
+				Enabled:    true,
+				SpeechRate: 1,
+				Volume:     1,
+			},
+			Host: AudioHost{
+				MaxSize:  audiostore.MaxSize,
+				MaxTotal: audiostore.MaxTotal,
+				TTL:      Duration(audiostore.TTL),
+			},
+		},
+		Replay: Replay{
+			Speed:     1,
+			Direction: wsforwarder.DirOut,
+		},
+		Profiles: map[string]live2ddriver.Profile{},
+	}
+}
+
+// Load the Config file on the top of Default.
+// The file is decoded as YAML if its extension is .yaml or .yml,
+// otherwise as JSON.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Default()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	default:
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+
+	if c.Profiles == nil {
+		c.Profiles = map[string]live2ddriver.Profile{}
+	}
+
+	return c, nil
+}
+
+// Validate the Config.
+func (c *Config) Validate() error {
+	if c.WsAddr == "" {
+		return fmt.Errorf("%w: empty ws address", ErrInvalidConfig)
+	}
+
+	if !c.Inputs.Stdin && c.Inputs.HTTPAddr == "" && c.Inputs.DriverAddr == "" {
+		return fmt.Errorf("%w: no input source: stdin or http or driver is required", ErrInvalidConfig)
+	}
+
+	if c.Inputs.DriverAddr != "" && len(c.Profiles) == 0 {
+		return fmt.Errorf("%w: text-in driver requires at least one profile", ErrInvalidConfig)
+	}
+	if c.SpeakEmotion.Enabled && len(c.Profiles) == 0 {
+		return fmt.Errorf("%w: speakEmotion requires at least one profile", ErrInvalidConfig)
+	}
+
+	if c.Forwarder.QueueSize < 1 {
+		return fmt.Errorf("%w: forwarder queueSize must be positive", ErrInvalidConfig)
+	}
+	if !wsforwarder.ValidOverflowPolicy(c.Forwarder.OverflowPolicy) {
+		return fmt.Errorf("%w: unknown forwarder overflowPolicy %q", ErrInvalidConfig, c.Forwarder.OverflowPolicy)
+	}
+	if c.Forwarder.HistorySize < 1 {
+		return fmt.Errorf("%w: forwarder historySize must be positive", ErrInvalidConfig)
+	}
+	if c.Forwarder.MaxRooms < 0 {
+		return fmt.Errorf("%w: negative forwarder maxRooms", ErrInvalidConfig)
+	}
+	if c.Forwarder.SendTimeout < 0 || c.Forwarder.PingInterval < 0 || c.Forwarder.IdleTimeout < 0 || c.Forwarder.WriteTimeout < 0 {
+		return fmt.Errorf("%w: negative forwarder timeout", ErrInvalidConfig)
+	}
+	for i, r := range c.Forwarder.Filters.Rules {
+		if err := r.rule().Validate(); err != nil {
+			return fmt.Errorf("%w: forwarder filters rule %d: %v", ErrInvalidConfig, i, err)
+		}
+	}
+	if err := c.Forwarder.Arbiter.config().Validate(); c.Forwarder.Arbiter.Enabled && err != nil {
+		return fmt.Errorf("%w: forwarder arbiter: %v", ErrInvalidConfig, err)
+	}
+
+	if err := c.validateTTS(); err != nil {
+		return err
+	}
+
+	if c.Audio.Analyze && c.Audio.EnvelopeRate < 1 {
+		return fmt.Errorf("%w: audio envelopeRate must be positive", ErrInvalidConfig)
+	}
+	if c.Audio.Dir != "" {
+		if fi, err := os.Stat(c.Audio.Dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("%w: audio dir %q is not a directory", ErrInvalidConfig, c.Audio.Dir)
+		}
+	}
+	if t := c.Audio.TextLipSync; t.Enabled && (t.SpeechRate <= 0 || t.Volume <= 0 || t.Volume > 1) {
+		return fmt.Errorf("%w: textLipSync speechRate must be positive, volume in (0, 1]", ErrInvalidConfig)
+	}
+	if err := c.validateAudioHost(); err != nil {
+		return err
+	}
+	if err := c.validateMacros(); err != nil {
+		return err
+	}
+	if err := c.validateReplay(); err != nil {
+		return err
+	}
+
+	if _, ok := c.Profiles[c.DefaultProfile]; c.DefaultProfile != "" && !ok {
+		return fmt.Errorf("%w: default profile %q not found", ErrInvalidConfig, c.DefaultProfile)
+	}
+
+	for name, p := range c.Profiles {
+		if _, err := p.EmoMapper.Create(); err != nil {
+			return fmt.Errorf("%w: profile %q: %v", ErrInvalidConfig, name, err)
+		}
+		if err := p.Idle.Validate(); err != nil {
+			return fmt.Errorf("%w: profile %q: %v", ErrInvalidConfig, name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateTTS() error {
+	t := c.TTS
+
+	switch t.Backend {
+	case "", MockTTS:
+	case ExecTTS:
+		if len(t.Command) == 0 || t.Command[0] == "" {
+			return fmt.Errorf("%w: exec tts requires a command", ErrInvalidConfig)
+		}
+	case HTTPTTS:
+		if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("%w: http tts requires an http(s) url, got %q", ErrInvalidConfig, t.URL)
+		}
+	default:
+		return fmt.Errorf("%w: unknown tts backend %q: want %q, %q or %q", ErrInvalidConfig, t.Backend, ExecTTS, HTTPTTS, MockTTS)
+	}
+
+	if t.Timeout < 0 {
+		return fmt.Errorf("%w: negative tts timeout", ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+func (c *Config) validateAudioHost() error {
+	h := c.Audio.Host
+
+	switch h.Store {
+	case "":
+		if h.RewriteDataURI {
+			return fmt.Errorf("%w: audio rewriteDataURI requires an audio store", ErrInvalidConfig)
+		}
+		return nil
+	case MemoryStore:
+	case DiskStore:
+		if h.Dir == "" {
+			return fmt.Errorf("%w: disk audio store requires a dir", ErrInvalidConfig)
+		}
+	default:
+		return fmt.Errorf("%w: unknown audio store %q: want %q or %q", ErrInvalidConfig, h.Store, MemoryStore, DiskStore)
+	}
+
+	if c.Inputs.HTTPAddr == "" {
+		return fmt.Errorf("%w: audio store requires the http input", ErrInvalidConfig)
+	}
+	if h.MaxSize < 0 || h.MaxTotal < 0 || h.TTL < 0 {
+		return fmt.Errorf("%w: negative audio host limit", ErrInvalidConfig)
+	}
+	if h.MaxSize > live2ddriver.MaxAudioSize {
+		return fmt.Errorf("%w: audio maxSize exceeds %d", ErrInvalidConfig, live2ddriver.MaxAudioSize)
+	}
+
+	return nil
+}
+
+var ErrInvalidConfig = errors.New("invalid config")
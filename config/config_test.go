@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"live2ddriver/live2ddriver"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	yamlConfig := `
+ws: ":9101"
+forwarder:
+  overflowPolicy: coalesce
+  sendTimeout: 100ms
+  filters:
+    rules:
+      - name: noIdleAfterEmotion
+        match: {motion: idle}
+        after: {motion: "*", emotion: true}
+        within: 2s
+        action: strip
+inputs:
+  driver: ":9104"
+defaultProfile: hiyori
+profiles:
+  hiyori:
+    model: https://example.com/hiyori.model3.json
+    emoMapper:
+      type: stateless
+      config:
+        motionFromEmotion:
+          happiness: TapBody
+        expressionFromPolarity:
+          positive: F01
+    idle:
+      after: 1m
+      minInterval: 8
+      maxInterval: 12.5s
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if c.WsAddr != ":9101" {
+		t.Errorf("WsAddr = %q, want %q", c.WsAddr, ":9101")
+	}
+	if c.Inputs.HTTPAddr != Default().Inputs.HTTPAddr {
+		t.Errorf("Inputs.HTTPAddr = %q, want default %q", c.Inputs.HTTPAddr, Default().Inputs.HTTPAddr)
+	}
+	if c.Forwarder.OverflowPolicy != "coalesce" || c.Forwarder.SendTimeout != Duration(100*time.Millisecond) {
+		t.Errorf("Forwarder = %+v, want coalesce & 100ms", c.Forwarder)
+	}
+	if c.Forwarder.SpeechQueue {
+		t.Errorf("Forwarder.SpeechQueue = true, want opt-in")
+	}
+	if f := c.Forwarder.Filters; !f.Builtin || len(f.Rules) != 1 || f.Rules[0].Within != Duration(2*time.Second) || !f.Rules[0].After.Emotion {
+		t.Errorf("Forwarder.Filters = %+v, want builtin & the rule", f)
+	}
+	if c.Profiles["hiyori"].EmoMapper.Config.MotionFromEmotion["happiness"] != "TapBody" {
+		t.Errorf("Profiles[hiyori] = %+v, want motion TapBody for happiness", c.Profiles["hiyori"])
+	}
+	if idle := c.Profiles["hiyori"].Idle; time.Duration(idle.After) != time.Minute ||
+		time.Duration(idle.MinInterval) != 8*time.Second || time.Duration(idle.MaxInterval) != 12500*time.Millisecond {
+		t.Errorf("Profiles[hiyori].Idle = %+v, want 1m, 8s (as seconds) & 12.5s", idle)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"NoWs", func(c *Config) { c.WsAddr = "" }},
+		{"NoInput", func(c *Config) { c.Inputs.HTTPAddr = "" }},
+		{"DriverWithoutProfile", func(c *Config) { c.Inputs.DriverAddr = ":9104" }},
+		{"DefaultProfileNotFound", func(c *Config) { c.DefaultProfile = "hiyori" }},
+		{"NegativeMaxRooms", func(c *Config) { c.Forwarder.MaxRooms = -1 }},
+		{"UnknownOverflowPolicy", func(c *Config) { c.Forwarder.OverflowPolicy = "block" }},
+		{"UnknownPriority", func(c *Config) { c.Forwarder.Arbiter.Enabled = true; c.Forwarder.Arbiter.DefaultPriority = "urgent" }},
+		{"InvalidIdle", func(c *Config) {
+			c.Profiles["shizuku"] = live2ddriver.Profile{
+				EmoMapper: live2ddriver.EmoMapperFactory{
+					Type: live2ddriver.StatelessEmoMapperType,
+					Config: live2ddriver.EmoMapperConfig{
+						MotionFromEmotion:      map[live2ddriver.EmotionsKey]live2ddriver.Motion{"happiness": "tap_body"},
+						ExpressionFromPolarity: map[live2ddriver.PolarityKey]live2ddriver.Expression{"positive": "f04"},
+					},
+				},
+				Idle: live2ddriver.IdleBehavior{Enabled: true},
+			}
+		}},
+		{"MacrosDirNotFound", func(c *Config) { c.Macros.Dir = "/no/such/dir" }},
+		{"ReplayFileNotFound", func(c *Config) { c.Replay.File = "/no/such/traffic.jsonl" }},
+		{"ReplayTheRecordFile", func(c *Config) { c.Replay.File = "traffic.jsonl"; c.Record.File = "./traffic.jsonl" }},
+		{"NegativeReplaySpeed", func(c *Config) { c.Replay.File = "traffic.jsonl"; c.Replay.Speed = -1 }},
+		{"EmptyFilterRule", func(c *Config) { c.Forwarder.Filters.Rules = []FilterRule{{Name: "nothing"}} }},
+		{"NoEnvelopeRate", func(c *Config) { c.Audio.EnvelopeRate = 0 }},
+		{"AudioDirNotFound", func(c *Config) { c.Audio.Dir = "/no/such/dir" }},
+		{"TextLipSyncVolume", func(c *Config) { c.Audio.TextLipSync.Volume = 2 }},
+		{"SpeakEmotionWithoutProfile", func(c *Config) { c.SpeakEmotion.Enabled = true }},
+		{"UnknownTTS", func(c *Config) { c.TTS.Backend = "siri" }},
+		{"ExecTTSWithoutCommand", func(c *Config) { c.TTS.Backend = ExecTTS }},
+		{"HTTPTTSWithoutURL", func(c *Config) { c.TTS.Backend = HTTPTTS }},
+		{"UnknownAudioStore", func(c *Config) { c.Audio.Host.Store = "s3" }},
+		{"DiskAudioStoreWithoutDir", func(c *Config) { c.Audio.Host.Store = DiskStore }},
+		{"AudioStoreWithoutHTTP", func(c *Config) { c.Audio.Host.Store = MemoryStore; c.Inputs.HTTPAddr = ""; c.Inputs.Stdin = true }},
+		{"RewriteWithoutAudioStore", func(c *Config) { c.Audio.Host.RewriteDataURI = true }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Default()
+			tc.modify(c)
+			if err := c.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Validate() = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+func TestConfig_validateMacros(t *testing.T) {
+	dir := t.TempDir()
+	script := `{"speak": {"text": "晚安"}}
+{"waitSpeech": true}
+{"motion": "bow"}`
+	if err := os.WriteFile(filepath.Join(dir, "goodnight.jsonl"), []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Default()
+	c.Macros.Dir = dir
+	if err := c.Validate(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Validate() without speechQueue = %v, want ErrInvalidConfig", err)
+	}
+
+	c.Forwarder.SpeechQueue = true
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() with speechQueue = %v", err)
+	}
+}
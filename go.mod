@@ -8,6 +8,7 @@ require (
 	github.com/murchinroom/emotextcligo v0.0.1
 	golang.org/x/exp v0.0.0-20230210204819-062eb4c674ab
 	golang.org/x/net v0.5.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -27,5 +28,4 @@ require (
 	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/text v0.6.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,311 @@
+package live2ddriver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// AudioInfo is the result of analyzing an audio.
+type AudioInfo struct {
+	Format   string        // "wav" or "mp3"
+	Duration time.Duration // length of the audio
+	LipSync  *LipSync      // mouth-open envelope. nil if the audio can not be decoded (e.g. mp3)
+}
+
+// DefaultEnvelopeRate is the default frame rate of LipSync envelopes.
+const DefaultEnvelopeRate = 30
+
+var (
+	ErrUnsupportedAudio = errors.New("unsupported audio format")
+	ErrInvalidAudio     = errors.New("invalid audio")
+)
+
+// AnalyzeAudio computes the duration & the mouth-open envelope (at rate
+// frames per second) of the WAV or MP3 audio data.
+//
+// WAV (PCM 8/16/24/32-bit or 32-bit float) is decoded for the envelope.
+// MP3 is not decoded: only the duration is computed, from the frame headers.
+func AnalyzeAudio(data []byte, rate int) (AudioInfo, error) {
+	if rate <= 0 {
+		rate = DefaultEnvelopeRate
+	}
+
+	switch {
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return analyzeWAV(data, rate)
+	case len(data) >= 3 && string(data[0:3]) == "ID3",
+		len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		d, err := mp3Duration(data)
+		return AudioInfo{Format: "mp3", Duration: d}, err
+	}
+	return AudioInfo{}, ErrUnsupportedAudio
+}
+
+// region WAV
+
+// wavFormat is the fmt chunk of a WAV file.
+type wavFormat struct {
+	audioFormat   uint16 // 1: PCM, 3: IEEE float, 0xFFFE: extensible
+	channels      int
+	sampleRate    int
+	blockAlign    int
+	bitsPerSample int
+}
+
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xFFFE
+)
+
+func analyzeWAV(data []byte, rate int) (AudioInfo, error) {
+	var format *wavFormat
+	var samples []byte
+
+	// chunks
+	for p := 12; p+8 <= len(data); {
+		id, size := string(data[p:p+4]), int(binary.LittleEndian.Uint32(data[p+4:p+8]))
+		body := data[p+8:]
+		if size > len(body) || size < 0 {
+			size = len(body) // truncated, e.g. streamed WAVs with size unset
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return AudioInfo{}, fmt.Errorf("%w: short fmt chunk", ErrInvalidAudio)
+			}
+			format = &wavFormat{
+				audioFormat:   binary.LittleEndian.Uint16(body[0:2]),
+				channels:      int(binary.LittleEndian.Uint16(body[2:4])),
+				sampleRate:    int(binary.LittleEndian.Uint32(body[4:8])),
+				blockAlign:    int(binary.LittleEndian.Uint16(body[12:14])),
+				bitsPerSample: int(binary.LittleEndian.Uint16(body[14:16])),
+			}
+			if format.audioFormat == wavExtensible && size >= 26 {
+				format.audioFormat = binary.LittleEndian.Uint16(body[24:26]) // sub format
+			}
+		case "data":
+			samples = body
+		}
+
+		p += 8 + size + size%2 // chunks are word aligned
+	}
+
+	if format == nil || samples == nil {
+		return AudioInfo{}, fmt.Errorf("%w: missing fmt or data chunk", ErrInvalidAudio)
+	}
+	if format.channels <= 0 || format.sampleRate <= 0 || format.blockAlign <= 0 {
+		return AudioInfo{}, fmt.Errorf("%w: bad fmt chunk", ErrInvalidAudio)
+	}
+
+	sample, err := format.decoder()
+	if err != nil {
+		return AudioInfo{}, err
+	}
+
+	frames := len(samples) / format.blockAlign
+	info := AudioInfo{
+		Format:   "wav",
+		Duration: time.Duration(frames) * time.Second / time.Duration(format.sampleRate),
+	}
+
+	// RMS of every window of 1/rate second, over every channel
+	window := format.sampleRate / rate
+	if window < 1 {
+		window = 1
+	}
+	bytesPerSample := format.bitsPerSample / 8
+
+	rms := make([]float64, 0, frames/window+1)
+	for start := 0; start < frames; start += window {
+		end := start + window
+		if end > frames {
+			end = frames
+		}
+
+		var sum float64
+		var n int
+		for i := start; i < end; i++ {
+			frame := samples[i*format.blockAlign:]
+			for ch := 0; ch < format.channels; ch++ {
+				v := sample(frame[ch*bytesPerSample:])
+				sum += v * v
+				n++
+			}
+		}
+		rms = append(rms, math.Sqrt(sum/float64(n)))
+	}
+
+	info.LipSync = &LipSync{Rate: rate, MouthOpen: envelope(rms)}
+	return info, nil
+}
+
+// decoder returns the function to decode a sample into [-1, 1].
+func (f *wavFormat) decoder() (func(b []byte) float64, error) {
+	if f.blockAlign < f.channels*f.bitsPerSample/8 {
+		return nil, fmt.Errorf("%w: bad block align", ErrInvalidAudio)
+	}
+
+	switch {
+	case f.audioFormat == wavPCM && f.bitsPerSample == 8: // unsigned
+		return func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }, nil
+	case f.audioFormat == wavPCM && f.bitsPerSample == 16:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }, nil
+	case f.audioFormat == wavPCM && f.bitsPerSample == 24:
+		return func(b []byte) float64 {
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			return float64(v) / (1 << 23)
+		}, nil
+	case f.audioFormat == wavPCM && f.bitsPerSample == 32:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }, nil
+	case f.audioFormat == wavFloat && f.bitsPerSample == 32:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }, nil
+	}
+	return nil, fmt.Errorf("%w: wav format %d, %d bits", ErrUnsupportedAudio, f.audioFormat, f.bitsPerSample)
+}
+
+// envelopeNoiseFloor is the RMS under which the mouth is taken as closed.
+const envelopeNoiseFloor = 0.01
+
+// envelope normalizes the RMS values into mouth-open values in [0, 1]:
+// relative to the peak, rounded to 2 decimals.
+func envelope(rms []float64) []float32 {
+	peak := 0.0
+	for _, v := range rms {
+		peak = math.Max(peak, v)
+	}
+
+	open := make([]float32, len(rms))
+	if peak < envelopeNoiseFloor {
+		return open // silence
+	}
+	for i, v := range rms {
+		if v < envelopeNoiseFloor {
+			continue
+		}
+		open[i] = float32(math.Round(v/peak*100) / 100)
+	}
+	return open
+}
+
+// endregion WAV
+
+// region MP3
+
+// mp3Duration computes the duration of the MP3 data by summing its frames.
+func mp3Duration(data []byte) (time.Duration, error) {
+	p := skipID3v2(data)
+
+	var seconds float64
+	var frames int
+	for p+4 <= len(data) {
+		if string(data[p:p+3]) == "TAG" { // ID3v1 at the end
+			break
+		}
+
+		h, ok := parseMP3Header(data[p : p+4])
+		if !ok {
+			p++ // resync
+			continue
+		}
+
+		seconds += float64(h.samples) / float64(h.sampleRate)
+		frames++
+		p += h.length
+	}
+
+	if frames == 0 {
+		return 0, fmt.Errorf("%w: no mp3 frame found", ErrInvalidAudio)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// skipID3v2 returns the offset after the ID3v2 tag, if any.
+func skipID3v2(data []byte) int {
+	if len(data) < 10 || string(data[0:3]) != "ID3" {
+		return 0
+	}
+	// syncsafe integer: 7 bits per byte
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	if data[5]&0x10 != 0 { // footer
+		size += 10
+	}
+	return 10 + size
+}
+
+// mp3Header is the header of a MP3 (MPEG audio) frame.
+type mp3Header struct {
+	sampleRate int
+	samples    int // per frame
+	length     int // frame length in bytes
+}
+
+var (
+	// kbps by [version is MPEG1][layer][index]
+	mp3Bitrates = [2][4][16]int{
+		{ // MPEG2 & 2.5
+			{},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // layer III
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // layer II
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256}, // layer I
+		},
+		{ // MPEG1
+			{},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // layer III
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // layer II
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // layer I
+		},
+	}
+	// Hz by [version][index]. version: 0: MPEG2.5, 2: MPEG2, 3: MPEG1
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},
+		{},
+		{22050, 24000, 16000},
+		{44100, 48000, 32000},
+	}
+)
+
+// parseMP3Header parses the 4-byte frame header.
+func parseMP3Header(b []byte) (h mp3Header, ok bool) {
+	if b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return h, false
+	}
+
+	version := int(b[1]>>3) & 0x3 // 0: 2.5, 1: reserved, 2: 2, 3: 1
+	layer := int(b[1]>>1) & 0x3   // 1: III, 2: II, 3: I
+	bitrateIndex := int(b[2] >> 4)
+	sampleRateIndex := int(b[2]>>2) & 0x3
+	padding := int(b[2]>>1) & 0x1
+
+	if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return h, false
+	}
+
+	mpeg1 := 0
+	if version == 3 {
+		mpeg1 = 1
+	}
+	bitrate := mp3Bitrates[mpeg1][layer][bitrateIndex] * 1000
+	h.sampleRate = mp3SampleRates[version][sampleRateIndex]
+
+	switch {
+	case layer == 3: // I
+		h.samples = 384
+		h.length = (12*bitrate/h.sampleRate + padding) * 4
+	case layer == 2 || mpeg1 == 1: // II, or III of MPEG1
+		h.samples = 1152
+		h.length = 144*bitrate/h.sampleRate + padding
+	default: // III of MPEG2 & 2.5
+		h.samples = 576
+		h.length = 72*bitrate/h.sampleRate + padding
+	}
+
+	return h, h.length > 4
+}
+
+// endregion MP3
@@ -0,0 +1,105 @@
+package live2ddriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// testWAV returns a 16-bit PCM WAV: a 440Hz sine of the amplitude for
+// every 1/10 second.
+func testWAV(sampleRate, channels int, amplitudes ...float64) []byte {
+	var samples bytes.Buffer
+	for i, amp := range amplitudes {
+		for j := 0; j < sampleRate/10; j++ {
+			t := float64(i*sampleRate/10+j) / float64(sampleRate)
+			v := int16(amp * math.Sin(2*math.Pi*440*t) * math.MaxInt16)
+			for ch := 0; ch < channels; ch++ {
+				_ = binary.Write(&samples, binary.LittleEndian, v)
+			}
+		}
+	}
+
+	var wav bytes.Buffer
+	le := func(v interface{}) { _ = binary.Write(&wav, binary.LittleEndian, v) }
+
+	wav.WriteString("RIFF")
+	le(uint32(36 + samples.Len()))
+	wav.WriteString("WAVE")
+
+	wav.WriteString("fmt ")
+	le(uint32(16))
+	le(uint16(1)) // PCM
+	le(uint16(channels))
+	le(uint32(sampleRate))
+	le(uint32(sampleRate * channels * 2))
+	le(uint16(channels * 2))
+	le(uint16(16))
+
+	wav.WriteString("data")
+	le(uint32(samples.Len()))
+	wav.Write(samples.Bytes())
+
+	return wav.Bytes()
+}
+
+// testMP3 returns n silent MPEG1 layer III frames of 128kbps, 44100Hz,
+// after an ID3v2 tag.
+func testMP3(n int) []byte {
+	var mp3 bytes.Buffer
+	mp3.Write([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 10})
+	mp3.Write(make([]byte, 10))
+
+	frame := make([]byte, 417) // 144 * 128000 / 44100
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	for i := 0; i < n; i++ {
+		mp3.Write(frame)
+	}
+	return mp3.Bytes()
+}
+
+func TestAnalyzeAudio(t *testing.T) {
+	t.Run("WAV", func(t *testing.T) {
+		info, err := AnalyzeAudio(testWAV(8000, 2, 0, 1, 0.5, 0), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Format != "wav" || info.Duration != 400*time.Millisecond {
+			t.Errorf("AnalyzeAudio() = %s, %v, want wav, 400ms", info.Format, info.Duration)
+		}
+
+		want := []float32{0, 1, 0.5, 0}
+		if info.LipSync == nil || info.LipSync.Rate != 10 || len(info.LipSync.MouthOpen) != len(want) {
+			t.Fatalf("AnalyzeAudio() LipSync = %+v, want %v at 10 fps", info.LipSync, want)
+		}
+		for i, v := range info.LipSync.MouthOpen {
+			if math.Abs(float64(v-want[i])) > 0.02 {
+				t.Errorf("MouthOpen = %v, want %v", info.LipSync.MouthOpen, want)
+				break
+			}
+		}
+	})
+
+	t.Run("MP3", func(t *testing.T) {
+		info, err := AnalyzeAudio(testMP3(100), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 100 * 1152 * time.Second / 44100
+		if info.Format != "mp3" || info.Duration.Round(time.Millisecond) != want.Round(time.Millisecond) || info.LipSync != nil {
+			t.Errorf("AnalyzeAudio() = %+v, want mp3 of %v, no LipSync", info, want)
+		}
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		if _, err := AnalyzeAudio([]byte("OggS...."), 0); !errors.Is(err, ErrUnsupportedAudio) {
+			t.Errorf("AnalyzeAudio() error = %v, want ErrUnsupportedAudio", err)
+		}
+		if _, err := AnalyzeAudio([]byte("RIFF\x00\x00\x00\x00WAVE"), 0); !errors.Is(err, ErrInvalidAudio) {
+			t.Errorf("AnalyzeAudio() error = %v, want ErrInvalidAudio", err)
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package live2ddriver
+
+import "sync"
+
+// Live2DDriver is the interface for the universal (model-agnostic) drivers.
+//
+// A Live2DDriver drives a Live2DRequest into the one that Live2DView can
+// understand, e.g. map the Emotion field into Motion & Expression.
+type Live2DDriver interface {
+	Drive(req Live2DRequest) Live2DRequest
+}
+
+// emotionDriver is a Live2DDriver that maps the Emotion field of requests
+// into Motion & Expression by an EmotionExpressionMapper.
+//
+// Motion & Expression given explicitly in the request take precedence over
+// the mapped ones. The Emotion field is consumed (set to nil) after driving.
+type emotionDriver struct {
+	mapper EmotionExpressionMapper
+	mu     sync.Mutex // mappers (e.g. statefulEmoMapper) are not goroutine-safe
+}
+
+// NewEmotionDriver returns a Live2DDriver that maps Emotion to Motion &
+// Expression by the given mapper.
+func NewEmotionDriver(mapper EmotionExpressionMapper) Live2DDriver {
+	return &emotionDriver{mapper: mapper}
+}
+
+func (d *emotionDriver) Drive(req Live2DRequest) Live2DRequest {
+	if req.Emotion == nil {
+		return req
+	}
+
+	d.mu.Lock()
+	motion, expression := d.mapper.Map(*req.Emotion)
+	d.mu.Unlock()
+
+	if req.Motion == "" {
+		req.Motion = string(motion)
+	}
+	if req.Expression == "" {
+		req.Expression = string(expression)
+	}
+	req.Emotion = nil
+
+	return req
+}
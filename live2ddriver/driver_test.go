@@ -0,0 +1,46 @@
+package live2ddriver
+
+import "testing"
+
+func TestEmotionDriver_Drive(t *testing.T) {
+	driver := NewEmotionDriver(NewStatelessEmoMapper(
+		map[EmotionsKey]Motion{"happiness": "tap_body"},
+		map[PolarityKey]Expression{"positive": "f04"},
+	))
+
+	emo := Emotion{
+		Emotions: map[EmotionsKey]float32{"happiness": 1.0},
+		Polarity: map[PolarityKey]float32{"positive": 1.0},
+	}
+
+	testCases := []struct {
+		name string
+		req  Live2DRequest
+		want Live2DRequest
+	}{
+		{
+			name: "NoEmotion",
+			req:  Live2DRequest{Motion: "shake"},
+			want: Live2DRequest{Motion: "shake"},
+		},
+		{
+			name: "Emotion",
+			req:  Live2DRequest{Emotion: &emo},
+			want: Live2DRequest{Motion: "tap_body", Expression: "f04"},
+		},
+		{
+			name: "EmotionWithExplicitMotion",
+			req:  Live2DRequest{Motion: "shake", Emotion: &emo},
+			want: Live2DRequest{Motion: "shake", Expression: "f04"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := driver.Drive(tc.req)
+			if got.Motion != tc.want.Motion || got.Expression != tc.want.Expression || got.Emotion != nil {
+				t.Errorf("Drive(%+v) = %+v, want %+v", tc.req, got, tc.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,14 @@
 package live2ddriver
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
 )
 
 //// Factory ////
@@ -11,8 +17,32 @@ import (
 // based on encodable configuration.
 // (from YAML config file to EmotionExpressionMapper)
 type EmoMapperFactory struct {
-	Type   MapperType
-	Config EmoMapperConfig
+	Type   MapperType      `json:"type" yaml:"type"`
+	Config EmoMapperConfig `json:"config" yaml:"config"`
+}
+
+// LoadEmoMapperFactory reads an EmoMapperFactory from the config file.
+// The file is decoded as YAML if its extension is .yaml or .yml,
+// otherwise as JSON.
+func LoadEmoMapperFactory(path string) (*EmoMapperFactory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f EmoMapperFactory
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &f)
+	default:
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEmoMapperConfig, err)
+	}
+
+	return &f, nil
 }
 
 // Create an EmotionExpressionMapper based on the factory configuration.
@@ -31,6 +61,31 @@ func (f *EmoMapperFactory) Create() (EmotionExpressionMapper, error) {
 	}
 }
 
+//// builtin ////
+
+// builtinProfiles are the Profiles shipped with live2ddriver.
+// Model specific files (e.g. shizuku.go) register theirs here.
+var builtinProfiles = map[string]Profile{}
+
+// BuiltinProfile returns the built-in Profile by name (e.g. "shizuku").
+func BuiltinProfile(name string) (*Profile, bool) {
+	p, ok := builtinProfiles[name]
+	if !ok {
+		return nil, false
+	}
+	return &p, true
+}
+
+// BuiltinEmoMapperFactory returns the EmoMapperFactory of the built-in
+// Profile by name (e.g. "shizuku").
+func BuiltinEmoMapperFactory(name string) (*EmoMapperFactory, bool) {
+	p, ok := BuiltinProfile(name)
+	if !ok {
+		return nil, false
+	}
+	return &p.EmoMapper, true
+}
+
 //// arg Type ////
 
 // MapperType is an encodable representation of EmotionExpressionMapper type.
@@ -46,9 +101,9 @@ const (
 // EmoMapperConfig is the configuration for EmotionExpressionMapper.
 type EmoMapperConfig struct {
 	// Emotion => Motion, e.g. "happiness" => "happy"
-	MotionFromEmotion map[EmotionsKey]Motion // 其实就是 map[string]string
+	MotionFromEmotion map[EmotionsKey]Motion `json:"motionFromEmotion" yaml:"motionFromEmotion"` // 其实就是 map[string]string
 	// Polarity => Expression, e.g. "positive" => "smile"
-	ExpressionFromPolarity map[PolarityKey]Expression // 其实就是 map[string]string
+	ExpressionFromPolarity map[PolarityKey]Expression `json:"expressionFromPolarity" yaml:"expressionFromPolarity"` // 其实就是 map[string]string
 }
 
 func (c *EmoMapperConfig) validate() error {
@@ -66,4 +121,5 @@ func (c *EmoMapperConfig) validate() error {
 var (
 	ErrInvalidEmoMapperType   = errors.New("invalid EmotionExpressionMapper type")
 	ErrInvalidEmoMapperConfig = errors.New("invalid EmotionExpressionMapper config")
+	ErrInvalidProfile         = errors.New("invalid profile")
 )
@@ -2,6 +2,8 @@ package live2ddriver
 
 import (
 	"encoding/json"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -64,3 +66,34 @@ func TestEmoMapperFactory_Create(t *testing.T) {
 		t.Errorf("emoMapper: got %v, want %v", got, expected)
 	}
 }
+
+func TestLoadEmoMapperFactory(t *testing.T) {
+	yamlConfig := `
+type: stateful
+config:
+  motionFromEmotion:
+    happiness: tap_body
+  expressionFromPolarity:
+    positive: f04
+`
+	path := filepath.Join(t.TempDir(), "mapper.yaml")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	factory, err := LoadEmoMapperFactory(path)
+	if err != nil {
+		t.Fatalf("LoadEmoMapperFactory failed: %v", err)
+	}
+
+	if factory.Type != StatefulEmoMapperType {
+		t.Errorf("factory.Type = %v, want %v", factory.Type, StatefulEmoMapperType)
+	}
+	if factory.Config.MotionFromEmotion["happiness"] != "tap_body" {
+		t.Errorf("MotionFromEmotion[happiness] = %v, want tap_body", factory.Config.MotionFromEmotion["happiness"])
+	}
+
+	if _, err := factory.Create(); err != nil {
+		t.Errorf("factory.Create failed: %v", err)
+	}
+}
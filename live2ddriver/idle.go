@@ -0,0 +1,173 @@
+package live2ddriver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Default timing of IdleBehaviors.
+const (
+	DefaultIdleAfter       = 30 * time.Second
+	DefaultIdleMinInterval = 8 * time.Second
+	DefaultIdleMaxInterval = 20 * time.Second
+)
+
+// IdleBehavior is what a model does when nobody is chatting: after After
+// without input, it plays random Motions every MinInterval ~ MaxInterval,
+// and resets its expression to one of the Expressions.
+//
+// Motions & Expressions are picked by their weights.
+type IdleBehavior struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	After       Duration `json:"after" yaml:"after"`             // without input before idling. 0 for DefaultIdleAfter.
+	MinInterval Duration `json:"minInterval" yaml:"minInterval"` // between idle actions. 0 for DefaultIdleMinInterval.
+	MaxInterval Duration `json:"maxInterval" yaml:"maxInterval"` // 0 for DefaultIdleMaxInterval.
+
+	Motions     map[string]float64 `json:"motions" yaml:"motions"`         // motion group => weight
+	Expressions map[string]float64 `json:"expressions" yaml:"expressions"` // expression => weight, reset to on idling
+	// ExpressionChance is the chance (0 ~ 1) to reset the expression again
+	// on every idle action after the first.
+	ExpressionChance float64 `json:"expressionChance" yaml:"expressionChance"`
+}
+
+var ErrInvalidIdleBehavior = errors.New("invalid idle behavior")
+
+// Validate the IdleBehavior.
+func (b IdleBehavior) Validate() error {
+	if b.After < 0 || b.MinInterval < 0 || b.MaxInterval < 0 {
+		return fmt.Errorf("%w: negative timing", ErrInvalidIdleBehavior)
+	}
+	if b := b.WithDefaults(); b.MinInterval > b.MaxInterval {
+		return fmt.Errorf("%w: minInterval %v > maxInterval %v", ErrInvalidIdleBehavior, b.MinInterval, b.MaxInterval)
+	}
+	if b.ExpressionChance < 0 || b.ExpressionChance > 1 {
+		return fmt.Errorf("%w: expressionChance %v not in [0, 1]", ErrInvalidIdleBehavior, b.ExpressionChance)
+	}
+	for _, weights := range []map[string]float64{b.Motions, b.Expressions} {
+		for name, w := range weights {
+			if w < 0 {
+				return fmt.Errorf("%w: negative weight of %q", ErrInvalidIdleBehavior, name)
+			}
+		}
+	}
+	if b.Enabled && len(b.Motions) == 0 && len(b.Expressions) == 0 {
+		return fmt.Errorf("%w: enabled without motions or expressions", ErrInvalidIdleBehavior)
+	}
+	return nil
+}
+
+// WithDefaults returns the IdleBehavior with the zero timing defaulted.
+func (b IdleBehavior) WithDefaults() IdleBehavior {
+	if b.After == 0 {
+		b.After = Duration(DefaultIdleAfter)
+	}
+	if b.MinInterval == 0 {
+		b.MinInterval = Duration(DefaultIdleMinInterval)
+	}
+	if b.MaxInterval == 0 {
+		b.MaxInterval = Duration(DefaultIdleMaxInterval)
+	}
+	return b
+}
+
+// Interval returns a random interval between MinInterval & MaxInterval.
+func (b IdleBehavior) Interval(rnd *rand.Rand) time.Duration {
+	b = b.WithDefaults()
+	return time.Duration(b.MinInterval) + time.Duration(rnd.Float64()*float64(b.MaxInterval-b.MinInterval))
+}
+
+// Action returns the request of the next idle action: a random motion, and
+// an expression reset if first (the first action of idling) or by the
+// ExpressionChance. Empty if there is nothing to do.
+func (b IdleBehavior) Action(rnd *rand.Rand, first bool) Live2DRequest {
+	req := Live2DRequest{
+		Motion:   pickWeighted(rnd, b.Motions),
+		Priority: PriorityIdle,
+	}
+	if first || rnd.Float64() < b.ExpressionChance {
+		req.Expression = pickWeighted(rnd, b.Expressions)
+	}
+	return req
+}
+
+// pickWeighted picks a random key by the weights. Empty if all the weights
+// are zero.
+func pickWeighted(rnd *rand.Rand, weights map[string]float64) string {
+	// in order, so that the same rnd picks the same
+	keys := make([]string, 0, len(weights))
+	var total float64
+	for k, w := range weights {
+		if w > 0 {
+			keys = append(keys, k)
+			total += w
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+
+	x := rnd.Float64() * total
+	for _, k := range keys {
+		if x -= weights[k]; x < 0 {
+			return k
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+// Duration is a time.Duration encoded as a string like "30s" or "1.5m" in
+// profiles, like the durations of the config. Plain numbers are seconds.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+// set the duration from a string, or a number of seconds.
+func (d *Duration) set(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		p, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(p)
+	case int:
+		*d = Duration(time.Duration(v) * time.Second)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	default:
+		return fmt.Errorf("invalid duration %v: want a string like \"30s\", or seconds", v)
+	}
+	return nil
+}
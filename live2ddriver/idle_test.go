@@ -0,0 +1,89 @@
+package live2ddriver
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestIdleBehavior_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		b       IdleBehavior
+		wantErr bool
+	}{
+		{"Zero", IdleBehavior{}, false},
+		{"Enabled", IdleBehavior{Enabled: true, Motions: map[string]float64{"idle": 1}}, false},
+		{"EnabledWithNothing", IdleBehavior{Enabled: true}, true},
+		{"NegativeAfter", IdleBehavior{After: -1}, true},
+		{"MinOverMax", IdleBehavior{MinInterval: Duration(30 * time.Second)}, true},
+		{"NegativeWeight", IdleBehavior{Motions: map[string]float64{"idle": -1}}, true},
+		{"Chance", IdleBehavior{ExpressionChance: 2}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.b.Validate()
+			if tc.wantErr != errors.Is(err, ErrInvalidIdleBehavior) || (!tc.wantErr && err != nil) {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdleBehavior_Action(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	b := IdleBehavior{
+		Motions:     map[string]float64{"idle": 3, "yawn": 1, "never": 0},
+		Expressions: map[string]float64{"f00": 1},
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		req := b.Action(rnd, false)
+		counts[req.Motion]++
+		if req.Priority != PriorityIdle || req.Expression != "" {
+			t.Fatalf("Action() = %+v, want an idle motion only", req)
+		}
+	}
+	if counts["never"] != 0 || counts["idle"] < 2800 || counts["idle"] > 3200 {
+		t.Errorf("Action() motions = %v, want by the weights 3:1:0", counts)
+	}
+
+	if req := b.Action(rnd, true); req.Expression != "f00" {
+		t.Errorf("Action(first) = %+v, want the expression reset", req)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := b.Interval(rnd); d < DefaultIdleMinInterval || d > DefaultIdleMaxInterval {
+			t.Fatalf("Interval() = %v, want in the default interval", d)
+		}
+	}
+}
+
+func TestProfileDriver_Idle(t *testing.T) {
+	profiles := testProfiles()
+	a := profiles["a"]
+	a.Idle = IdleBehavior{Enabled: true, Motions: map[string]float64{"a_idle": 1}}
+	profiles["a"] = a
+
+	driver, err := NewProfileDriver(profiles, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := driver.Idle(); !b.Enabled || b.Motions["a_idle"] != 1 {
+		t.Errorf("Idle() = %+v, want the idle behavior of a", b)
+	}
+
+	driver.Drive(Live2DRequest{Model: "b"})
+	if b := driver.Idle(); b.Enabled {
+		t.Errorf("Idle() after switching to b = %+v, want disabled", b)
+	}
+
+	a.Idle.Enabled, a.Idle.Motions = true, nil
+	profiles["a"] = a
+	if err := driver.Reload(profiles, "a"); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("Reload(invalid idle) = %v, want ErrInvalidProfile", err)
+	}
+}
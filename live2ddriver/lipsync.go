@@ -0,0 +1,224 @@
+package live2ddriver
+
+import (
+	"math"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// durations of syllables & pauses at the normal speech rate
+const (
+	cjkSyllable   = 200 * time.Millisecond // a Han character, kana (mora) or Hangul block
+	latinSyllable = 180 * time.Millisecond // a syllable of a word, or a digit
+	shortPause    = 250 * time.Millisecond // , ; :
+	longPause     = 500 * time.Millisecond // . ! ? and line breaks
+)
+
+// syllable is a unit of the synthesized speech: a pause if peak is 0.
+type syllable struct {
+	duration time.Duration
+	peak     float32 // how open the mouth gets
+}
+
+// TextLipSync synthesizes the mouth movement of speaking the text, as
+// keyframes: every syllable opens & closes the mouth once, and punctuations
+// pause. CJK is timed by characters, Latin text by the syllables (vowel
+// groups) of words.
+//
+// speechRate (1 for normal) scales the timing, and volume (0 ~ 1) how open
+// the mouth gets. Non-positive values for 1.
+//
+// Returns nil & 0 if there is nothing to speak in the text.
+func TextLipSync(text string, speechRate, volume float64) (*LipSync, time.Duration) {
+	if speechRate <= 0 {
+		speechRate = 1
+	}
+	if volume <= 0 || volume > 1 {
+		volume = 1
+	}
+
+	syllables := splitSyllables(text)
+
+	var t float64 // seconds
+	var end float64
+	keyframes := []Keyframe{{Time: 0, Value: 0}}
+	for _, s := range syllables {
+		d := s.duration.Seconds() / speechRate
+		if s.peak > 0 {
+			if keyframes[len(keyframes)-1].Time < roundTime(t) { // closed during the pause
+				keyframes = append(keyframes, Keyframe{Time: roundTime(t), Value: 0})
+			}
+			keyframes = append(keyframes,
+				Keyframe{Time: roundTime(t + 0.4*d), Value: roundValue(float64(s.peak) * volume)},
+				Keyframe{Time: roundTime(t + d), Value: 0},
+			)
+			end = t + d
+		}
+		t += d
+	}
+
+	if end == 0 {
+		return nil, 0
+	}
+	return &LipSync{Keyframes: keyframes}, time.Duration(roundTime(end) * float64(time.Second))
+}
+
+func roundTime(t float64) float64 {
+	return math.Round(t*1000) / 1000
+}
+
+func roundValue(v float64) float32 {
+	return float32(math.Round(v*100) / 100)
+}
+
+// splitSyllables splits the text into syllables & pauses.
+func splitSyllables(text string) []syllable {
+	var syllables []syllable
+	var word []rune
+
+	flush := func() {
+		syllables = append(syllables, wordSyllables(word)...)
+		word = word[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flush()
+			syllables = appendCJK(syllables, r)
+		case unicode.IsLetter(r) || (r == '\'' && len(word) > 0):
+			word = append(word, unicode.ToLower(r))
+		case unicode.IsDigit(r):
+			flush()
+			syllables = append(syllables, syllable{latinSyllable, 0.7})
+		case strings.ContainsRune(".!?。！？…\n", r):
+			flush()
+			syllables = append(syllables, syllable{duration: longPause})
+		case strings.ContainsRune(",;:，、；：—", r):
+			flush()
+			syllables = append(syllables, syllable{duration: shortPause})
+		default: // spaces, quotes, brackets...
+			flush()
+		}
+	}
+	flush()
+
+	return syllables
+}
+
+func isCJK(r rune) bool {
+	return r == 'ー' || unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// appendCJK appends the syllable of the CJK character r.
+func appendCJK(syllables []syllable, r rune) []syllable {
+	switch {
+	case strings.ContainsRune("ゃゅょぁぃぅぇぉャュョァィゥェォ", r): // part of the mora before
+		return syllables
+	case r == 'ー' && len(syllables) > 0: // prolongs the mora before
+		syllables[len(syllables)-1].duration += cjkSyllable
+		return syllables
+	case r == 'っ' || r == 'ッ': // a closed mora
+		return append(syllables, syllable{duration: cjkSyllable})
+	}
+
+	// characters don't tell their vowels: vary the peak a little, steadily
+	peak := 0.7 + 0.1*float32(r%4)
+	return append(syllables, syllable{cjkSyllable, peak})
+}
+
+// latinVowels and how open the mouth gets for them
+var latinVowels = map[rune]float32{
+	'a': 1, 'à': 1, 'á': 1, 'â': 1, 'ä': 1,
+	'o': 0.9, 'ò': 0.9, 'ó': 0.9, 'ô': 0.9, 'ö': 0.9,
+	'e': 0.75, 'è': 0.75, 'é': 0.75, 'ê': 0.75, 'ë': 0.75,
+	'u': 0.65, 'ù': 0.65, 'ú': 0.65, 'û': 0.65, 'ü': 0.65,
+	'i': 0.55, 'ì': 0.55, 'í': 0.55, 'î': 0.55, 'ï': 0.55, 'y': 0.55,
+}
+
+// wordSyllables returns the syllables of the (lower case) word: one for
+// every group of vowels, shaped by the first vowel of the group.
+func wordSyllables(word []rune) []syllable {
+	if len(word) == 0 {
+		return nil
+	}
+
+	var syllables []syllable
+	inVowels := false
+	for _, r := range word {
+		peak, vowel := latinVowels[r]
+		if vowel && !inVowels {
+			syllables = append(syllables, syllable{latinSyllable, peak})
+		}
+		inVowels = vowel
+	}
+
+	// silent e: "make", "time" (but not "the", "people")
+	n := len(word)
+	if len(syllables) > 1 && word[n-1] == 'e' && n > 2 && word[n-2] != 'l' && latinVowels[word[n-2]] == 0 {
+		syllables = syllables[:len(syllables)-1]
+	}
+
+	if len(syllables) == 0 { // "hmm", "tv"
+		for i := 0; i < (n+1)/2; i++ {
+			syllables = append(syllables, syllable{latinSyllable, 0.6})
+		}
+	}
+
+	return syllables
+}
+
+// textLipSyncDriver is a Live2DDriver that fills the LipSync & Duration of
+// speak requests without audio from their text.
+type textLipSyncDriver struct {
+	next       Live2DDriver
+	speechRate float64
+	volume     float64
+}
+
+// NewTextLipSyncDriver returns a Live2DDriver that drives requests by next
+// (nil to skip), and then fills the LipSync keyframes (and the Duration if
+// not given) of speak requests with text but no audio, by TextLipSync.
+//
+// The SpeechRate & Volume of the requests override the default speechRate
+// & volume.
+func NewTextLipSyncDriver(next Live2DDriver, speechRate, volume float64) Live2DDriver {
+	return &textLipSyncDriver{
+		next:       next,
+		speechRate: speechRate,
+		volume:     volume,
+	}
+}
+
+func (d *textLipSyncDriver) Drive(req Live2DRequest) Live2DRequest {
+	if d.next != nil {
+		req = d.next.Drive(req)
+	}
+
+	if req.Speak == nil || req.Speak.Audio != "" || req.Speak.Text == "" || req.Speak.LipSync != nil {
+		return req
+	}
+
+	speechRate, volume := d.speechRate, d.volume
+	if req.Speak.SpeechRate > 0 {
+		speechRate = float64(req.Speak.SpeechRate)
+	}
+	if req.Speak.Volume > 0 {
+		volume = float64(req.Speak.Volume)
+	}
+
+	lipSync, duration := TextLipSync(req.Speak.Text, speechRate, volume)
+	if lipSync == nil {
+		return req
+	}
+
+	speak := *req.Speak // don't modify the request of the caller
+	speak.LipSync = lipSync
+	if speak.Duration == 0 {
+		speak.Duration = duration.Seconds()
+	}
+	req.Speak = &speak
+
+	return req
+}
@@ -0,0 +1,102 @@
+package live2ddriver
+
+import "testing"
+
+func Test_splitSyllables(t *testing.T) {
+	testCases := []struct {
+		text      string
+		syllables int // not pauses
+		pauses    int
+	}{
+		{"", 0, 0},
+		{"hello", 2, 0},
+		{"make the people happy", 1 + 1 + 2 + 2, 0},
+		{"Hello, world!", 3, 2},
+		{"hmm", 2, 0},
+		{"你好，世界。", 4, 2},
+		{"きょうはいいてんき", 8, 0}, // きょ う は い い て ん き: ょ is a part of き
+		{"ちょっと", 2, 1},      // ちょ っ と: っ is closed
+		{"ラーメン", 3, 0},      // ラー メ ン
+		{"2024", 4, 0},
+	}
+
+	for _, tc := range testCases {
+		var syllables, pauses int
+		for _, s := range splitSyllables(tc.text) {
+			if s.peak > 0 {
+				syllables++
+			} else {
+				pauses++
+			}
+		}
+		if syllables != tc.syllables || pauses != tc.pauses {
+			t.Errorf("splitSyllables(%q) = %d syllables, %d pauses, want %d, %d", tc.text, syllables, pauses, tc.syllables, tc.pauses)
+		}
+	}
+}
+
+func TestTextLipSync(t *testing.T) {
+	lipSync, d := TextLipSync("你好", 1, 1)
+	if d != 2*cjkSyllable {
+		t.Errorf("TextLipSync() duration = %v, want %v", d, 2*cjkSyllable)
+	}
+	// closed, open, closed, open, closed
+	if lipSync == nil || len(lipSync.Keyframes) != 5 {
+		t.Fatalf("TextLipSync() = %+v, want 5 keyframes", lipSync)
+	}
+	for i, kf := range lipSync.Keyframes {
+		if open := kf.Value > 0; open != (i%2 == 1) {
+			t.Errorf("keyframe %d = %+v, want open: %v", i, kf, i%2 == 1)
+		}
+		if i > 0 && kf.Time <= lipSync.Keyframes[i-1].Time {
+			t.Errorf("keyframe %d = %+v, not after %+v", i, kf, lipSync.Keyframes[i-1])
+		}
+	}
+
+	// scaled by the speech rate & volume
+	fast, fastD := TextLipSync("你好", 2, 0.5)
+	if fastD != d/2 {
+		t.Errorf("TextLipSync(rate 2) duration = %v, want %v", fastD, d/2)
+	}
+	if got, want := fast.Keyframes[1].Value, roundValue(float64(lipSync.Keyframes[1].Value)*0.5); got != want {
+		t.Errorf("TextLipSync(volume 0.5) peak = %v, want %v", got, want)
+	}
+
+	// pauses keep the mouth closed
+	paused, pausedD := TextLipSync("你，好。", 1, 1)
+	if pausedD != 2*cjkSyllable+shortPause {
+		t.Errorf("TextLipSync(paused) duration = %v, want %v (trailing pause trimmed)", pausedD, 2*cjkSyllable+shortPause)
+	}
+	if kf := paused.Keyframes[3]; kf.Time != (cjkSyllable+shortPause).Seconds() || kf.Value != 0 {
+		t.Errorf("keyframe after the pause = %+v, want closed at %v", kf, cjkSyllable+shortPause)
+	}
+
+	if lipSync, d := TextLipSync("...", 1, 1); lipSync != nil || d != 0 {
+		t.Errorf("TextLipSync(...) = %+v, %v, want nil", lipSync, d)
+	}
+}
+
+func TestTextLipSyncDriver(t *testing.T) {
+	driver := NewTextLipSyncDriver(nil, 1, 1)
+
+	req := Live2DRequest{Speak: &Speaking{Text: "hello"}}
+	got := driver.Drive(req)
+	if got.Speak.LipSync == nil || len(got.Speak.LipSync.Keyframes) == 0 || got.Speak.Duration != (2*latinSyllable).Seconds() {
+		t.Errorf("Drive() speak = %+v, want keyframes of %v", got.Speak, 2*latinSyllable)
+	}
+	if req.Speak.LipSync != nil {
+		t.Errorf("Drive() modified the request of the caller")
+	}
+
+	// the speech rate of the request overrides
+	slow := driver.Drive(Live2DRequest{Speak: &Speaking{Text: "hello", SpeechRate: 0.5}})
+	if slow.Speak.Duration != (4 * latinSyllable).Seconds() {
+		t.Errorf("Drive(speechRate 0.5) duration = %v, want %v", slow.Speak.Duration, 4*latinSyllable)
+	}
+
+	// with audio: the audio decides
+	withAudio := Live2DRequest{Speak: &Speaking{Text: "hello", Audio: "a.wav"}}
+	if got := driver.Drive(withAudio); got.Speak.LipSync != nil {
+		t.Errorf("Drive(with audio) = %+v, want passed through", got.Speak)
+	}
+}
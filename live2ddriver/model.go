@@ -2,21 +2,72 @@ package live2ddriver
 
 // Live2DRequest is the message format for Live2DView controlling (communication).
 type Live2DRequest struct {
+	ID         string    `json:"id,omitempty"`         // request id: views acknowledge the request by {"event": "ack", "id": ...}
+	Room       string    `json:"room,omitempty"`       // room of the views to forward to. Empty for the default room. Not forwarded to views.
 	Model      string    `json:"model,omitempty"`      // model src
 	Motion     string    `json:"motion,omitempty"`     // motion group
 	Expression string    `json:"expression,omitempty"` // expression id (name or index)
 	Speak      *Speaking `json:"speak,omitempty"`      // speak audio (lip sync)
 	Emotion    *Emotion  `json:"emotion,omitempty"`    // emotion: will map to motion & expression by driver
+	Priority   Priority  `json:"priority,omitempty"`   // priority of the motion & expression against the others. Not forwarded to views.
 }
 
+// Priority of a request, arbitrating its motion & expression against those
+// of the other requests.
+type Priority string
+
+const (
+	PriorityIdle    Priority = "idle"    // idle behaviors
+	PriorityChat    Priority = "chat"    // chatting & speaking
+	PriorityEmotion Priority = "emotion" // mapped from emotions
+	PriorityManual  Priority = "manual"  // operators
+)
+
 // Speaking is the message format for Live2DView speaking (lip sync).
 type Speaking struct {
 	Audio  string  `json:"audio,omitempty"`  // audio src: url to audio file (wav or mp3) or base64 encoded data (data:audio/wav;base64,xxxx)
 	Text   string  `json:"text,omitempty"`   // text
 	Volume float32 `json:"volume,omitempty"` // volume
 
+	SpeechRate float32 `json:"speechRate,omitempty"` // speed of the speech: 1 for normal, 0 for the default
+
 	Expression string `json:"expression,omitempty"` // expression id (name or index)
 	Motion     string `json:"motion,omitempty"`     // motion group
+
+	// filled by the driver from the audio (or the text if no audio)
+
+	Duration float64  `json:"duration,omitempty"` // audio duration in seconds
+	LipSync  *LipSync `json:"lipSync,omitempty"`  // mouth-open envelope for views animating the mouth from data
+
+	// filled by the driver from the emotion of every sentence
+
+	Timeline []SpeakCue `json:"timeline,omitempty"` // expression & motion changes during the speech
+}
+
+// SpeakCue is the expression & motion to change to when the speech gets to
+// a sentence.
+type SpeakCue struct {
+	Time       float64 `json:"t"`    // seconds from the start of the speech
+	Text       string  `json:"text"` // the sentence
+	Expression string  `json:"expression,omitempty"`
+	Motion     string  `json:"motion,omitempty"`
+}
+
+// LipSync is the mouth movement of a speech, how open the mouth is
+// (0: closed ~ 1: fully open) over time. Either:
+//
+//   - an envelope from the audio: MouthOpen[i] at i/Rate seconds;
+//   - keyframes synthesized from the text: interpolate linearly between them.
+type LipSync struct {
+	Rate      int        `json:"rate,omitempty"`      // frames per second
+	MouthOpen []float32  `json:"mouthOpen,omitempty"` // mouth-open value of every frame
+	Keyframes []Keyframe `json:"keyframes,omitempty"` // mouth-open keyframes
+}
+
+// Keyframe is the value of a parameter (e.g. mouth open) at a time.
+type Keyframe struct {
+	Time  float64 `json:"t"` // seconds from the start
+	Value float32 `json:"v"`
 }
 
 // chan buffer size
@@ -0,0 +1,255 @@
+package live2ddriver
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// Profile is the configuration of a live2d model for the universal drivers.
+type Profile struct {
+	Model     string           `json:"model" yaml:"model"`         // model src
+	EmoMapper EmoMapperFactory `json:"emoMapper" yaml:"emoMapper"` // emotion => motion & expression of the model
+	Idle      IdleBehavior     `json:"idle" yaml:"idle"`           // what the model does when nobody is chatting
+}
+
+// ProfileDriver is a Live2DDriver that follows the model switching:
+// when a {"model": ...} request switches the model, the matching profile
+// takes over the driving.
+type ProfileDriver interface {
+	Live2DDriver
+	// CurrentProfile returns the name of the profile in use.
+	// Empty if the current model matches no profile.
+	CurrentProfile() string
+	// Idle returns the IdleBehavior of the profile in use.
+	// Disabled if no profile is in use.
+	Idle() IdleBehavior
+	// Reload the profiles. The new profiles are validated before taking
+	// over: on error, the running ones are kept.
+	Reload(profiles map[string]Profile, defaultProfile string) error
+}
+
+// profileDriver drives requests by the emotion driver of the current
+// profile.
+type profileDriver struct {
+	profiles map[string]Profile
+	drivers  map[string]Live2DDriver // profile name => emotion driver
+	byModel  map[string]string       // model src => profile name
+
+	current string // current profile name
+
+	mu       sync.RWMutex
+	reloadMu sync.Mutex // serializes Reloads
+}
+
+// NewProfileDriver returns a ProfileDriver with the profiles.
+// The initial profile in use is defaultProfile, which can be empty
+// to start with no profile.
+//
+// The mapper of every profile is created at once, an error is returned if
+// any of the profiles is invalid.
+func NewProfileDriver(profiles map[string]Profile, defaultProfile string) (ProfileDriver, error) {
+	d := &profileDriver{}
+
+	if err := d.Reload(profiles, defaultProfile); err != nil {
+		return nil, err
+	}
+	d.current = defaultProfile
+
+	return d, nil
+}
+
+// Reload creates the drivers of the new profiles, and swaps them in at once.
+//
+// Drivers of the profiles that are not changed are kept, so do the memory
+// of their (stateful) mappers. The current profile is kept if it's still
+// there, otherwise it falls back to the defaultProfile.
+func (d *profileDriver) Reload(profiles map[string]Profile, defaultProfile string) error {
+	if _, ok := profiles[defaultProfile]; defaultProfile != "" && !ok {
+		return fmt.Errorf("%w: default profile %q not found", ErrInvalidProfile, defaultProfile)
+	}
+
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	d.mu.RLock()
+	oldProfiles, oldDrivers := d.profiles, d.drivers
+	d.mu.RUnlock()
+
+	drivers := make(map[string]Live2DDriver, len(profiles))
+	byModel := make(map[string]string, len(profiles))
+
+	for name, p := range profiles {
+		if err := p.Idle.Validate(); err != nil {
+			return fmt.Errorf("%w %q: %v", ErrInvalidProfile, name, err)
+		}
+		if old, ok := oldProfiles[name]; ok && reflect.DeepEqual(old, p) {
+			drivers[name] = oldDrivers[name]
+		} else {
+			mapper, err := p.EmoMapper.Create()
+			if err != nil {
+				return fmt.Errorf("%w %q: %v", ErrInvalidProfile, name, err)
+			}
+			drivers[name] = NewEmotionDriver(mapper)
+		}
+
+		if p.Model != "" {
+			byModel[p.Model] = name
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.profiles, d.drivers, d.byModel = profiles, drivers, byModel
+
+	if _, ok := profiles[d.current]; !ok {
+		d.current = defaultProfile
+	}
+
+	return nil
+}
+
+func (d *profileDriver) Drive(req Live2DRequest) Live2DRequest {
+	if req.Model != "" {
+		req.Model = d.switchModel(req.Model)
+	}
+
+	d.mu.RLock()
+	driver := d.drivers[d.current]
+	d.mu.RUnlock()
+
+	if driver == nil {
+		if req.Emotion != nil {
+			log.Printf("WARN profileDriver: no profile for current model, drop emotion.")
+			req.Emotion = nil
+		}
+		return req
+	}
+
+	return driver.Drive(req)
+}
+
+// switchModel switches the current profile to the one matching the model.
+// The model can be a model src or a profile name. The model src to load is
+// returned.
+func (d *profileDriver) switchModel(model string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	name, ok := d.byModel[model]
+	if !ok {
+		if p, isName := d.profiles[model]; isName && p.Model != "" {
+			name, model = model, p.Model
+			ok = true
+		}
+	}
+
+	if !ok {
+		log.Printf("WARN profileDriver: no profile for model %s.", model)
+		d.current = ""
+		return model
+	}
+
+	if d.current != name {
+		log.Printf("INFO profileDriver: switch profile %q -> %q.", d.current, name)
+		d.current = name
+	}
+	return model
+}
+
+func (d *profileDriver) CurrentProfile() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.current
+}
+
+func (d *profileDriver) Idle() IdleBehavior {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.profiles[d.current].Idle
+}
+
+// ProfileDrivers are independent ProfileDrivers sharing the same profiles,
+// one per room: every room follows its own model switching, with its own
+// mappers (and their memory).
+type ProfileDrivers interface {
+	// Get returns the ProfileDriver of the room, created on first use.
+	Get(room string) ProfileDriver
+	// CurrentProfiles returns the current profile of every room.
+	CurrentProfiles() map[string]string
+	// Reload the profiles of every room. See ProfileDriver.Reload.
+	Reload(profiles map[string]Profile, defaultProfile string) error
+}
+
+type profileDrivers struct {
+	profiles       map[string]Profile
+	defaultProfile string
+	drivers        map[string]ProfileDriver // room => driver
+
+	mu sync.Mutex
+}
+
+// NewProfileDrivers returns ProfileDrivers with the profiles. The initial
+// profile of every room is defaultProfile.
+//
+// The profiles are validated at once, an error is returned if any of them
+// is invalid.
+func NewProfileDrivers(profiles map[string]Profile, defaultProfile string) (ProfileDrivers, error) {
+	if _, err := NewProfileDriver(profiles, defaultProfile); err != nil {
+		return nil, err
+	}
+	return &profileDrivers{
+		profiles:       profiles,
+		defaultProfile: defaultProfile,
+		drivers:        map[string]ProfileDriver{},
+	}, nil
+}
+
+func (s *profileDrivers) Get(room string) ProfileDriver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d, ok := s.drivers[room]; ok {
+		return d
+	}
+
+	d, err := NewProfileDriver(s.profiles, s.defaultProfile)
+	if err != nil { // unreachable: the profiles are validated
+		log.Printf("ERROR profileDrivers: room %q: %v. Start with no profile.", room, err)
+		d, _ = NewProfileDriver(nil, "")
+	}
+	s.drivers[room] = d
+	return d
+}
+
+func (s *profileDrivers) CurrentProfiles() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := make(map[string]string, len(s.drivers))
+	for room, d := range s.drivers {
+		current[room] = d.CurrentProfile()
+	}
+	return current
+}
+
+// Reload validates the new profiles first, so that either every room
+// takes them, or none does.
+func (s *profileDrivers) Reload(profiles map[string]Profile, defaultProfile string) error {
+	if _, err := NewProfileDriver(profiles, defaultProfile); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for room, d := range s.drivers {
+		if err := d.Reload(profiles, defaultProfile); err != nil {
+			return fmt.Errorf("room %q: %w", room, err)
+		}
+	}
+	s.profiles, s.defaultProfile = profiles, defaultProfile
+	return nil
+}
@@ -0,0 +1,169 @@
+package live2ddriver
+
+import (
+	"errors"
+	"testing"
+)
+
+func testProfiles() map[string]Profile {
+	return map[string]Profile{
+		"a": {
+			Model: "https://example.com/a.model.json",
+			EmoMapper: EmoMapperFactory{
+				Type: StatelessEmoMapperType,
+				Config: EmoMapperConfig{
+					MotionFromEmotion:      map[EmotionsKey]Motion{"happiness": "a_happy"},
+					ExpressionFromPolarity: map[PolarityKey]Expression{"positive": "a_smile"},
+				},
+			},
+		},
+		"b": {
+			Model: "https://example.com/b.model.json",
+			EmoMapper: EmoMapperFactory{
+				Type: StatelessEmoMapperType,
+				Config: EmoMapperConfig{
+					MotionFromEmotion:      map[EmotionsKey]Motion{"happiness": "b_happy"},
+					ExpressionFromPolarity: map[PolarityKey]Expression{"positive": "b_smile"},
+				},
+			},
+		},
+	}
+}
+
+func TestProfileDriver(t *testing.T) {
+	driver, err := NewProfileDriver(testProfiles(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emo := Emotion{
+		Emotions: map[EmotionsKey]float32{"happiness": 1.0},
+		Polarity: map[PolarityKey]float32{"positive": 1.0},
+	}
+
+	steps := []struct {
+		name        string
+		req         Live2DRequest
+		wantProfile string
+		want        Live2DRequest
+	}{
+		{"Default", Live2DRequest{Emotion: &emo}, "a", Live2DRequest{Motion: "a_happy", Expression: "a_smile"}},
+		{"SwitchByModelSrc", Live2DRequest{Model: "https://example.com/b.model.json"}, "b", Live2DRequest{Model: "https://example.com/b.model.json"}},
+		{"AfterSwitch", Live2DRequest{Emotion: &emo}, "b", Live2DRequest{Motion: "b_happy", Expression: "b_smile"}},
+		{"SwitchByProfileName", Live2DRequest{Model: "a", Emotion: &emo}, "a", Live2DRequest{Model: "https://example.com/a.model.json", Motion: "a_happy", Expression: "a_smile"}},
+		{"UnknownModel", Live2DRequest{Model: "https://example.com/c.model.json", Emotion: &emo}, "", Live2DRequest{Model: "https://example.com/c.model.json"}},
+	}
+
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			got := driver.Drive(s.req)
+			if got.Model != s.want.Model || got.Motion != s.want.Motion || got.Expression != s.want.Expression || got.Emotion != nil {
+				t.Errorf("Drive(%+v) = %+v, want %+v", s.req, got, s.want)
+			}
+			if p := driver.CurrentProfile(); p != s.wantProfile {
+				t.Errorf("CurrentProfile() = %q, want %q", p, s.wantProfile)
+			}
+		})
+	}
+}
+
+func TestNewProfileDriver_invalid(t *testing.T) {
+	profiles := testProfiles()
+	profiles["bad"] = Profile{EmoMapper: EmoMapperFactory{Type: StatelessEmoMapperType}}
+
+	if _, err := NewProfileDriver(profiles, "a"); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("NewProfileDriver() error = %v, want ErrInvalidProfile", err)
+	}
+	if _, err := NewProfileDriver(testProfiles(), "c"); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("NewProfileDriver() error = %v, want ErrInvalidProfile", err)
+	}
+}
+
+func TestProfileDriver_Reload(t *testing.T) {
+	driver, err := NewProfileDriver(testProfiles(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emo := Emotion{
+		Emotions: map[EmotionsKey]float32{"happiness": 1.0},
+		Polarity: map[PolarityKey]float32{"positive": 1.0},
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		profiles := testProfiles()
+		profiles["a"] = Profile{EmoMapper: EmoMapperFactory{Type: StatelessEmoMapperType}}
+
+		if err := driver.Reload(profiles, "a"); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("Reload() error = %v, want ErrInvalidProfile", err)
+		}
+		if got := driver.Drive(Live2DRequest{Emotion: &emo}); got.Motion != "a_happy" {
+			t.Errorf("after invalid Reload, Drive() = %+v, want the running profile kept", got)
+		}
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		profiles := testProfiles()
+		profiles["a"].EmoMapper.Config.MotionFromEmotion["happiness"] = "a_happy_v2"
+
+		if err := driver.Reload(profiles, "b"); err != nil {
+			t.Fatalf("Reload() error = %v", err)
+		}
+		if p := driver.CurrentProfile(); p != "a" {
+			t.Errorf("CurrentProfile() = %q, want the current profile %q kept", p, "a")
+		}
+		if got := driver.Drive(Live2DRequest{Emotion: &emo}); got.Motion != "a_happy_v2" {
+			t.Errorf("after Reload, Drive() = %+v, want motion a_happy_v2", got)
+		}
+	})
+
+	t.Run("CurrentRemoved", func(t *testing.T) {
+		profiles := testProfiles()
+		delete(profiles, "a")
+
+		if err := driver.Reload(profiles, "b"); err != nil {
+			t.Fatalf("Reload() error = %v", err)
+		}
+		if p := driver.CurrentProfile(); p != "b" {
+			t.Errorf("CurrentProfile() = %q, want fallback to default %q", p, "b")
+		}
+	})
+}
+
+func TestProfileDrivers(t *testing.T) {
+	drivers, err := NewProfileDrivers(testProfiles(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	main, brb := drivers.Get("main"), drivers.Get("brb")
+	if drivers.Get("main") != main {
+		t.Errorf("Get() returns a new driver for the same room")
+	}
+
+	// rooms switch models independently
+	brb.Drive(Live2DRequest{Model: "b"})
+	if got := drivers.CurrentProfiles(); got["main"] != "a" || got["brb"] != "b" {
+		t.Errorf("CurrentProfiles() = %v, want main: a, brb: b", got)
+	}
+
+	// reload every room, or none
+	profiles := testProfiles()
+	delete(profiles, "b")
+	if err := drivers.Reload(profiles, "c"); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("Reload() error = %v, want ErrInvalidProfile", err)
+	}
+	if got := drivers.CurrentProfiles(); got["brb"] != "b" {
+		t.Errorf("CurrentProfiles() after invalid Reload = %v, want brb: b", got)
+	}
+
+	if err := drivers.Reload(profiles, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := drivers.CurrentProfiles(); got["main"] != "a" || got["brb"] != "a" {
+		t.Errorf("CurrentProfiles() after Reload = %v, want a for every room", got)
+	}
+	if p := drivers.Get("new").CurrentProfile(); p != "a" {
+		t.Errorf("CurrentProfile() of a new room = %q, want a", p)
+	}
+}
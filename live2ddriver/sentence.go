@@ -0,0 +1,62 @@
+package live2ddriver
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// sentenceEnds end sentences. '.' ends only if followed by a space or the
+// end, so that 3.14 and example.com are not split.
+const sentenceEnds = "。！？!?…\n"
+
+// sentenceClosers are kept with the sentence ending before them.
+const sentenceClosers = "”’」』）)]\"'"
+
+// SplitSentences splits the text into sentences, by the Chinese & English
+// sentence-ending punctuations. Punctuations & closing quotes stay with the
+// sentences they end; spaces around sentences are trimmed, and empty ones
+// dropped.
+func SplitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		ends := strings.ContainsRune(sentenceEnds, r) ||
+			(r == '.' && (i+1 == len(runes) || unicode.IsSpace(runes[i+1]) || runes[i+1] == '.'))
+		if !ends {
+			continue
+		}
+
+		// ?!, ..., ”
+		for i+1 < len(runes) && (strings.ContainsRune(sentenceEnds, runes[i+1]) || runes[i+1] == '.' ||
+			strings.ContainsRune(sentenceClosers, runes[i+1])) {
+			i++
+		}
+
+		if s := strings.TrimSpace(string(runes[start : i+1])); s != "" {
+			sentences = append(sentences, s)
+		}
+		start = i + 1
+	}
+	if s := strings.TrimSpace(string(runes[start:])); s != "" {
+		sentences = append(sentences, s)
+	}
+
+	return sentences
+}
+
+// textSpeechDuration estimates how long speaking the text lasts, pauses
+// included, at the speechRate (1 for normal).
+func textSpeechDuration(text string, speechRate float64) time.Duration {
+	if speechRate <= 0 {
+		speechRate = 1
+	}
+	var d time.Duration
+	for _, s := range splitSyllables(text) {
+		d += s.duration
+	}
+	return time.Duration(float64(d) / speechRate)
+}
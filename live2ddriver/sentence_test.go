@@ -0,0 +1,27 @@
+package live2ddriver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSentences(t *testing.T) {
+	testCases := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"你好", []string{"你好"}},
+		{"我很开心！但是要走了。", []string{"我很开心！", "但是要走了。"}},
+		{"他说：“好的。”然后走了", []string{"他说：“好的。”", "然后走了"}},
+		{"Really?! Yes. Pi is 3.14, see example.com", []string{"Really?!", "Yes.", "Pi is 3.14, see example.com"}},
+		{"Wait... what?", []string{"Wait...", "what?"}},
+		{"line one\n\nline two", []string{"line one", "line two"}},
+	}
+
+	for _, tc := range testCases {
+		if got := SplitSentences(tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SplitSentences(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
@@ -67,6 +67,37 @@ var shizukuMotionsFromEmotions = map[string]shizukuMotion{
 
 // #endregion shizukuMotions
 
+// #region shizuku builtin Profile
+
+const shizukuModel = "https://cdn.jsdelivr.net/gh/guansss/pixi-live2d-display/test/assets/shizuku/shizuku.model.json"
+
+// The shizuku tables live on as a built-in profile of the universal drivers:
+// BuiltinProfile("shizuku").
+func init() {
+	motionFromEmotion := map[EmotionsKey]Motion{}
+	for k, v := range shizukuMotionsFromEmotions {
+		motionFromEmotion[k] = Motion(v)
+	}
+
+	expressionFromPolarity := map[PolarityKey]Expression{}
+	for k, v := range shizukuExpressionFromPolarity {
+		expressionFromPolarity[k] = Expression(v)
+	}
+
+	builtinProfiles["shizuku"] = Profile{
+		Model: shizukuModel,
+		EmoMapper: EmoMapperFactory{
+			Type: StatefulEmoMapperType,
+			Config: EmoMapperConfig{
+				MotionFromEmotion:      motionFromEmotion,
+				ExpressionFromPolarity: expressionFromPolarity,
+			},
+		},
+	}
+}
+
+// #endregion shizuku builtin Profile
+
 // #region shizukuDriver
 
 // Deprecated: Legacy model-specific driver.
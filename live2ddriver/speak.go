@@ -0,0 +1,161 @@
+package live2ddriver
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxAudioSize is the max size of audios to analyze.
+const MaxAudioSize = 20 << 20
+
+// ErrRemoteAudio is returned by AudioLoaders for audio srcs that are not
+// available locally (e.g. http urls), which are not analyzed.
+var ErrRemoteAudio = errors.New("remote audio")
+
+// AudioLoader loads the data of a Speaking.Audio src.
+type AudioLoader interface {
+	Load(src string) ([]byte, error)
+}
+
+// audioLoader loads data URIs, and local files under a directory.
+type audioLoader struct {
+	dir string
+}
+
+// NewAudioLoader returns an AudioLoader of data URIs
+// (data:audio/wav;base64,xxxx), and local files (file:///path/to/a.wav or
+// /path/to/a.wav) under dir. Empty dir to load data URIs only.
+func NewAudioLoader(dir string) AudioLoader {
+	return &audioLoader{dir: dir}
+}
+
+func (l *audioLoader) Load(src string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(src, "data:"):
+		data, _, err := DecodeDataURI(src)
+		return data, err
+	case strings.HasPrefix(src, "file://"):
+		u, err := url.Parse(src)
+		if err != nil {
+			return nil, err
+		}
+		return l.loadFile(u.Path)
+	case strings.Contains(src, "://"):
+		return nil, ErrRemoteAudio
+	}
+	return l.loadFile(src)
+}
+
+// loadFile reads the file at path, which must be under l.dir.
+func (l *audioLoader) loadFile(path string) ([]byte, error) {
+	if l.dir == "" {
+		return nil, ErrRemoteAudio
+	}
+
+	dir, err := filepath.Abs(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("audio %s is not under %s", path, dir)
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.Size() > MaxAudioSize {
+		return nil, fmt.Errorf("audio %s too large: %d bytes", path, fi.Size())
+	}
+	return os.ReadFile(path)
+}
+
+// DecodeDataURI decodes the data & the media type (e.g. audio/wav) of the
+// data URI:
+//
+//	data:[<mediatype>][;base64],<data>
+func DecodeDataURI(uri string) (data []byte, mediaType string, err error) {
+	meta, encoded, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasPrefix(uri, "data:") {
+		return nil, "", fmt.Errorf("%w: bad data URI", ErrInvalidAudio)
+	}
+	if len(encoded) > MaxAudioSize*4/3+4 {
+		return nil, "", fmt.Errorf("data URI too large: %d bytes", len(encoded))
+	}
+
+	base64Encoded := strings.HasSuffix(meta, ";base64")
+	mediaType, _, _ = strings.Cut(meta, ";") // drop parameters, e.g. ;charset=utf-8
+
+	if base64Encoded {
+		data, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			// some encoders drop the padding
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		}
+		return data, mediaType, err
+	}
+
+	s, err := url.PathUnescape(encoded)
+	return []byte(s), mediaType, err
+}
+
+// audioDriver is a Live2DDriver that fills the Duration & LipSync of
+// speak requests from their audio.
+type audioDriver struct {
+	next         Live2DDriver
+	loader       AudioLoader
+	envelopeRate int
+}
+
+// NewAudioDriver returns a Live2DDriver that drives requests by next (nil
+// to skip), and then fills the Duration & LipSync (at envelopeRate frames
+// per second) of speak requests by analyzing the audio loaded by loader.
+//
+// Requests with the Duration given, or audios failing to load or analyze
+// are passed through as they are.
+func NewAudioDriver(next Live2DDriver, loader AudioLoader, envelopeRate int) Live2DDriver {
+	return &audioDriver{
+		next:         next,
+		loader:       loader,
+		envelopeRate: envelopeRate,
+	}
+}
+
+func (d *audioDriver) Drive(req Live2DRequest) Live2DRequest {
+	if d.next != nil {
+		req = d.next.Drive(req)
+	}
+
+	if req.Speak == nil || req.Speak.Audio == "" || req.Speak.Duration != 0 {
+		return req
+	}
+
+	data, err := d.loader.Load(req.Speak.Audio)
+	if err != nil {
+		if !errors.Is(err, ErrRemoteAudio) {
+			log.Printf("WARN audioDriver: load audio: %v.", err)
+		}
+		return req
+	}
+
+	info, err := AnalyzeAudio(data, d.envelopeRate)
+	if err != nil {
+		log.Printf("WARN audioDriver: analyze audio: %v.", err)
+		return req
+	}
+
+	speak := *req.Speak // don't modify the request of the caller
+	speak.Duration = info.Duration.Seconds()
+	speak.LipSync = info.LipSync
+	req.Speak = &speak
+
+	return req
+}
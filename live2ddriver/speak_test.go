@@ -0,0 +1,75 @@
+package live2ddriver
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioLoader_Load(t *testing.T) {
+	dir := t.TempDir()
+	wav := testWAV(8000, 1, 1)
+	if err := os.WriteFile(filepath.Join(dir, "a.wav"), wav, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loader := NewAudioLoader(dir)
+
+	testCases := []struct {
+		name    string
+		src     string
+		want    []byte
+		wantErr error // nil: any error
+		ok      bool
+	}{
+		{"DataURI", "data:audio/wav;base64," + base64.StdEncoding.EncodeToString(wav), wav, nil, true},
+		{"DataURIPlain", "data:text/plain,hi%20there", []byte("hi there"), nil, true},
+		{"File", filepath.Join(dir, "a.wav"), wav, nil, true},
+		{"RelativeFile", "a.wav", wav, nil, true},
+		{"FileURL", "file://" + filepath.Join(dir, "a.wav"), wav, nil, true},
+		{"OutsideDir", filepath.Join(dir, "..", "a.wav"), nil, nil, false},
+		{"Remote", "https://example.com/a.wav", nil, ErrRemoteAudio, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := loader.Load(tc.src)
+			if tc.ok {
+				if err != nil || string(got) != string(tc.want) {
+					t.Errorf("Load(%.40s) = %d bytes, %v, want %d bytes", tc.src, len(got), err, len(tc.want))
+				}
+				return
+			}
+			if err == nil || (tc.wantErr != nil && !errors.Is(err, tc.wantErr)) {
+				t.Errorf("Load(%.40s) error = %v, want %v", tc.src, err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("NoDir", func(t *testing.T) {
+		if _, err := NewAudioLoader("").Load(filepath.Join(dir, "a.wav")); !errors.Is(err, ErrRemoteAudio) {
+			t.Errorf("Load() error = %v, want ErrRemoteAudio", err)
+		}
+	})
+}
+
+func TestAudioDriver(t *testing.T) {
+	uri := "data:audio/wav;base64," + base64.StdEncoding.EncodeToString(testWAV(8000, 1, 1, 0))
+	driver := NewAudioDriver(nil, NewAudioLoader(""), 10)
+
+	req := Live2DRequest{Speak: &Speaking{Audio: uri}}
+	got := driver.Drive(req)
+	if got.Speak.Duration != 0.2 || got.Speak.LipSync == nil || len(got.Speak.LipSync.MouthOpen) != 2 {
+		t.Errorf("Drive() speak = duration %v, lipSync %+v, want 0.2s of 2 frames", got.Speak.Duration, got.Speak.LipSync)
+	}
+	if req.Speak.Duration != 0 {
+		t.Errorf("Drive() modified the request of the caller")
+	}
+
+	remote := Live2DRequest{Speak: &Speaking{Audio: "https://example.com/a.wav"}}
+	if got := driver.Drive(remote); got.Speak.Duration != 0 || got.Speak.LipSync != nil {
+		t.Errorf("Drive(remote) = %+v, want passed through", got.Speak)
+	}
+}
@@ -0,0 +1,141 @@
+package live2ddriver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// MaxSentenceAnalyses is the max number of sentences of a speech analyzed
+// concurrently, so that a long text is not a burst of analyzer requests.
+const MaxSentenceAnalyses = 4
+
+// speakEmotionDriver is a Live2DDriver that picks the expression & motion
+// of speak requests from the emotion of their text.
+type speakEmotionDriver struct {
+	next      Live2DDriver
+	mapper    Live2DDriver
+	analyzer  EmotionAnalyzer
+	sentences bool
+}
+
+// NewSpeakEmotionDriver returns a Live2DDriver that drives requests by next,
+// and then fills the missing Expression & Motion of speak requests with
+// text: the emotion of the text is analyzed by the analyzer, and mapped by
+// the mapper (e.g. a ProfileDriver, that is, by the active
+// EmotionExpressionMapper). next can be the mapper itself, or the drivers
+// chained after it (e.g. TTS & audio analysis), so that the Duration of the
+// speech is known.
+//
+// With sentences on, a text of sentences is split by SplitSentences, and
+// every sentence is analyzed & mapped into a SpeakCue of the Timeline, timed
+// by the text and scaled to the Duration if known. The Expression & Motion
+// are of the first cue.
+//
+// Expression & Motion given in the speak request are kept. Requests failing
+// to be analyzed are passed through as they are.
+func NewSpeakEmotionDriver(next, mapper Live2DDriver, analyzer EmotionAnalyzer, sentences bool) Live2DDriver {
+	return &speakEmotionDriver{
+		next:      next,
+		mapper:    mapper,
+		analyzer:  analyzer,
+		sentences: sentences,
+	}
+}
+
+func (d *speakEmotionDriver) Drive(req Live2DRequest) Live2DRequest {
+	// first, so that a model switching in the request takes effect
+	req = d.next.Drive(req)
+
+	if req.Speak == nil || req.Speak.Text == "" || (req.Speak.Expression != "" && req.Speak.Motion != "") {
+		return req
+	}
+
+	speak := *req.Speak // don't modify the request of the caller
+
+	var expression, motion string
+	if sentences := SplitSentences(speak.Text); d.sentences && len(sentences) > 1 {
+		speak.Timeline = d.timeline(sentences, speak)
+		if len(speak.Timeline) == 0 {
+			return req
+		}
+		expression, motion = speak.Timeline[0].Expression, speak.Timeline[0].Motion
+	} else {
+		emo, err := d.analyzer.Analyze(speak.Text)
+		if err != nil {
+			log.Printf("WARN speakEmotionDriver: analyze speak text: %v.", err)
+			return req
+		}
+		expression, motion = d.mapEmotion(emo)
+	}
+
+	if speak.Expression == "" {
+		speak.Expression = expression
+	}
+	if speak.Motion == "" {
+		speak.Motion = motion
+	}
+	req.Speak = &speak
+
+	return req
+}
+
+// mapEmotion maps the emotion into expression & motion by the mapper.
+func (d *speakEmotionDriver) mapEmotion(emo Emotion) (expression, motion string) {
+	mapped := d.mapper.Drive(Live2DRequest{Emotion: &emo})
+	return mapped.Expression, mapped.Motion
+}
+
+// timeline analyzes the sentences of the speech into cues. Sentences
+// failing to be analyzed are skipped, keeping the cue before.
+func (d *speakEmotionDriver) timeline(sentences []string, speak Speaking) []SpeakCue {
+	// when every sentence starts, by the text
+	starts := make([]time.Duration, len(sentences))
+	var total time.Duration
+	for i, s := range sentences {
+		starts[i] = total
+		total += textSpeechDuration(s, float64(speak.SpeechRate))
+	}
+	scale := 1.0
+	if speak.Duration > 0 && total > 0 {
+		scale = speak.Duration / total.Seconds()
+	}
+
+	// analyze concurrently (at most MaxSentenceAnalyses at a time), but
+	// map in order: stateful mappers follow the emotion changes of the
+	// sentences.
+	emotions := make([]*Emotion, len(sentences))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MaxSentenceAnalyses)
+	for i, s := range sentences {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, s string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			emo, err := d.analyzer.Analyze(s)
+			if err != nil {
+				log.Printf("WARN speakEmotionDriver: analyze sentence %q: %v.", s, err)
+				return
+			}
+			emotions[i] = &emo
+		}(i, s)
+	}
+	wg.Wait()
+
+	var timeline []SpeakCue
+	for i, emo := range emotions {
+		if emo == nil {
+			continue
+		}
+		expression, motion := d.mapEmotion(*emo)
+		timeline = append(timeline, SpeakCue{
+			Time:       roundTime(starts[i].Seconds() * scale),
+			Text:       sentences[i],
+			Expression: expression,
+			Motion:     motion,
+		})
+	}
+
+	return timeline
+}
@@ -0,0 +1,135 @@
+package live2ddriver
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpeakEmotionDriver(t *testing.T) {
+	profiles, err := NewProfileDriver(testProfiles(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer := mockAnalyzer{emo: Emotion{
+		Emotions: map[EmotionsKey]float32{"happiness": 1.0},
+		Polarity: map[PolarityKey]float32{"positive": 1.0},
+	}}
+	driver := NewSpeakEmotionDriver(profiles, profiles, analyzer, false)
+
+	testCases := []struct {
+		name string
+		req  Live2DRequest
+		want Speaking
+	}{
+		{"Filled", Live2DRequest{Speak: &Speaking{Text: "我很开心"}},
+			Speaking{Text: "我很开心", Expression: "a_smile", Motion: "a_happy"}},
+		{"GivenKept", Live2DRequest{Speak: &Speaking{Text: "我很开心", Expression: "f01"}},
+			Speaking{Text: "我很开心", Expression: "f01", Motion: "a_happy"}},
+		{"NoText", Live2DRequest{Speak: &Speaking{Audio: "a.wav"}},
+			Speaking{Audio: "a.wav"}},
+		{"SwitchedModel", Live2DRequest{Model: "b", Speak: &Speaking{Text: "我很开心"}},
+			Speaking{Text: "我很开心", Expression: "b_smile", Motion: "b_happy"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := driver.Drive(tc.req)
+			if !reflect.DeepEqual(*got.Speak, tc.want) {
+				t.Errorf("Drive() speak = %+v, want %+v", *got.Speak, tc.want)
+			}
+			if got.Motion != "" || got.Expression != "" {
+				t.Errorf("Drive() = %+v, want the speak filled only", got)
+			}
+		})
+	}
+
+	t.Run("AnalyzeError", func(t *testing.T) {
+		driver := NewSpeakEmotionDriver(profiles, profiles, mockAnalyzer{err: errors.New("emotext down")}, false)
+		req := Live2DRequest{Speak: &Speaking{Text: "我很开心"}}
+		if got := driver.Drive(req); !reflect.DeepEqual(got.Speak, req.Speak) {
+			t.Errorf("Drive() speak = %+v, want passed through", got.Speak)
+		}
+	})
+}
+
+// sentenceAnalyzer is an EmotionAnalyzer of the emotions of known texts.
+type sentenceAnalyzer map[string]Emotion
+
+func (a sentenceAnalyzer) Analyze(text string) (Emotion, error) {
+	emo, ok := a[text]
+	if !ok {
+		return Emotion{}, errors.New("unknown text")
+	}
+	return emo, nil
+}
+
+func TestSpeakEmotionDriver_sentences(t *testing.T) {
+	profiles, err := NewProfileDriver(testProfiles(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	happy := Emotion{Emotions: map[EmotionsKey]float32{"happiness": 1}, Polarity: map[PolarityKey]float32{"positive": 1}}
+	sad := Emotion{Emotions: map[EmotionsKey]float32{"sadness": 1}, Polarity: map[PolarityKey]float32{"negative": 1}}
+	analyzer := sentenceAnalyzer{"我很开心！": happy, "但是要走了。": sad}
+
+	driver := NewSpeakEmotionDriver(profiles, profiles, analyzer, true)
+
+	// timed by the text: the second starts after 4 syllables & a long pause.
+	// profile a maps nothing for sad.
+	got := driver.Drive(Live2DRequest{Speak: &Speaking{Text: "我很开心！但是要走了。"}})
+	want := []SpeakCue{
+		{Time: 0, Text: "我很开心！", Expression: "a_smile", Motion: "a_happy"},
+		{Time: (4*cjkSyllable + longPause).Seconds(), Text: "但是要走了。"},
+	}
+	if !reflect.DeepEqual(got.Speak.Timeline, want) {
+		t.Errorf("Drive() timeline = %+v, want %+v", got.Speak.Timeline, want)
+	}
+	if got.Speak.Expression != "a_smile" || got.Speak.Motion != "a_happy" {
+		t.Errorf("Drive() speak = %+v, want the expression & motion of the first cue", got.Speak)
+	}
+
+	// scaled to the duration
+	got = driver.Drive(Live2DRequest{Speak: &Speaking{Text: "我很开心！但是要走了。", Duration: 2 * (9*cjkSyllable + 2*longPause).Seconds()}})
+	if len(got.Speak.Timeline) != 2 || got.Speak.Timeline[1].Time != 2*want[1].Time {
+		t.Errorf("Drive(duration) timeline = %+v, want the second at %v", got.Speak.Timeline, 2*want[1].Time)
+	}
+
+	// a single sentence: no timeline
+	got = driver.Drive(Live2DRequest{Speak: &Speaking{Text: "我很开心！"}})
+	if got.Speak.Timeline != nil || got.Speak.Motion != "a_happy" {
+		t.Errorf("Drive(single sentence) speak = %+v, want no timeline", got.Speak)
+	}
+}
+
+// countingAnalyzer is a slow EmotionAnalyzer counting the concurrent
+// analyses.
+type countingAnalyzer struct {
+	running, max atomic.Int32
+}
+
+func (a *countingAnalyzer) Analyze(text string) (Emotion, error) {
+	n := a.running.Add(1)
+	defer a.running.Add(-1)
+	for m := a.max.Load(); n > m && !a.max.CompareAndSwap(m, n); m = a.max.Load() {
+	}
+	time.Sleep(10 * time.Millisecond)
+	return Emotion{}, nil
+}
+
+func TestSpeakEmotionDriver_maxAnalyses(t *testing.T) {
+	profiles, err := NewProfileDriver(testProfiles(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	analyzer := &countingAnalyzer{}
+	driver := NewSpeakEmotionDriver(profiles, profiles, analyzer, true)
+
+	driver.Drive(Live2DRequest{Speak: &Speaking{Text: strings.Repeat("好。", 20)}})
+	if max := analyzer.max.Load(); max > MaxSentenceAnalyses || max < 2 {
+		t.Errorf("analyzed %d sentences at a time, want 2~%d", max, MaxSentenceAnalyses)
+	}
+}
@@ -0,0 +1,148 @@
+package live2ddriver
+
+import (
+	"encoding/json"
+	"io"
+	"live2ddriver/emotext"
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/murchinroom/emotextcligo"
+)
+
+// EmotionAnalyzer analyzes the emotion of texts.
+type EmotionAnalyzer interface {
+	Analyze(text string) (Emotion, error)
+}
+
+// emotextAnalyzer is an EmotionAnalyzer backed by the emotext server
+// (via emotextcligo).
+type emotextAnalyzer struct{}
+
+// NewEmotextAnalyzer returns an EmotionAnalyzer that queries the emotext
+// server.
+func NewEmotextAnalyzer() EmotionAnalyzer {
+	return emotextAnalyzer{}
+}
+
+func (emotextAnalyzer) Analyze(text string) (Emotion, error) {
+	result, err := emotextcligo.Query(text)
+	if err != nil {
+		return Emotion{}, err
+	}
+
+	emo := Emotion(result)
+	emo.Emotions = emotions21To7(emo.Emotions)
+
+	return emo, nil
+}
+
+// emotions21To7 reduces the 21 emotion categories of emotext into the 7
+// categories that EmoMapperConfigs are written in. Keys that are already
+// one of the 7 categories are kept as they are.
+func emotions21To7(e map[EmotionsKey]float32) map[EmotionsKey]float32 {
+	e7 := make(map[EmotionsKey]float32, len(e))
+	for k, v := range e {
+		if k7, ok := emotext.Emotions21Map7[k]; ok {
+			k = k7
+		}
+		e7[k] += v
+	}
+	return e7
+}
+
+// TextDriver drives Live2DView by texts: text => Live2DRequest.
+type TextDriver interface {
+	DriveText(text string) (Live2DRequest, error)
+}
+
+// textDriver analyzes the emotion of the text and drives the emotion
+// request by a Live2DDriver (e.g. the universal emotion driver).
+type textDriver struct {
+	analyzer EmotionAnalyzer
+	driver   Live2DDriver
+}
+
+// NewTextDriver returns a TextDriver that analyzes texts by the analyzer,
+// and drives the result emotion by the driver.
+//
+// If driver is nil, the result request carries the unmapped Emotion field,
+// which is expected to be driven later (e.g. by the forwarder).
+func NewTextDriver(analyzer EmotionAnalyzer, driver Live2DDriver) TextDriver {
+	return &textDriver{
+		analyzer: analyzer,
+		driver:   driver,
+	}
+}
+
+func (d *textDriver) DriveText(text string) (Live2DRequest, error) {
+	emo, err := d.analyzer.Analyze(text)
+	if err != nil {
+		return Live2DRequest{}, err
+	}
+
+	req := Live2DRequest{Emotion: &emo}
+	if d.driver != nil {
+		req = d.driver.Drive(req)
+	}
+
+	return req, nil
+}
+
+// DriveTextHTTP listen on addr and serve http request: POST /driver.
+// Get text from request body, drive it into a Live2DRequest by driver,
+// and return the Live2DRequest as response. The Live2DRequest is also sent
+// to chOut after json.Marshal.
+//
+// Address a room by POST /driver/<room> or /driver?room=<room>: the room
+// is set to the Live2DRequest.
+//
+// No blocking.
+func DriveTextHTTP(driver TextDriver, addr string) (chOut chan []byte) {
+	chOut = make(chan []byte, BufferSize)
+	go func() {
+		router := gin.New()
+		router.Use(gin.Recovery())
+		handler := func(c *gin.Context) {
+			body := c.Request.Body
+			defer body.Close()
+
+			text, err := io.ReadAll(body)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			res, err := driver.DriveText(string(text))
+			if err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+				return
+			}
+			if reflect.ValueOf(res).IsZero() {
+				c.JSON(http.StatusBadRequest, gin.H{"warn": "empty Drive req"})
+				return
+			}
+
+			if room := c.Param("room"); room != "" {
+				res.Room = room
+			} else {
+				res.Room = c.Query("room")
+			}
+
+			j, err := json.Marshal(res)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			chOut <- j
+
+			c.Data(http.StatusOK, "application/json", j)
+		}
+		router.POST("/driver", handler)
+		router.POST("/driver/:room", handler)
+		router.Run(addr)
+	}()
+	return chOut
+}
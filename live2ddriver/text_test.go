@@ -0,0 +1,65 @@
+package live2ddriver
+
+import (
+	"errors"
+	"testing"
+)
+
+// mockAnalyzer is an EmotionAnalyzer that returns the emotion in it.
+type mockAnalyzer struct {
+	emo Emotion
+	err error
+}
+
+func (a mockAnalyzer) Analyze(text string) (Emotion, error) {
+	return a.emo, a.err
+}
+
+func TestTextDriver_DriveText(t *testing.T) {
+	analyzer := mockAnalyzer{emo: Emotion{
+		Emotions: map[EmotionsKey]float32{"happiness": 1.0},
+		Polarity: map[PolarityKey]float32{"positive": 1.0},
+	}}
+
+	t.Run("WithDriver", func(t *testing.T) {
+		factory, _ := BuiltinEmoMapperFactory("shizuku")
+		mapper, err := factory.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		driver := NewTextDriver(analyzer, NewEmotionDriver(mapper))
+
+		req, err := driver.DriveText("我很开心")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Motion != shizukuMotionsFromEmotions["happiness"] || req.Expression != shizukuExpressionFromPolarity["positive"] {
+			t.Errorf("DriveText() = %+v, want motion %v & expression %v", req,
+				shizukuMotionsFromEmotions["happiness"], shizukuExpressionFromPolarity["positive"])
+		}
+	})
+
+	t.Run("WithoutDriver", func(t *testing.T) {
+		req, err := NewTextDriver(analyzer, nil).DriveText("我很开心")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Emotion == nil {
+			t.Errorf("DriveText() = %+v, want unmapped emotion", req)
+		}
+	})
+
+	t.Run("AnalyzeError", func(t *testing.T) {
+		_, err := NewTextDriver(mockAnalyzer{err: errors.New("emotext down")}, nil).DriveText("我很开心")
+		if err == nil {
+			t.Errorf("DriveText() error = nil, want error")
+		}
+	})
+}
+
+func Test_emotions21To7(t *testing.T) {
+	e7 := emotions21To7(map[EmotionsKey]float32{"PA": 0.2, "PE": 0.3, "surprise": 0.5})
+	if e7["happiness"] != 0.5 || e7["surprise"] != 0.5 || len(e7) != 2 {
+		t.Errorf("emotions21To7() = %v, want map[happiness:0.5 surprise:0.5]", e7)
+	}
+}
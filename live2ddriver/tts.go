@@ -0,0 +1,299 @@
+package live2ddriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TTSRequest is the speech to synthesize.
+type TTSRequest struct {
+	Text       string  `json:"text"`
+	SpeechRate float32 `json:"speechRate,omitempty"` // 1 for normal, 0 for the default
+}
+
+// Speech is the audio synthesized by a TTS.
+type Speech struct {
+	Data        []byte
+	ContentType string // e.g. audio/wav
+}
+
+// TTS (text-to-speech) synthesizes speech audios from texts.
+type TTS interface {
+	Synthesize(ctx context.Context, req TTSRequest) (Speech, error)
+}
+
+var ErrTTS = errors.New("tts failed")
+
+// speechOf returns the Speech of the data, if it's an audio.
+func speechOf(data []byte, contentType string) (Speech, error) {
+	if !strings.HasPrefix(contentType, "audio/") {
+		contentType, _, _ = strings.Cut(http.DetectContentType(data), ";")
+	}
+	if !strings.HasPrefix(contentType, "audio/") {
+		return Speech{}, fmt.Errorf("%w: got %s (%d bytes), not an audio", ErrTTS, contentType, len(data))
+	}
+	return Speech{Data: data, ContentType: contentType}, nil
+}
+
+// region exec
+
+// execTTS runs a local command (e.g. espeak, piper) to synthesize.
+type execTTS struct {
+	command []string
+}
+
+// NewExecTTS returns a TTS that runs the command (no shell) for every
+// request. The text is written to the stdin of the command, and the audio
+// (WAV or MP3) is read from its stdout, or from the file of {out}.
+//
+// Placeholders in the arguments:
+//
+//	{text}: the text
+//	{rate}: the speech rate, 1 for normal
+//	{out}:  a temporary .wav file to write the audio to
+//
+// e.g. ["espeak", "--stdout"], ["piper", "--model", "zh.onnx", "--output_file", "{out}"].
+//
+// Texts that would make an argument a flag (e.g. "-h" for "{text}") are
+// rejected: prefer the stdin to {text} for texts from the chat.
+func NewExecTTS(command ...string) TTS {
+	return &execTTS{command: command}
+}
+
+func (t *execTTS) Synthesize(ctx context.Context, req TTSRequest) (Speech, error) {
+	if len(t.command) == 0 {
+		return Speech{}, fmt.Errorf("%w: no command", ErrTTS)
+	}
+
+	rate := req.SpeechRate
+	if rate <= 0 {
+		rate = 1
+	}
+
+	var out string
+	if strings.Contains(strings.Join(t.command, " "), "{out}") {
+		f, err := os.CreateTemp("", "live2ddriver-tts-*.wav")
+		if err != nil {
+			return Speech{}, err
+		}
+		f.Close()
+		out = f.Name()
+		defer os.Remove(out)
+	}
+
+	placeholders := strings.NewReplacer(
+		"{text}", req.Text,
+		"{rate}", strconv.FormatFloat(float64(rate), 'g', -1, 32),
+		"{out}", out,
+	)
+	args := make([]string, len(t.command))
+	for i, arg := range t.command {
+		args[i] = placeholders.Replace(arg)
+		if i > 0 && strings.HasPrefix(args[i], "-") && !strings.HasPrefix(arg, "-") {
+			return Speech{}, fmt.Errorf("%w: %s: text %q would be a flag", ErrTTS, t.command[0], req.Text)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(req.Text)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return Speech{}, fmt.Errorf("%w: %s: %v: %s", ErrTTS, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	data := stdout.Bytes()
+	if out != "" {
+		var err error
+		if data, err = os.ReadFile(out); err != nil {
+			return Speech{}, fmt.Errorf("%w: read %s: %v", ErrTTS, out, err)
+		}
+	}
+
+	return speechOf(data, "")
+}
+
+// endregion exec
+
+// region HTTP
+
+// httpTTS requests a TTS server to synthesize.
+type httpTTS struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPTTS returns a TTS that POSTs the TTSRequest (JSON) to the url,
+// which responds the audio (WAV or MP3).
+func NewHTTPTTS(url string) TTS {
+	return &httpTTS{url: url, client: &http.Client{}}
+}
+
+func (t *httpTTS) Synthesize(ctx context.Context, req TTSRequest) (Speech, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Speech{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return Speech{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return Speech{}, fmt.Errorf("%w: %v", ErrTTS, err)
+	}
+	defer resp.Body.Close()
+
+	// one more byte to tell a too large audio from a cut off one
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxAudioSize+1))
+	if err != nil {
+		return Speech{}, fmt.Errorf("%w: %v", ErrTTS, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return Speech{}, fmt.Errorf("%w: %s: %s", ErrTTS, resp.Status, bytes.TrimSpace(data))
+	}
+	if len(data) > MaxAudioSize {
+		return Speech{}, fmt.Errorf("%w: audio larger than %d bytes", ErrTTS, MaxAudioSize)
+	}
+
+	return speechOf(data, resp.Header.Get("Content-Type"))
+}
+
+// endregion HTTP
+
+// region mock
+
+// mockTTS synthesizes humming WAVs, following the TextLipSync of the text.
+type mockTTS struct{}
+
+// NewMockTTS returns a TTS that works offline (e.g. for tests & demos): it
+// synthesizes a 220Hz hum, louder where the mouth opens in TextLipSync.
+func NewMockTTS() TTS {
+	return mockTTS{}
+}
+
+// mockSampleRate of the WAVs by mockTTS.
+const mockSampleRate = 8000
+
+func (mockTTS) Synthesize(ctx context.Context, req TTSRequest) (Speech, error) {
+	lipSync, duration := TextLipSync(req.Text, float64(req.SpeechRate), 1)
+	if lipSync == nil {
+		return Speech{}, fmt.Errorf("%w: nothing to speak in %q", ErrTTS, req.Text)
+	}
+
+	samples := make([]int16, int(duration.Seconds()*mockSampleRate))
+	k := 0 // keyframes[k] <= t < keyframes[k+1]
+	for i := range samples {
+		t := float64(i) / mockSampleRate
+		for k+2 < len(lipSync.Keyframes) && lipSync.Keyframes[k+1].Time <= t {
+			k++
+		}
+		a, b := lipSync.Keyframes[k], lipSync.Keyframes[k+1]
+		amp := float64(a.Value)
+		if b.Time > a.Time {
+			amp += (float64(b.Value) - float64(a.Value)) * (t - a.Time) / (b.Time - a.Time)
+		}
+		samples[i] = int16(amp * 0.5 * math.MaxInt16 * math.Sin(2*math.Pi*220*t))
+	}
+
+	return Speech{Data: encodeWAV(samples, mockSampleRate), ContentType: "audio/wav"}, nil
+}
+
+// encodeWAV encodes the 16-bit mono PCM samples as a WAV.
+func encodeWAV(samples []int16, sampleRate int) []byte {
+	var wav bytes.Buffer
+	le := func(v interface{}) { _ = binary.Write(&wav, binary.LittleEndian, v) }
+
+	wav.WriteString("RIFF")
+	le(uint32(36 + 2*len(samples)))
+	wav.WriteString("WAVE")
+
+	wav.WriteString("fmt ")
+	le(uint32(16))
+	le(uint16(wavPCM))
+	le(uint16(1)) // mono
+	le(uint32(sampleRate))
+	le(uint32(sampleRate * 2))
+	le(uint16(2))
+	le(uint16(16))
+
+	wav.WriteString("data")
+	le(uint32(2 * len(samples)))
+	le(samples)
+
+	return wav.Bytes()
+}
+
+// endregion mock
+
+// ttsDriver is a Live2DDriver that synthesizes the audios of speak
+// requests with text but no audio.
+type ttsDriver struct {
+	next    Live2DDriver
+	tts     TTS
+	timeout time.Duration
+}
+
+// NewTTSDriver returns a Live2DDriver that drives requests by next (nil to
+// skip), and then synthesizes the audio (as a data URI) of speak requests
+// with text but no audio by the tts, in timeout (0 for no timeout).
+//
+// Requests failing to be synthesized are passed through without audio.
+func NewTTSDriver(next Live2DDriver, tts TTS, timeout time.Duration) Live2DDriver {
+	return &ttsDriver{
+		next:    next,
+		tts:     tts,
+		timeout: timeout,
+	}
+}
+
+func (d *ttsDriver) Drive(req Live2DRequest) Live2DRequest {
+	if d.next != nil {
+		req = d.next.Drive(req)
+	}
+
+	if req.Speak == nil || req.Speak.Audio != "" || strings.TrimSpace(req.Speak.Text) == "" {
+		return req
+	}
+
+	ctx := context.Background()
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	speech, err := d.tts.Synthesize(ctx, TTSRequest{
+		Text:       req.Speak.Text,
+		SpeechRate: req.Speak.SpeechRate,
+	})
+	if err != nil {
+		log.Printf("WARN ttsDriver: %v. Speak without audio.", err)
+		return req
+	}
+
+	speak := *req.Speak // don't modify the request of the caller
+	speak.Audio = "data:" + speech.ContentType + ";base64," + base64.StdEncoding.EncodeToString(speech.Data)
+	req.Speak = &speak
+
+	return req
+}
@@ -0,0 +1,153 @@
+package live2ddriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMockTTS(t *testing.T) {
+	speech, err := NewMockTTS().Synthesize(context.Background(), TTSRequest{Text: "你好"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := AnalyzeAudio(speech.Data, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want := TextLipSync("你好", 1, 1)
+	if speech.ContentType != "audio/wav" || info.Duration.Round(time.Millisecond) != want {
+		t.Errorf("Synthesize() = %s of %v, want audio/wav of %v", speech.ContentType, info.Duration, want)
+	}
+
+	if _, err := NewMockTTS().Synthesize(context.Background(), TTSRequest{Text: "..."}); !errors.Is(err, ErrTTS) {
+		t.Errorf("Synthesize(...) error = %v, want ErrTTS", err)
+	}
+}
+
+func TestExecTTS(t *testing.T) {
+	for _, name := range []string{"cat", "cp", "false"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+
+	wav := testWAV(8000, 1, 1)
+	file := filepath.Join(t.TempDir(), "a.wav")
+	if err := os.WriteFile(file, wav, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		command []string
+		ok      bool
+	}{
+		{"Stdout", []string{"cat", file}, true},
+		{"OutFile", []string{"cp", file, "{out}"}, true},
+		{"NotAudio", []string{"cat"}, false}, // echoes the text
+		{"Fail", []string{"false"}, false},
+	}
+
+	t.Run("TextAsFlag", func(t *testing.T) {
+		_, err := NewExecTTS("cat", "{text}").Synthesize(context.Background(), TTSRequest{Text: "-n /etc/passwd"})
+		if !errors.Is(err, ErrTTS) || !strings.Contains(err.Error(), "flag") {
+			t.Errorf("Synthesize(-n) error = %v, want ErrTTS of a flag", err)
+		}
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			speech, err := NewExecTTS(tc.command...).Synthesize(context.Background(), TTSRequest{Text: "hello"})
+			if !tc.ok {
+				if !errors.Is(err, ErrTTS) {
+					t.Errorf("Synthesize() error = %v, want ErrTTS", err)
+				}
+				return
+			}
+			if err != nil || string(speech.Data) != string(wav) || !strings.HasPrefix(speech.ContentType, "audio/") {
+				t.Errorf("Synthesize() = %s of %d bytes, %v, want the wav", speech.ContentType, len(speech.Data), err)
+			}
+		})
+	}
+}
+
+func TestHTTPTTS(t *testing.T) {
+	wav := testWAV(8000, 1, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req TTSRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/wav")
+		_, _ = w.Write(wav)
+	}))
+	defer ts.Close()
+
+	speech, err := NewHTTPTTS(ts.URL).Synthesize(context.Background(), TTSRequest{Text: "hello", SpeechRate: 1.2})
+	if err != nil || speech.ContentType != "audio/wav" || string(speech.Data) != string(wav) {
+		t.Errorf("Synthesize() = %s of %d bytes, %v, want the wav", speech.ContentType, len(speech.Data), err)
+	}
+
+	if _, err := NewHTTPTTS(ts.URL).Synthesize(context.Background(), TTSRequest{}); !errors.Is(err, ErrTTS) {
+		t.Errorf("Synthesize(400) error = %v, want ErrTTS", err)
+	}
+
+	// too large: an error rather than a cut off audio
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/wav")
+		_, _ = w.Write(wav)
+		_, _ = w.Write(make([]byte, MaxAudioSize))
+	}))
+	defer large.Close()
+
+	if _, err := NewHTTPTTS(large.URL).Synthesize(context.Background(), TTSRequest{Text: "hello"}); !errors.Is(err, ErrTTS) {
+		t.Errorf("Synthesize(too large) error = %v, want ErrTTS", err)
+	}
+}
+
+// failingTTS fails every request.
+type failingTTS struct{}
+
+func (failingTTS) Synthesize(ctx context.Context, req TTSRequest) (Speech, error) {
+	return Speech{}, ErrTTS
+}
+
+func TestTTSDriver(t *testing.T) {
+	driver := NewTTSDriver(nil, NewMockTTS(), time.Second)
+
+	req := Live2DRequest{Speak: &Speaking{Text: "hello"}}
+	got := driver.Drive(req)
+	if !strings.HasPrefix(got.Speak.Audio, "data:audio/wav;base64,") {
+		t.Errorf("Drive() audio = %.40s, want a data URI", got.Speak.Audio)
+	}
+	if req.Speak.Audio != "" {
+		t.Errorf("Drive() modified the request of the caller")
+	}
+
+	// the synthesized audio is analyzed after
+	analyzed := NewAudioDriver(driver, NewAudioLoader(""), 10).Drive(req)
+	if analyzed.Speak.Duration == 0 || analyzed.Speak.LipSync == nil {
+		t.Errorf("Drive() then analyze = %+v, want duration & lip sync", analyzed.Speak)
+	}
+
+	withAudio := Live2DRequest{Speak: &Speaking{Text: "hello", Audio: "a.wav"}}
+	if got := driver.Drive(withAudio); got.Speak.Audio != "a.wav" {
+		t.Errorf("Drive(with audio) audio = %s, want a.wav", got.Speak.Audio)
+	}
+
+	// on failures, speak without audio
+	if got := NewTTSDriver(nil, failingTTS{}, 0).Drive(req); got.Speak.Audio != "" {
+		t.Errorf("Drive(failing) audio = %.40s, want none", got.Speak.Audio)
+	}
+}
@@ -0,0 +1,264 @@
+// Package macro runs named choreography scripts: timed steps of
+// expressions, motions & speeches, for recurring bits like greetings,
+// sponsor reads and "goodnight".
+package macro
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"live2ddriver/live2ddriver"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrNotFound      = errors.New("macro not found")
+	ErrInvalidName   = errors.New("invalid macro name")
+	ErrInvalidScript = errors.New("invalid macro script")
+)
+
+// Extensions of the script files, in the order of precedence:
+// YAML (a list of steps), JSON (an array of steps), or JSONL (a step per
+// line).
+var Extensions = []string{".yaml", ".yml", ".json", ".jsonl"}
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidName reports whether name is a valid macro name: 1~64 letters,
+// digits, '_' or '-'.
+func ValidName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+// Step is a step of a macro script. The expression, motion & speak of a
+// step are sent as one Live2DRequest, and then the step waits for the
+// speech to end (WaitSpeech) and Wait seconds, if given.
+//
+// Example (JSONL):
+//
+//	{"expression": "f01", "motion": "wave", "speak": {"text": "大家好！"}}
+//	{"waitSpeech": true, "wait": 1.5}
+//	{"motion": "bow"}
+type Step struct {
+	Expression string                 `json:"expression,omitempty"`
+	Motion     string                 `json:"motion,omitempty"`
+	Speak      *live2ddriver.Speaking `json:"speak,omitempty"`
+
+	WaitSpeech bool    `json:"waitSpeech,omitempty"` // wait for the last speech of the macro to end
+	Wait       float64 `json:"wait,omitempty"`       // seconds to wait after the step
+}
+
+// request returns the Live2DRequest of the step. nil if nothing to send.
+func (s Step) request() *live2ddriver.Live2DRequest {
+	if s.Expression == "" && s.Motion == "" && s.Speak == nil {
+		return nil
+	}
+	return &live2ddriver.Live2DRequest{
+		Expression: s.Expression,
+		Motion:     s.Motion,
+		Speak:      s.Speak,
+	}
+}
+
+// Validate the steps of a script.
+func Validate(steps []Step) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("%w: no steps", ErrInvalidScript)
+	}
+
+	speaks := false
+	for i, s := range steps {
+		if s.request() == nil && !s.WaitSpeech && s.Wait == 0 {
+			return fmt.Errorf("%w: step %d: empty", ErrInvalidScript, i)
+		}
+		if s.Wait < 0 {
+			return fmt.Errorf("%w: step %d: negative wait", ErrInvalidScript, i)
+		}
+		if s.Speak != nil {
+			if s.Speak.Text == "" && s.Speak.Audio == "" {
+				return fmt.Errorf("%w: step %d: speak without text or audio", ErrInvalidScript, i)
+			}
+			speaks = true
+		}
+		if s.WaitSpeech && !speaks {
+			return fmt.Errorf("%w: step %d: waitSpeech before any speak", ErrInvalidScript, i)
+		}
+	}
+	return nil
+}
+
+// Parse the script data of the format given by the file extension (see
+// Extensions). Unknown fields are rejected, to catch typos.
+func Parse(data []byte, ext string) ([]Step, error) {
+	var steps []Step
+	var err error
+
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		steps, err = parseYAML(data)
+	case ".json":
+		err = decodeStrict(data, &steps)
+	case ".jsonl":
+		steps, err = parseJSONL(data)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidScript, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScript, err)
+	}
+
+	return steps, Validate(steps)
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func parseJSONL(data []byte) ([]Step, error) {
+	var steps []Step
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	for {
+		var s Step
+		err := dec.Decode(&s)
+		if err == io.EOF {
+			return steps, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %v", len(steps), err)
+		}
+		steps = append(steps, s)
+	}
+}
+
+// parseYAML decodes the YAML by the JSON tags of Step (and of the
+// Live2DRequest fields in it), so that all the formats share the same
+// field names.
+func parseYAML(data []byte) ([]Step, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonable(v)
+	if err != nil {
+		return nil, err
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+	return steps, decodeStrict(j, &steps)
+}
+
+// jsonable converts the maps decoded by yaml.v2 into JSON objects.
+func jsonable(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			var err error
+			if m[key], err = jsonable(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			var err error
+			if v[i], err = jsonable(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// Load the script of the macro from the dir: the first existing file of
+// <name><ext> for ext in Extensions.
+func Load(dir, name string) ([]Step, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	for _, ext := range Extensions {
+		data, err := os.ReadFile(filepath.Join(dir, name+ext))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		steps, err := Parse(data, ext)
+		if err != nil {
+			return nil, fmt.Errorf("macro %q: %w", name, err)
+		}
+		return steps, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+}
+
+// List the names of the macros in the dir, sorted.
+func List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var names []string
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		name := strings.TrimSuffix(e.Name(), ext)
+		if e.IsDir() || !isExtension(ext) || !ValidName(name) || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func isExtension(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAll loads every macro in the dir, to validate them.
+func LoadAll(dir string) (map[string][]Step, error) {
+	names, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	macros := make(map[string][]Step, len(names))
+	for _, name := range names {
+		if macros[name], err = Load(dir, name); err != nil {
+			return nil, err
+		}
+	}
+	return macros, nil
+}
@@ -0,0 +1,110 @@
+package macro
+
+import (
+	"errors"
+	"live2ddriver/live2ddriver"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	want := []Step{
+		{Expression: "f01", Motion: "wave", Speak: &live2ddriver.Speaking{Text: "大家好！", SpeechRate: 1.2}, WaitSpeech: true},
+		{Wait: 1.5},
+		{Motion: "bow"},
+	}
+
+	testCases := []struct {
+		ext  string
+		data string
+	}{
+		{".yaml", `
+- expression: f01
+  motion: wave
+  speak: {text: 大家好！, speechRate: 1.2}
+  waitSpeech: true
+- wait: 1.5
+- motion: bow
+`},
+		{".json", `[{"expression": "f01", "motion": "wave", "speak": {"text": "大家好！", "speechRate": 1.2}, "waitSpeech": true},
+{"wait": 1.5}, {"motion": "bow"}]`},
+		{".jsonl", `{"expression": "f01", "motion": "wave", "speak": {"text": "大家好！", "speechRate": 1.2}, "waitSpeech": true}
+{"wait": 1.5}
+
+{"motion": "bow"}
+`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.ext, func(t *testing.T) {
+			got, err := Parse([]byte(tc.data), tc.ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Parse() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParse_invalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		ext  string
+		data string
+	}{
+		{"UnknownFormat", ".txt", `wave`},
+		{"Empty", ".jsonl", ``},
+		{"UnknownField", ".yaml", `- motoin: wave`},
+		{"EmptyStep", ".json", `[{"motion": "wave"}, {}]`},
+		{"NegativeWait", ".jsonl", `{"wait": -1}`},
+		{"SpeakNothing", ".jsonl", `{"speak": {"volume": 1}}`},
+		{"WaitSpeechFirst", ".jsonl", `{"waitSpeech": true}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tc.data), tc.ext); !errors.Is(err, ErrInvalidScript) {
+				t.Errorf("Parse() error = %v, want ErrInvalidScript", err)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for file, data := range map[string]string{
+		"hello.yaml":     "- motion: wave\n",
+		"hello.jsonl":    `{"motion": "shadowed"}`,
+		"goodnight.json": `[{"motion": "bow"}]`,
+		"broken.jsonl":   `{"motion": `,
+		"notes.txt":      `not a macro`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if names, err := List(dir); err != nil || !reflect.DeepEqual(names, []string{"broken", "goodnight", "hello"}) {
+		t.Errorf("List() = %v, %v, want [broken goodnight hello]", names, err)
+	}
+
+	if steps, err := Load(dir, "hello"); err != nil || len(steps) != 1 || steps[0].Motion != "wave" {
+		t.Errorf("Load(hello) = %+v, %v, want the yaml", steps, err)
+	}
+	if _, err := Load(dir, "broken"); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("Load(broken) error = %v, want ErrInvalidScript", err)
+	}
+	if _, err := Load(dir, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load(missing) error = %v, want ErrNotFound", err)
+	}
+	if _, err := Load(dir, "../hello"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Load(../hello) error = %v, want ErrInvalidName", err)
+	}
+	if _, err := LoadAll(dir); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("LoadAll() error = %v, want ErrInvalidScript of broken", err)
+	}
+}
@@ -0,0 +1,291 @@
+package macro
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"live2ddriver/live2ddriver"
+	"live2ddriver/wsforwarder"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// speechPoll is how often a step waiting for a speech checks the speech
+// queue.
+const speechPoll = 100 * time.Millisecond
+
+var ErrNotRunning = errors.New("macro not running")
+
+// Forwarder forwards the requests of macros, e.g. the messageForwarder.
+type Forwarder interface {
+	SendMessage(msg []byte)
+	// Speech returns the speech queue of the room, to wait for speeches.
+	Speech(room string) (wsforwarder.SpeechQueueInfo, error)
+}
+
+// RunInfo describes a running macro.
+type RunInfo struct {
+	ID      string    `json:"id"`
+	Macro   string    `json:"macro"`
+	Room    string    `json:"room,omitempty"`
+	Step    int       `json:"step"` // the step in progress
+	Steps   int       `json:"steps"`
+	Started time.Time `json:"started"`
+}
+
+// run is a running macro.
+type run struct {
+	RunInfo
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Runner runs the macros in a dir, by the Forwarder.
+//
+// Every run is independent: macros (including the same one) can run
+// concurrently, each with its own progress & speeches, and be cancelled
+// one by one.
+type Runner struct {
+	forwarder Forwarder
+	dir       string
+
+	runs map[string]*run // id => run
+	seq  uint64          // to number runs
+	mu   sync.Mutex
+}
+
+// NewRunner returns a Runner of the macros in the dir. Scripts are read on
+// every start, so that edits take effect without reloading.
+func NewRunner(forwarder Forwarder, dir string) *Runner {
+	return &Runner{
+		forwarder: forwarder,
+		dir:       dir,
+		runs:      map[string]*run{},
+	}
+}
+
+// Macros returns the names of the macros.
+func (r *Runner) Macros() ([]string, error) {
+	return List(r.dir)
+}
+
+// Start running the macro in the room (empty for the DefaultRoom), without
+// waiting for it to finish.
+func (r *Runner) Start(name, room string) (RunInfo, error) {
+	if room != "" && !wsforwarder.ValidRoomName(room) {
+		return RunInfo{}, fmt.Errorf("%w: %q", wsforwarder.ErrInvalidRoom, room)
+	}
+	steps, err := Load(r.dir, name)
+	if err != nil {
+		return RunInfo{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r.mu.Lock()
+	r.seq++
+	ru := &run{
+		RunInfo: RunInfo{
+			ID:      strconv.FormatUint(r.seq, 10),
+			Macro:   name,
+			Room:    room,
+			Steps:   len(steps),
+			Started: time.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	r.runs[ru.ID] = ru
+	info := ru.RunInfo
+	r.mu.Unlock()
+
+	log.Printf("INFO macro %q: run %s started in room %q.", name, ru.ID, room)
+
+	go func() {
+		defer close(ru.done)
+		defer cancel()
+
+		err := r.run(ctx, ru, steps)
+
+		r.mu.Lock()
+		delete(r.runs, ru.ID)
+		r.mu.Unlock()
+
+		switch {
+		case errors.Is(err, context.Canceled):
+			log.Printf("INFO macro %q: run %s cancelled at step %d.", name, ru.ID, ru.Step)
+		case err != nil:
+			log.Printf("WARN macro %q: run %s: %v.", name, ru.ID, err)
+		default:
+			log.Printf("INFO macro %q: run %s finished.", name, ru.ID)
+		}
+	}()
+
+	return info, nil
+}
+
+// run the steps. Returns the ctx.Err() if cancelled.
+func (r *Runner) run(ctx context.Context, ru *run, steps []Step) error {
+	var speech string // id of the last speech
+	for i, s := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		ru.Step = i
+		r.mu.Unlock()
+
+		if req := s.request(); req != nil {
+			req.Room = ru.Room
+			req.Priority = live2ddriver.PriorityManual
+			if req.Speak != nil {
+				req.ID = fmt.Sprintf("macro-%s-%d", ru.ID, i) // to wait for the speech
+				speech = req.ID
+			}
+			msg, err := json.Marshal(req)
+			if err != nil {
+				return err
+			}
+			r.forwarder.SendMessage(msg)
+		}
+
+		if s.WaitSpeech {
+			if err := r.waitSpeech(ctx, ru.Room, speech); err != nil {
+				return err
+			}
+		}
+		if s.Wait > 0 {
+			if err := sleep(ctx, time.Duration(s.Wait*float64(time.Second))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waitSpeech waits until the speech with the id is neither in progress nor
+// pending in the speech queue of the room.
+func (r *Runner) waitSpeech(ctx context.Context, room, id string) error {
+	for {
+		q, err := r.forwarder.Speech(room)
+		if err != nil {
+			return err
+		}
+		if !inQueue(q, id) {
+			return nil
+		}
+		if err := sleep(ctx, speechPoll); err != nil {
+			return err
+		}
+	}
+}
+
+func inQueue(q wsforwarder.SpeechQueueInfo, id string) bool {
+	if q.Current != nil && q.Current.ID == id {
+		return true
+	}
+	for _, s := range q.Pending {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep for d, or until the ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Runs returns the running macros, in the order of starting.
+func (r *Runner) Runs() []RunInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	runs := make([]RunInfo, 0, len(r.runs))
+	for _, ru := range r.runs {
+		runs = append(runs, ru.RunInfo)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs
+}
+
+// Cancel the runs of the macro, or only the run with the id if given, and
+// wait for them to stop. Speeches already sent are not called back.
+// Returns the number of the runs cancelled, or ErrNotRunning if none.
+func (r *Runner) Cancel(name, id string) (int, error) {
+	r.mu.Lock()
+	var runs []*run
+	for _, ru := range r.runs {
+		if ru.Macro == name && (id == "" || ru.ID == id) {
+			runs = append(runs, ru)
+		}
+	}
+	r.mu.Unlock()
+
+	if len(runs) == 0 {
+		return 0, fmt.Errorf("%w: %q", ErrNotRunning, name)
+	}
+	for _, ru := range runs {
+		ru.cancel()
+		<-ru.done
+	}
+	return len(runs), nil
+}
+
+// region HTTP
+
+// Routes registers the macro APIs:
+//
+//	GET    /macro: the macros, and the running ones
+//	POST   /macro/:name?room=<room>: start the macro
+//	DELETE /macro/:name[?run=<id>]: cancel the runs of the macro
+func (r *Runner) Routes(router gin.IRouter) {
+	router.GET("/macro", func(c *gin.Context) {
+		names, err := r.Macros()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"macros": names, "runs": r.Runs()})
+	})
+	router.POST("/macro/:name", func(c *gin.Context) {
+		info, err := r.Start(c.Param("name"), c.Query("room"))
+		switch {
+		case errors.Is(err, ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrInvalidScript):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusAccepted, info)
+		}
+	})
+	router.DELETE("/macro/:name", func(c *gin.Context) {
+		n, err := r.Cancel(c.Param("name"), c.Query("run"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"cancelled": n})
+	})
+}
+
+// endregion HTTP
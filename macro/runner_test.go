@@ -0,0 +1,207 @@
+package macro
+
+import (
+	"encoding/json"
+	"errors"
+	"live2ddriver/live2ddriver"
+	"live2ddriver/wsforwarder"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeForwarder records the requests sent, and keeps every speech in
+// progress until it's finished.
+type fakeForwarder struct {
+	sent     []live2ddriver.Live2DRequest
+	speaking map[string]bool // speech id => in progress
+	mu       sync.Mutex
+}
+
+func newFakeForwarder() *fakeForwarder {
+	return &fakeForwarder{speaking: map[string]bool{}}
+}
+
+func (f *fakeForwarder) SendMessage(msg []byte) {
+	var req live2ddriver.Live2DRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		panic(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, req)
+	if req.Speak != nil {
+		f.speaking[req.ID] = true
+	}
+}
+
+func (f *fakeForwarder) Speech(room string) (wsforwarder.SpeechQueueInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	q := wsforwarder.SpeechQueueInfo{Room: room}
+	for id := range f.speaking {
+		q.Pending = append(q.Pending, wsforwarder.SpeechInfo{ID: id})
+	}
+	return q, nil
+}
+
+func (f *fakeForwarder) finish(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.speaking, id)
+}
+
+// motions returns the motions sent in the room.
+func (f *fakeForwarder) motions(room string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var motions []string
+	for _, req := range f.sent {
+		if req.Room == room && req.Motion != "" {
+			motions = append(motions, req.Motion)
+		}
+	}
+	return motions
+}
+
+// waitFor polls cond for a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func writeMacros(t *testing.T, macros map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for file, data := range macros {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRunner(t *testing.T) {
+	dir := writeMacros(t, map[string]string{
+		"greet.jsonl": `{"motion": "wave", "speak": {"text": "大家好！"}}
+{"waitSpeech": true}
+{"motion": "bow"}`,
+		"fidget.jsonl": `{"motion": "a"}
+{"wait": 0.05}
+{"motion": "b"}`,
+		"long.jsonl": `{"motion": "start"}
+{"wait": 60}
+{"motion": "never"}`,
+	})
+	fwd := newFakeForwarder()
+	r := NewRunner(fwd, dir)
+
+	if names, err := r.Macros(); err != nil || len(names) != 3 {
+		t.Errorf("Macros() = %v, %v, want 3 macros", names, err)
+	}
+
+	// concurrent runs don't wait for each other
+	greet, err := r.Start("greet", "brb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Start("fidget", "brb"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "fidget", func() bool { return len(fwd.motions("brb")) == 3 })
+	if runs := r.Runs(); len(runs) != 1 || runs[0].ID != greet.ID || runs[0].Step != 1 {
+		t.Errorf("Runs() = %+v, want greet waiting for the speech", runs)
+	}
+
+	var speak live2ddriver.Live2DRequest
+	fwd.mu.Lock()
+	for _, req := range fwd.sent {
+		if req.Speak != nil {
+			speak = req
+		}
+	}
+	fwd.mu.Unlock()
+	if speak.Priority != live2ddriver.PriorityManual || speak.Motion != "wave" || speak.ID == "" {
+		t.Errorf("greet sent %+v, want a manual speak with an id", speak)
+	}
+
+	fwd.finish(speak.ID)
+	waitFor(t, "greet", func() bool { return len(r.Runs()) == 0 })
+	if got := fwd.motions("brb"); got[len(got)-1] != "bow" {
+		t.Errorf("motions = %v, want bow after the speech", got)
+	}
+
+	// cancel mid-run
+	if _, err := r.Start("long", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "long", func() bool { return len(fwd.motions("")) == 1 })
+	if n, err := r.Cancel("long", ""); n != 1 || err != nil {
+		t.Errorf("Cancel(long) = %d, %v, want 1", n, err)
+	}
+	if got := fwd.motions(""); len(got) != 1 || len(r.Runs()) != 0 {
+		t.Errorf("after Cancel: motions %v, runs %+v, want stopped", got, r.Runs())
+	}
+	if _, err := r.Cancel("long", ""); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Cancel(long) again = %v, want ErrNotRunning", err)
+	}
+
+	if _, err := r.Start("greet", "../etc"); !errors.Is(err, wsforwarder.ErrInvalidRoom) {
+		t.Errorf("Start(bad room) = %v, want ErrInvalidRoom", err)
+	}
+}
+
+func TestRunner_Routes(t *testing.T) {
+	dir := writeMacros(t, map[string]string{
+		"long.yaml":   "- motion: start\n- wait: 60\n",
+		"broken.yaml": "- {}\n",
+	})
+	r := NewRunner(newFakeForwarder(), dir)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	r.Routes(router)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	do := func(method, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/macro/missing", http.StatusNotFound},
+		{http.MethodPost, "/macro/broken", http.StatusUnprocessableEntity},
+		{http.MethodPost, "/macro/long?room=brb", http.StatusAccepted},
+		{http.MethodGet, "/macro", http.StatusOK},
+		{http.MethodDelete, "/macro/long?run=42", http.StatusNotFound},
+		{http.MethodDelete, "/macro/long", http.StatusOK},
+		{http.MethodDelete, "/macro/long", http.StatusNotFound},
+	} {
+		if got := do(tc.method, tc.path); got != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"live2ddriver/config"
 	"live2ddriver/live2ddriver"
+	"live2ddriver/macro"
 	"live2ddriver/wsforwarder"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/net/websocket"
@@ -16,18 +19,35 @@ import (
 // region CLI
 
 var (
+	configFile = flag.String("config", "", "whole-server config file (YAML or JSON): listeners, inputs & model profiles. Flags set explicitly override the file.")
+
 	wsAddr   = flag.String("wsAddr", ":9001", "(out) forward messages to WebSocket server address")
 	httpAddr = flag.String("httpAddr", ":9002", "(in) forward messages from HTTP server address. Empty to disable.")
 	stdin    = flag.Bool("stdin", false, "(in) forward messages from stdin")
 	verbose  = flag.Bool("verbose", false, "verbose mode")
 
+	// debugging
+
+	recordFile  = flag.String("record", "", "append every inbound & outbound message to the JSONL file. Empty to disable.")
+	replayFile  = flag.String("replay", "", "replay mode: re-forward the JSONL recording (of -record) once a view connects. Empty to disable.")
+	replaySpeed = flag.Float64("replaySpeed", 1, "pacing of -replay: 1 as recorded, 2 twice as fast, 0 without pacing")
+
 	// drivers
 
+	emoMapper  = flag.String("emoMapper", "", "(driver) EmoMapperFactory config file (JSON or YAML) of the universal emotion driver: map {\"emotion\": ...} requests to motion & expression. Empty to disable.")
+	driverAddr = flag.String("driver", "", "(in) text-in driver server address: POST text to /driver, the emotion of the text is analyzed and mapped by the current profile (or -emoMapper). Empty to disable. (e.g. localhost:9004)")
+
 	// Deprecated: Legacy model-specific driver.
-	shizukuAddr = flag.String("shizuku", "", "Shizuku driver server address (text in). Empty to disable. (e.g. localhost:9004)")
+	shizukuAddr = flag.String("shizuku", "", "Deprecated: use -driver instead. Text-in driver with the built-in shizuku profile. Empty to disable. (e.g. localhost:9004)")
+)
+
+// profile names for the legacy flags
+const (
+	emoMapperProfile = "emoMapper"
+	shizukuProfile   = "shizuku"
 )
 
-func cli() {
+func cli() *config.Config {
 	flag.Usage = func() {
 		fmt.Printf("Usage: %s [options]\n", os.Args[0])
 		fmt.Printf("Forward messages from stdin | http to WebSocket clients.\n")
@@ -36,13 +56,86 @@ func cli() {
 
 	flag.Parse()
 
-	if !*stdin && *httpAddr == "" && *shizukuAddr == "" {
-		fmt.Fprintf(os.Stderr, "Error: no input source: -stdin or -httpAddr or -shizuku is required.\n")
+	// Deprecated: Legacy model-specific driver.
+	if *shizukuAddr != "" {
+		log.Println("Warning: -shizuku is deprecated. Use -driver with a profile instead.")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	wsforwarder.Verbose = *verbose
+	*verbose = cfg.Verbose
+	wsforwarder.Verbose = cfg.Verbose
+
+	return cfg
+}
+
+// loadConfig loads the config file (-config) and overrides it with the
+// flags set explicitly. The result config is validated.
+//
+// It reads the files again on every call, which is how the reloading works.
+func loadConfig() (*config.Config, error) {
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// flags set explicitly override the config file
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "wsAddr":
+			cfg.WsAddr = *wsAddr
+		case "httpAddr":
+			cfg.Inputs.HTTPAddr = *httpAddr
+		case "stdin":
+			cfg.Inputs.Stdin = *stdin
+		case "verbose":
+			cfg.Verbose = *verbose
+		case "driver":
+			cfg.Inputs.DriverAddr = *driverAddr
+		case "record":
+			cfg.Record.File = *recordFile
+		case "replay":
+			cfg.Replay.File = *replayFile
+		case "replaySpeed":
+			cfg.Replay.Speed = *replaySpeed
+		case "emoMapper":
+			factory, e := live2ddriver.LoadEmoMapperFactory(*emoMapper)
+			if e != nil {
+				err = fmt.Errorf("load emoMapper config %s: %w", *emoMapper, e)
+				return
+			}
+			cfg.Profiles[emoMapperProfile] = live2ddriver.Profile{EmoMapper: *factory}
+			cfg.DefaultProfile = emoMapperProfile
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Deprecated: Legacy model-specific driver.
+	if *shizukuAddr != "" {
+		shizuku, _ := live2ddriver.BuiltinProfile(shizukuProfile)
+		cfg.Profiles[shizukuProfile] = *shizuku
+		if cfg.DefaultProfile == "" {
+			cfg.DefaultProfile = shizukuProfile
+		}
+		cfg.Inputs.DriverAddr = *shizukuAddr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
 }
 
 // endregion CLI
@@ -52,43 +145,98 @@ func init() {
 }
 
 func main() {
-	cli()
+	cfg := cli()
+
+	// the universal drivers: one per room, so that every room follows its
+	// own model switching. Speak requests are synthesized (TTS), their audios
+	// analyzed, and then get the expression & motion of their text, timed
+	// by the duration.
+	drivers, err := live2ddriver.NewProfileDrivers(cfg.Profiles, cfg.DefaultProfile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	verboseLogf("Universal driver: %d profile(s), default %q.\n", len(cfg.Profiles), cfg.DefaultProfile)
+
+	reloadOnSIGHUP(drivers)
+
+	analyzer := live2ddriver.NewEmotextAnalyzer()
+
+	// short-lived audios served on the http input
+	audioHost, err := cfg.AudioHost()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	opts := append(cfg.Forwarder.Options(), wsforwarder.WithRoomDriver(func(room string) live2ddriver.Live2DDriver {
+		profile := drivers.Get(room)
+		driver := cfg.Audio.Driver(cfg.TTS.Driver(profile), audioHost)
+		return cfg.SpeakEmotion.Driver(driver, profile, analyzer)
+	}), wsforwarder.WithIdle(func(room string) live2ddriver.IdleBehavior {
+		return drivers.Get(room).Idle() // of the current profile of the room
+	}))
+
+	// the traffic, to debug glitches afterwards
+	if cfg.Record.File != "" {
+		recorder, err := wsforwarder.OpenRecorder(cfg.Record.File)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		opts = append(opts, wsforwarder.WithRecorder(recorder))
+		verboseLogf("Recording the traffic to %s...\n", cfg.Record.File)
+	}
 
-	forwarder := wsforwarder.NewMessageForwarder()
+	forwarder := wsforwarder.NewMessageForwarder(opts...)
 
+	// /live2d?room=<room> or /live2d/<room>
 	http.Handle("/live2d", websocket.Handler(func(c *websocket.Conn) {
 		forwarder.ForwardMessageTo(c)
 	}))
+	http.Handle("/live2d/", websocket.Handler(func(c *websocket.Conn) {
+		forwarder.ForwardMessageToRoom(strings.TrimPrefix(c.Request().URL.Path, "/live2d/"), c)
+	}))
 
-	if *stdin {
+	if cfg.Inputs.Stdin {
 		go func() {
 			forwarder.ForwardMessageFromStdin()
 		}()
 	}
-	if *httpAddr != "" {
+	if cfg.Inputs.HTTPAddr != "" {
+		routes := []wsforwarder.RouteRegister{adminRoutes(drivers)}
+		if audioHost != nil {
+			routes = append(routes, audioHost.Routes)
+			verboseLogf("(in) Hosting audios on %s/audio...\n", cfg.Inputs.HTTPAddr)
+		}
+		if cfg.Macros.Dir != "" {
+			routes = append(routes, macro.NewRunner(forwarder, cfg.Macros.Dir).Routes)
+			verboseLogf("(in) Macros of %s on %s/macro...\n", cfg.Macros.Dir, cfg.Inputs.HTTPAddr)
+		}
+
 		go func() {
-			err := forwarder.ForwardMessageFromHTTP(*httpAddr)
+			err := forwarder.ForwardMessageFromHTTP(cfg.Inputs.HTTPAddr, routes...)
 			if err != nil {
 				panic(err)
 			}
 		}()
 	}
 
-	// Deprecated: Legacy model-specific driver.
-	if *shizukuAddr != "" {
-		log.Println("Warning: the model-specific driver (-shizuku) is deprecated. Use the universal driver instead.")
-
-		driver := live2ddriver.NewShizukuDriver()
+	if cfg.Inputs.DriverAddr != "" {
+		// the emotion is mapped by the forwarder, with the driver of the
+		// room addressed.
+		textDriver := live2ddriver.NewTextDriver(analyzer, nil)
 
 		go func() {
-			verboseLogf("(in) Shizuku Driver Listening on %s...\n", *shizukuAddr)
-			dh := live2ddriver.DriveLive2DHTTP(driver, *shizukuAddr)
+			verboseLogf("(in) Text Driver Listening on %s/driver...\n", cfg.Inputs.DriverAddr)
+			dh := live2ddriver.DriveTextHTTP(textDriver, cfg.Inputs.DriverAddr)
 			forwarder.ForwardMessageFrom(dh)
 		}()
 	}
 
-	verboseLogf("(out) Listening WebSocket on %s/live2d...\n", *wsAddr)
-	if err := http.ListenAndServe(*wsAddr, nil); err != nil {
+	if cfg.Replay.File != "" {
+		replayOnConnect(forwarder, cfg.Replay)
+	}
+
+	verboseLogf("(out) Listening WebSocket on %s/live2d[/<room>]...\n", cfg.WsAddr)
+	if err := wsforwarder.ListenAndServe(cfg.WsAddr, nil); err != nil {
 		panic("ListenAndServe: " + err.Error())
 	}
 }
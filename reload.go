@@ -0,0 +1,71 @@
+package main
+
+import (
+	"live2ddriver/live2ddriver"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reloadMu serializes reloads from SIGHUP & the admin API.
+var reloadMu sync.Mutex
+
+// reloadProfiles reads the config (files & flags) again and swaps the new
+// profiles into the drivers of every room.
+//
+// Only the profiles are reloaded. Listeners & inputs take effect after
+// restarting. An invalid config is rejected and the running one kept.
+func reloadProfiles(drivers live2ddriver.ProfileDrivers) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := drivers.Reload(cfg.Profiles, cfg.DefaultProfile); err != nil {
+		return err
+	}
+
+	log.Printf("INFO reload: %d profile(s) loaded, current profiles %v.", len(cfg.Profiles), drivers.CurrentProfiles())
+	return nil
+}
+
+// reloadOnSIGHUP reloads the profiles on SIGHUP.
+//
+// No blocking.
+func reloadOnSIGHUP(drivers live2ddriver.ProfileDrivers) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			log.Printf("INFO reload: SIGHUP received.")
+			if err := reloadProfiles(drivers); err != nil {
+				log.Printf("ERROR reload: %v. Keep running with the old config.", err)
+			}
+		}
+	}()
+}
+
+// adminRoutes registers the admin APIs:
+//
+//	POST /admin/reload: reload the profiles
+func adminRoutes(drivers live2ddriver.ProfileDrivers) func(router gin.IRouter) {
+	return func(router gin.IRouter) {
+		router.POST("/admin/reload", func(c *gin.Context) {
+			if err := reloadProfiles(drivers); err != nil {
+				log.Printf("ERROR reload: %v. Keep running with the old config.", err)
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"profiles": drivers.CurrentProfiles()})
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"live2ddriver/config"
+	"live2ddriver/wsforwarder"
+	"log"
+	"time"
+)
+
+// replayer is the part of the messageForwarder replaying recordings.
+type replayer interface {
+	Clients() []wsforwarder.ClientInfo
+	Replay(ctx context.Context, records []wsforwarder.Record, opts wsforwarder.ReplayOptions) (int, error)
+}
+
+// replayPoll is how often the replay mode checks for connected views.
+const replayPoll = 100 * time.Millisecond
+
+// replayOnConnect replays the recording once the first view connects: the
+// replay mode. The recording was validated with the config.
+//
+// No blocking.
+func replayOnConnect(forwarder replayer, cfg config.Replay) {
+	records, err := wsforwarder.LoadRecords(cfg.File)
+	if err != nil {
+		log.Printf("ERROR replay: %v.", err)
+		return
+	}
+
+	go func() {
+		log.Printf("INFO replay: waiting for a view to replay %d record(s) of %s...", len(records), cfg.File)
+		for len(forwarder.Clients()) == 0 {
+			time.Sleep(replayPoll)
+		}
+
+		n, err := forwarder.Replay(context.Background(), records, cfg.Options())
+		if err != nil {
+			log.Printf("ERROR replay: %v.", err)
+			return
+		}
+		log.Printf("INFO replay: %d message(s) of %s replayed.", n, cfg.File)
+	}()
+}
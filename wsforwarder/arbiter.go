@@ -0,0 +1,215 @@
+package wsforwarder
+
+import (
+	"errors"
+	"fmt"
+	"live2ddriver/live2ddriver"
+	"sync"
+	"time"
+)
+
+// ArbiterConfig configures the arbitration of motions & expressions.
+type ArbiterConfig struct {
+	// DefaultPriority of requests without a priority, and not mapped
+	// from an emotion (which are PriorityEmotion). Default: PriorityChat.
+	DefaultPriority live2ddriver.Priority
+
+	// MotionHold is how long a motion holds before a lower-priority motion
+	// can replace it.
+	MotionHold time.Duration
+	// ExpressionDwell is how long an expression is held before a
+	// lower-priority expression can replace it.
+	ExpressionDwell time.Duration
+
+	// Cooldown is the minimum time between two motions of the same group,
+	// or Cooldowns[group] if given. Manual motions ignore cooldowns.
+	Cooldown  time.Duration
+	Cooldowns map[string]time.Duration
+}
+
+var ErrInvalidArbiterConfig = errors.New("invalid arbiter config")
+
+// Validate the config.
+func (c ArbiterConfig) Validate() error {
+	if c.DefaultPriority != "" && priorityRank(c.DefaultPriority) < 0 {
+		return fmt.Errorf("%w: unknown defaultPriority %q", ErrInvalidArbiterConfig, c.DefaultPriority)
+	}
+	if c.MotionHold < 0 || c.ExpressionDwell < 0 || c.Cooldown < 0 {
+		return fmt.Errorf("%w: negative duration", ErrInvalidArbiterConfig)
+	}
+	for group, d := range c.Cooldowns {
+		if d < 0 {
+			return fmt.Errorf("%w: negative cooldown of %q", ErrInvalidArbiterConfig, group)
+		}
+	}
+	return nil
+}
+
+// priorityRank returns the order of the priority: idle < chat < emotion <
+// manual. -1 for unknown priorities.
+func priorityRank(p live2ddriver.Priority) int {
+	switch p {
+	case live2ddriver.PriorityIdle:
+		return 0
+	case live2ddriver.PriorityChat:
+		return 1
+	case live2ddriver.PriorityEmotion:
+		return 2
+	case live2ddriver.PriorityManual:
+		return 3
+	}
+	return -1
+}
+
+// arbiter is the Filter arbitrating the motions & expressions of every
+// room by their priorities.
+type arbiter struct {
+	config ArbiterConfig
+
+	rooms map[string]*arbiterState
+	mu    sync.Mutex
+}
+
+// arbiterState is what's playing in a room.
+type arbiterState struct {
+	motion     arbitrated
+	expression arbitrated
+	played     map[string]time.Time // motion group => when it was last played
+}
+
+// arbitrated is a motion or expression that won.
+type arbitrated struct {
+	name     string
+	priority live2ddriver.Priority
+	since    time.Time
+}
+
+// NewArbiter returns a Filter arbitrating motions & expressions (of the
+// request, of its speak, and of the timeline cues of the speech): instead of
+// the last arrived one always winning, a motion (or expression) is stripped
+// from the request if
+//
+//   - a motion of higher priority is playing for less than MotionHold
+//     (an expression of higher priority is held for less than
+//     ExpressionDwell);
+//   - or, for motions, the same group played within its cooldown.
+//
+// The priority of a request is its Priority, or PriorityEmotion for
+// requests mapped from an emotion, or the DefaultPriority. Equal or higher
+// priorities replace at once. Switching the model resets the arbitration
+// of the room. Decisions are logged in the verbose mode.
+//
+// The config should be valid.
+func NewArbiter(config ArbiterConfig) Filter {
+	if config.DefaultPriority == "" {
+		config.DefaultPriority = live2ddriver.PriorityChat
+	}
+	return &arbiter{
+		config: config,
+		rooms:  map[string]*arbiterState{},
+	}
+}
+
+func (a *arbiter) Filter(ctx FilterContext, req live2ddriver.Live2DRequest) (live2ddriver.Live2DRequest, bool) {
+	priority := a.priority(ctx, req)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.rooms[ctx.Room]
+	if !ok || req.Model != "" {
+		s = &arbiterState{played: map[string]time.Time{}}
+		a.rooms[ctx.Room] = s
+	}
+
+	// arbitrate the motion (expression) played at the time: stripped if
+	// it loses, otherwise it takes over if record.
+	stripped := false
+	motion := func(name *string, now time.Time, record bool) {
+		if *name == "" {
+			return
+		}
+		if reason := a.rejectMotion(s, now, *name, priority); reason != "" {
+			verboseLogf("INFO arbiter room %q: reject %s motion %q: %s.", ctx.Room, priority, *name, reason)
+			*name, stripped = "", true
+		} else if record {
+			verboseLogf("INFO arbiter room %q: play %s motion %q.", ctx.Room, priority, *name)
+			s.motion = arbitrated{*name, priority, now}
+			s.played[*name] = now
+		}
+	}
+	expression := func(name *string, now time.Time, record bool) {
+		if *name == "" {
+			return
+		}
+		if reason := a.outranked(s.expression, now, priority, a.config.ExpressionDwell); reason != "" {
+			verboseLogf("INFO arbiter room %q: reject %s expression %q: %s.", ctx.Room, priority, *name, reason)
+			*name, stripped = "", true
+		} else if record {
+			verboseLogf("INFO arbiter room %q: set %s expression %q.", ctx.Room, priority, *name)
+			s.expression = arbitrated{*name, priority, now}
+		}
+	}
+
+	motion(&req.Motion, ctx.Time, true)
+	expression(&req.Expression, ctx.Time, true)
+
+	if req.Speak != nil {
+		speak := *req.Speak // copied: never modify the caller's
+		motion(&speak.Motion, ctx.Time, true)
+		expression(&speak.Expression, ctx.Time, true)
+
+		// the cues are arbitrated against what's playing at their time, but
+		// don't take over: they are not played yet.
+		if len(speak.Timeline) > 0 {
+			speak.Timeline = append([]live2ddriver.SpeakCue(nil), speak.Timeline...)
+			for i := range speak.Timeline {
+				cue := &speak.Timeline[i]
+				at := ctx.Time.Add(time.Duration(cue.Time * float64(time.Second)))
+				motion(&cue.Motion, at, false)
+				expression(&cue.Expression, at, false)
+			}
+		}
+		req.Speak = &speak
+	}
+
+	return req, !stripped || !isEmptyRequest(req)
+}
+
+// priority of the request.
+func (a *arbiter) priority(ctx FilterContext, req live2ddriver.Live2DRequest) live2ddriver.Priority {
+	switch {
+	case priorityRank(req.Priority) >= 0:
+		return req.Priority
+	case ctx.FromEmotion:
+		return live2ddriver.PriorityEmotion
+	}
+	return a.config.DefaultPriority
+}
+
+// rejectMotion returns why the motion loses, or "" if it wins.
+func (a *arbiter) rejectMotion(s *arbiterState, now time.Time, motion string, priority live2ddriver.Priority) string {
+	if priority != live2ddriver.PriorityManual {
+		cooldown, ok := a.config.Cooldowns[motion]
+		if !ok {
+			cooldown = a.config.Cooldown
+		}
+		if last, ok := s.played[motion]; ok && now.Sub(last) < cooldown {
+			return fmt.Sprintf("cooling down (played %v ago, cooldown %v)", now.Sub(last), cooldown)
+		}
+	}
+
+	return a.outranked(s.motion, now, priority, a.config.MotionHold)
+}
+
+// outranked returns why the current one holds against the priority, or ""
+// if it doesn't.
+func (a *arbiter) outranked(current arbitrated, now time.Time, priority live2ddriver.Priority, hold time.Duration) string {
+	if current.name == "" || priorityRank(priority) >= priorityRank(current.priority) {
+		return ""
+	}
+	if held := now.Sub(current.since); held < hold {
+		return fmt.Sprintf("%s %q held for %v < %v", current.priority, current.name, held, hold)
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package wsforwarder
+
+import (
+	"errors"
+	"live2ddriver/live2ddriver"
+	"testing"
+	"time"
+)
+
+func TestArbiter(t *testing.T) {
+	a := NewArbiter(ArbiterConfig{
+		MotionHold:      2 * time.Second,
+		ExpressionDwell: 5 * time.Second,
+		Cooldowns:       map[string]time.Duration{"shake": 10 * time.Second},
+	})
+
+	start := time.Now()
+	at := func(s float64) FilterContext {
+		return FilterContext{Room: "r", Time: start.Add(time.Duration(s * float64(time.Second)))}
+	}
+	emotion := func(ctx FilterContext) FilterContext {
+		ctx.FromEmotion = true
+		return ctx
+	}
+	idle, manual := live2ddriver.PriorityIdle, live2ddriver.PriorityManual
+
+	testCases := []struct {
+		name     string
+		ctx      FilterContext
+		req      live2ddriver.Live2DRequest
+		want     live2ddriver.Live2DRequest
+		wantKeep bool
+	}{
+		{"Emotion", emotion(at(0)), live2ddriver.Live2DRequest{Motion: "happy", Expression: "smile"},
+			live2ddriver.Live2DRequest{Motion: "happy", Expression: "smile"}, true},
+		{"ChatHeld", at(1), live2ddriver.Live2DRequest{Motion: "talk", Expression: "f01"},
+			live2ddriver.Live2DRequest{}, false},
+		{"ChatMotionAfterHold", at(3), live2ddriver.Live2DRequest{Motion: "talk", Expression: "f01"},
+			live2ddriver.Live2DRequest{Motion: "talk"}, true},
+		{"IdleHeldBySpeak", at(3.5), live2ddriver.Live2DRequest{Motion: "idle", Priority: idle, Speak: &live2ddriver.Speaking{Text: "hi"}},
+			live2ddriver.Live2DRequest{Priority: idle, Speak: &live2ddriver.Speaking{Text: "hi"}}, true},
+		{"ExpressionAfterDwell", at(6), live2ddriver.Live2DRequest{Expression: "f01", Priority: idle},
+			live2ddriver.Live2DRequest{Expression: "f01", Priority: idle}, true},
+		{"Manual", at(6.5), live2ddriver.Live2DRequest{Motion: "shake", Priority: manual},
+			live2ddriver.Live2DRequest{Motion: "shake", Priority: manual}, true},
+		{"CoolingDown", emotion(at(10)), live2ddriver.Live2DRequest{Motion: "shake"},
+			live2ddriver.Live2DRequest{}, false},
+		{"ManualIgnoresCooldown", at(11), live2ddriver.Live2DRequest{Motion: "shake", Priority: manual},
+			live2ddriver.Live2DRequest{Motion: "shake", Priority: manual}, true},
+		{"NoMotion", at(11.5), live2ddriver.Live2DRequest{ID: "1"},
+			live2ddriver.Live2DRequest{ID: "1"}, true},
+		{"ModelResets", at(12), live2ddriver.Live2DRequest{Model: "haru", Motion: "idle", Priority: idle},
+			live2ddriver.Live2DRequest{Model: "haru", Motion: "idle", Priority: idle}, true},
+	}
+
+	for _, tc := range testCases {
+		got, keep := a.Filter(tc.ctx, tc.req)
+		if keep != tc.wantKeep || (keep && (got.Motion != tc.want.Motion || got.Expression != tc.want.Expression || got.Model != tc.want.Model)) {
+			t.Errorf("%s: Filter(%+v) = %+v, %v, want %+v, %v", tc.name, tc.req, got, keep, tc.want, tc.wantKeep)
+		}
+	}
+
+	// rooms are independent
+	if got, keep := a.Filter(FilterContext{Room: "other", Time: start.Add(time.Second)}, live2ddriver.Live2DRequest{Motion: "talk"}); !keep || got.Motion != "talk" {
+		t.Errorf("Filter(other room) = %+v, %v, want the motion", got, keep)
+	}
+}
+
+func TestArbiterConfig_Validate(t *testing.T) {
+	for _, c := range []ArbiterConfig{
+		{DefaultPriority: "urgent"},
+		{MotionHold: -time.Second},
+		{Cooldowns: map[string]time.Duration{"shake": -time.Second}},
+	} {
+		if err := c.Validate(); !errors.Is(err, ErrInvalidArbiterConfig) {
+			t.Errorf("Validate(%+v) = %v, want ErrInvalidArbiterConfig", c, err)
+		}
+	}
+}
+
+func TestMessageForwarder_priority(t *testing.T) {
+	f := NewMessageForwarder(WithFilters(NewArbiter(ArbiterConfig{MotionHold: time.Minute})))
+	dial := serveForwarder(t, f)
+
+	ws := dial("?since=0")
+	waitClients(t, f, 1)
+
+	f.SendMessage([]byte(`{"motion": "wave", "priority": "manual"}`))
+	f.SendMessage([]byte(`{"motion": "idle", "priority": "idle"}`)) // held
+	f.SendMessage([]byte(`{"motion": "bow", "priority": "manual"}`))
+	// the motions of the speech are held as well, until the cues after the hold
+	f.SendMessage([]byte(`{"speak": {"text": "hi", "motion": "talk", "expression": "f01", "timeline": [` +
+		`{"t": 0, "text": "hi", "motion": "talk"}, {"t": 120, "text": "bye", "motion": "bye"}]}}`))
+
+	for _, want := range []string{
+		`{"seq":1,"motion":"wave"}`,
+		`{"seq":2,"motion":"bow"}`,
+		`{"seq":3,"speak":{"text":"hi","expression":"f01","timeline":[{"t":0,"text":"hi"},{"t":120,"text":"bye","motion":"bye"}]}}`,
+	} {
+		if got := receive(t, ws); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
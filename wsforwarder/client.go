@@ -0,0 +1,403 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cdfmlr/ellipsis"
+	"golang.org/x/net/websocket"
+)
+
+// OverflowPolicy is what to do with a message when the send queue of a
+// client is full.
+type OverflowPolicy = string
+
+const (
+	// DropOldest drops the oldest queued message to make room for the new one.
+	DropOldest OverflowPolicy = "dropOldest"
+	// DropNewest drops the new message.
+	DropNewest OverflowPolicy = "dropNewest"
+	// Coalesce merges the queued Live2DRequests and the new one into a
+	// single request (fields of later ones win). Falls back to DropOldest
+	// if any of them is not a JSON object.
+	Coalesce OverflowPolicy = "coalesce"
+	// Disconnect disconnects the client.
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// ValidOverflowPolicy reports whether p is a known OverflowPolicy.
+func ValidOverflowPolicy(p OverflowPolicy) bool {
+	switch p {
+	case DropOldest, DropNewest, Coalesce, Disconnect:
+		return true
+	}
+	return false
+}
+
+// outMsg is a message in the send queue.
+type outMsg struct {
+	data []byte
+	dlvs []*Delivery // deliveries to report to, if tracked
+}
+
+// client is a connected Live2DView with its own send queue.
+//
+// Messages are enqueued by the forwarder without blocking (or blocking
+// at most the send timeout), and written to the websocket connection by
+// the writer goroutine of the client (client.forward).
+type client struct {
+	ws *websocket.Conn
+
+	// metadata, see ClientInfo
+	id          string
+	room        string
+	userAgent   string
+	connectedAt time.Time
+
+	queue    []outMsg
+	queueCap int
+	policy   OverflowPolicy
+	mu       sync.Mutex // to protect queue
+
+	notify chan struct{} // message enqueued
+	space  chan struct{} // message dequeued
+	done   chan struct{} // closed when the client is gone
+
+	heartbeat heartbeat
+
+	sub atomic.Pointer[subscription]
+
+	closeOnce sync.Once
+
+	// counters
+	sent      atomic.Uint64
+	bytesSent atomic.Uint64
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+
+	lastErr struct {
+		err  string
+		time time.Time
+		mu   sync.Mutex
+	}
+}
+
+func newClient(ws *websocket.Conn, queueCap int, policy OverflowPolicy) *client {
+	if queueCap < 1 {
+		queueCap = 1
+	}
+	c := &client{
+		ws:          ws,
+		connectedAt: time.Now(),
+		queue:       make([]outMsg, 0, queueCap),
+		queueCap:    queueCap,
+		policy:      policy,
+		notify:      make(chan struct{}, 1),
+		space:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	c.subscribe(Subscription{})
+	if r := ws.Request(); r != nil {
+		c.userAgent = r.UserAgent()
+		c.subscribe(subscriptionFromQuery(r.URL.Query()))
+	}
+	return c
+}
+
+var (
+	// errClientGone is returned by enqueue if the client is closed.
+	errClientGone = errors.New("client gone")
+	// errSlowClient is returned by enqueue if the client is disconnected
+	// by the Disconnect policy.
+	errSlowClient = errors.New("client disconnected: send queue full")
+)
+
+// enqueue the msg into the send queue.
+//
+// If the queue is full, wait at most timeout for the writer to make room,
+// then apply the OverflowPolicy. Returns errClientGone if the client is
+// closed, or errSlowClient if it's disconnected by the policy.
+func (c *client) enqueue(msg outMsg, timeout time.Duration) error {
+	var deadline <-chan time.Time
+
+	for {
+		select {
+		case <-c.done:
+			return errClientGone
+		default:
+		}
+
+		c.mu.Lock()
+		if len(c.queue) < c.queueCap {
+			c.queue = append(c.queue, msg)
+			c.mu.Unlock()
+			c.signal(c.notify)
+			return nil
+		}
+		c.mu.Unlock()
+
+		if timeout <= 0 {
+			break
+		}
+		if deadline == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+
+		select {
+		case <-c.space:
+			continue
+		case <-c.done:
+			return errClientGone
+		case <-deadline:
+		}
+		break
+	}
+
+	return c.overflow(msg)
+}
+
+// preload msgs (e.g. the state replay) into the send queue, regardless of
+// the queue capacity. Must be called before the client is registered to
+// receive live messages.
+func (c *client) preload(msgs [][]byte) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	for _, msg := range msgs {
+		c.queue = append(c.queue, outMsg{data: msg})
+	}
+	c.mu.Unlock()
+
+	c.signal(c.notify)
+}
+
+// overflow applies the OverflowPolicy to msg with the queue full.
+func (c *client) overflow(msg outMsg) error {
+	c.mu.Lock()
+
+	// the writer may have made room since enqueue released the lock
+	if len(c.queue) < c.queueCap {
+		c.queue = append(c.queue, msg)
+		c.mu.Unlock()
+		c.signal(c.notify)
+		return nil
+	}
+
+	policy := c.policy
+	if policy == Coalesce {
+		if merged, ok := coalesce(append(c.queue, msg)); ok {
+			c.coalesced.Add(uint64(len(c.queue)))
+			c.queue = append(c.queue[:0], merged)
+			c.mu.Unlock()
+			c.signal(c.notify)
+			return nil
+		}
+		policy = DropOldest
+	}
+
+	var dropped outMsg
+
+	switch policy {
+	case DropNewest:
+		c.mu.Unlock()
+		dropped = msg
+	case Disconnect:
+		c.mu.Unlock()
+		log.Printf("WARN client %s: send queue full, disconnect.", c.ws.RemoteAddr())
+		c.setError(errSlowClient)
+		c.close()
+		return errSlowClient
+	default: // DropOldest
+		dropped = c.queue[0]
+		copy(c.queue, c.queue[1:])
+		c.queue[len(c.queue)-1] = msg
+		c.mu.Unlock()
+		c.signal(c.notify)
+	}
+
+	for _, d := range dropped.dlvs {
+		d.fail(c, "dropped: send queue full")
+	}
+
+	c.setError(fmt.Errorf("send queue full (%s): message dropped", policy))
+	if n := c.dropped.Add(1); n == 1 || n%100 == 0 {
+		log.Printf("WARN client %s: send queue full (%s), %d message(s) dropped so far.", c.ws.RemoteAddr(), policy, n)
+	}
+	return nil
+}
+
+// coalesce merges JSON objects into one: fields of later ones win.
+// The merged message reports to the deliveries of all msgs.
+// Returns false if any of msgs is not a JSON object.
+func coalesce(msgs []outMsg) (outMsg, bool) {
+	merged := map[string]json.RawMessage{}
+	var dlvs []*Delivery
+	for _, msg := range msgs {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(msg.data, &fields); err != nil || fields == nil {
+			return outMsg{}, false
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+		dlvs = append(dlvs, msg.dlvs...)
+	}
+
+	j, err := json.Marshal(merged)
+	if err != nil {
+		return outMsg{}, false
+	}
+	return outMsg{data: j, dlvs: dlvs}, true
+}
+
+// dequeue the oldest message in the send queue.
+func (c *client) dequeue() (outMsg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.queue) == 0 {
+		return outMsg{}, false
+	}
+	msg := c.queue[0]
+	c.queue[0] = outMsg{}
+	c.queue = c.queue[1:]
+	if len(c.queue) == 0 {
+		c.queue = make([]outMsg, 0, c.queueCap)
+	}
+
+	c.signal(c.space)
+	return msg, true
+}
+
+// signal ch without blocking.
+func (c *client) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// forward messages in the send queue to the websocket connection,
+// and ping the client periodically.
+//
+// Block until the client is closed, or it's evicted: a write fails or
+// the client is idle for too long.
+func (c *client) forward() {
+	defer c.close()
+
+	var ping <-chan time.Time
+	if c.heartbeat.pingInterval > 0 {
+		ticker := time.NewTicker(c.heartbeat.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.notify:
+		case <-ping:
+			if err := c.ping(); err != nil {
+				c.evict(fmt.Errorf("ping: %w", err))
+				return
+			}
+			continue
+		case <-c.done:
+			return
+		}
+
+		for {
+			msg, ok := c.dequeue()
+			if !ok {
+				break
+			}
+
+			verboseLogf("INFO fwd msg: %s -> %s.", ellipsis.Centering(string(msg.data), 80), c.ws.RemoteAddr())
+			if err := c.write(msg.data); err != nil {
+				for _, d := range msg.dlvs {
+					d.fail(c, err.Error())
+				}
+				c.evict(fmt.Errorf("write: %w", err))
+				return
+			}
+			c.sent.Add(1)
+			c.bytesSent.Add(uint64(len(msg.data)))
+			for _, d := range msg.dlvs {
+				d.delivered(c)
+			}
+		}
+	}
+}
+
+// MaxViewMessageSize is the max size of messages received from Live2DViews.
+const MaxViewMessageSize = 64 << 10
+
+// receive messages from the websocket connection, and handle them.
+//
+// Block until the client is closed or a read fails (e.g. the view closed
+// the connection).
+func (c *client) receive(handle func(msg []byte)) {
+	defer c.close()
+
+	c.ws.MaxPayloadBytes = MaxViewMessageSize
+
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(c.ws, &msg); err != nil {
+			if err != io.EOF {
+				c.setError(fmt.Errorf("receive: %w", err))
+				verboseLogf("ERROR recv msg from %s error: %s.", c.ws.RemoteAddr(), err)
+			}
+			return
+		}
+		handle(msg)
+	}
+}
+
+// evict the dead client: log the reason and close it.
+// Nothing is logged if the client is already closed.
+func (c *client) evict(reason error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	log.Printf("WARN evict client %s: %v.", c.addr(), reason)
+	c.setError(reason)
+	c.close()
+}
+
+// setError records the last error of the client.
+func (c *client) setError(err error) {
+	c.lastErr.mu.Lock()
+	defer c.lastErr.mu.Unlock()
+
+	c.lastErr.err = err.Error()
+	c.lastErr.time = time.Now()
+}
+
+// addr is the remote address of the Live2DView.
+func (c *client) addr() string {
+	if r := c.ws.Request(); r != nil {
+		return r.RemoteAddr
+	}
+	return c.ws.RemoteAddr().String()
+}
+
+// close the client and its websocket connection. Idempotent.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.ws.Close()
+	})
+}
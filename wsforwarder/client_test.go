@@ -0,0 +1,135 @@
+package wsforwarder
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// newTestConn returns the server side of a websocket connection.
+// The connection is closed at the end of the test.
+func newTestConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	conns := make(chan *websocket.Conn)
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		conns <- ws
+		<-release
+	}))
+
+	client, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		close(release)
+		srv.Close()
+	})
+
+	return <-conns
+}
+
+func queued(c *client) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var msgs []string
+	for _, msg := range c.queue {
+		msgs = append(msgs, string(msg.data))
+	}
+	return msgs
+}
+
+func TestClient_enqueue(t *testing.T) {
+	testCases := []struct {
+		policy      OverflowPolicy
+		msgs        []string
+		want        []string
+		wantDropped uint64
+	}{
+		{DropOldest, []string{"1", "2", "3"}, []string{"2", "3"}, 1},
+		{DropNewest, []string{"1", "2", "3"}, []string{"1", "2"}, 1},
+		{Coalesce, []string{`{"model":"a"}`, `{"motion":"m1"}`, `{"motion":"m2"}`}, []string{`{"model":"a","motion":"m2"}`}, 0},
+		{Coalesce, []string{"1", "2", "3"}, []string{"2", "3"}, 1}, // not JSON objects: fallback to DropOldest
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			c := newClient(newTestConn(t), 2, tc.policy)
+
+			for _, msg := range tc.msgs {
+				if err := c.enqueue(outMsg{data: []byte(msg)}, 0); err != nil {
+					t.Fatalf("enqueue(%s) error: %v", msg, err)
+				}
+			}
+
+			if got := queued(c); strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("queue = %v, want %v", got, tc.want)
+			}
+			if got := c.dropped.Load(); got != tc.wantDropped {
+				t.Errorf("dropped = %v, want %v", got, tc.wantDropped)
+			}
+		})
+	}
+
+	t.Run(Disconnect, func(t *testing.T) {
+		c := newClient(newTestConn(t), 1, Disconnect)
+
+		if err := c.enqueue(outMsg{data: []byte("1")}, 0); err != nil {
+			t.Fatalf("enqueue error: %v", err)
+		}
+		if err := c.enqueue(outMsg{data: []byte("2")}, 0); err != errSlowClient {
+			t.Errorf("enqueue error = %v, want errSlowClient", err)
+		}
+
+		select {
+		case <-c.done:
+		default:
+			t.Errorf("client not closed")
+		}
+	})
+
+	t.Run("DrainedBeforeOverflow", func(t *testing.T) {
+		// the writer empties the queue between enqueue & overflow
+		for _, policy := range []OverflowPolicy{DropOldest, DropNewest, Coalesce, Disconnect} {
+			c := newClient(newTestConn(t), 1, policy)
+
+			if err := c.overflow(outMsg{data: []byte("1")}); err != nil {
+				t.Fatalf("%s: overflow error: %v", policy, err)
+			}
+			if got := queued(c); len(got) != 1 || got[0] != "1" || c.dropped.Load() != 0 {
+				t.Errorf("%s: queue = %v, dropped %d, want [1] without dropping", policy, got, c.dropped.Load())
+			}
+		}
+	})
+
+	t.Run("SendTimeout", func(t *testing.T) {
+		c := newClient(newTestConn(t), 1, DropNewest)
+
+		if err := c.enqueue(outMsg{data: []byte("1")}, 0); err != nil {
+			t.Fatalf("enqueue error: %v", err)
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			c.dequeue()
+		}()
+
+		if err := c.enqueue(outMsg{data: []byte("2")}, time.Second); err != nil {
+			t.Fatalf("enqueue error: %v", err)
+		}
+		if got := queued(c); len(got) != 1 || got[0] != "2" {
+			t.Errorf("queue = %v, want [2]", got)
+		}
+		if got := c.dropped.Load(); got != 0 {
+			t.Errorf("dropped = %v, want 0", got)
+		}
+	})
+}
@@ -0,0 +1,307 @@
+package wsforwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"live2ddriver/live2ddriver"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WaitMode is what SendMessageTracked waits for from each client.
+type WaitMode = string
+
+const (
+	// WaitDelivered waits until the message is written to the connection.
+	WaitDelivered WaitMode = "delivered"
+	// WaitAcked waits until the view acknowledges the message by the
+	// request ID: {"event": "ack", "id": "<request id>"}.
+	WaitAcked WaitMode = "acked"
+)
+
+var (
+	// ErrNoClients is returned by SendMessageTracked if no view would get
+	// the message: none is connected, or none subscribes to it. The message
+	// is not forwarded, leaving the state & history as they are.
+	ErrNoClients = errors.New("no Live2DView connected")
+	// ErrNothingToForward is returned by SendMessageTracked if the message
+	// is dropped before forwarding (e.g. empty after driving).
+	ErrNothingToForward = errors.New("nothing to forward")
+)
+
+// DeliveryResult is the delivery of a message to a client.
+type DeliveryResult struct {
+	Client    string `json:"client"`
+	Delivered bool   `json:"delivered"`       // written to the connection
+	Acked     bool   `json:"acked"`           // acknowledged by the view
+	Error     string `json:"error,omitempty"` // failed: dropped, disconnected, ...
+}
+
+// DeliveryReport is the delivery of a message to all clients.
+type DeliveryReport struct {
+	ID       string           `json:"id,omitempty"`
+	Wait     WaitMode         `json:"wait"`
+	Complete bool             `json:"complete"` // every client either reached the Wait state or failed
+	Clients  []DeliveryResult `json:"clients"`
+}
+
+// OK reports whether every client reached the Wait state.
+func (r DeliveryReport) OK() bool {
+	if !r.Complete {
+		return false
+	}
+	for _, c := range r.Clients {
+		if c.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Delivery tracks the delivery of a message to the clients connected when
+// it was sent.
+type Delivery struct {
+	id   string
+	wait WaitMode
+
+	clients []*client // in the order of connection
+	results map[*client]*DeliveryResult
+	pending int
+	mu      sync.Mutex // to protect results & pending
+
+	done   chan struct{} // closed when nothing is pending
+	onDone func()
+}
+
+func newDelivery(id string, wait WaitMode, clients []*client, onDone func()) *Delivery {
+	d := &Delivery{
+		id:      id,
+		wait:    wait,
+		clients: append([]*client{}, clients...),
+		results: make(map[*client]*DeliveryResult, len(clients)),
+		pending: len(clients),
+		done:    make(chan struct{}),
+		onDone:  onDone,
+	}
+	for _, c := range clients {
+		d.results[c] = &DeliveryResult{Client: c.addr()}
+	}
+	if d.pending == 0 {
+		d.finish()
+	}
+	return d
+}
+
+// settled reports whether r is final: reached the wait state or failed.
+func (d *Delivery) settled(r *DeliveryResult) bool {
+	return r.Error != "" || r.Acked || (d.wait == WaitDelivered && r.Delivered)
+}
+
+// update the result of the client by fn.
+func (d *Delivery) update(c *client, fn func(r *DeliveryResult)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.results[c]
+	if !ok || d.settled(r) {
+		return
+	}
+
+	fn(r)
+
+	if d.settled(r) {
+		d.pending--
+		if d.pending == 0 {
+			d.finish()
+		}
+	}
+}
+
+func (d *Delivery) finish() {
+	close(d.done)
+	if d.onDone != nil {
+		d.onDone()
+	}
+}
+
+func (d *Delivery) delivered(c *client) {
+	d.update(c, func(r *DeliveryResult) { r.Delivered = true })
+}
+
+func (d *Delivery) acked(c *client) {
+	d.update(c, func(r *DeliveryResult) { r.Delivered, r.Acked = true, true })
+}
+
+func (d *Delivery) fail(c *client, reason string) {
+	d.update(c, func(r *DeliveryResult) { r.Error = reason })
+}
+
+// Done is closed when every client either reached the wait state or failed.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Report returns the current DeliveryReport.
+func (d *Delivery) Report() DeliveryReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := DeliveryReport{
+		ID:       d.id,
+		Wait:     d.wait,
+		Complete: d.pending == 0,
+		Clients:  make([]DeliveryResult, 0, len(d.clients)),
+	}
+	for _, c := range d.clients {
+		report.Clients = append(report.Clients, *d.results[c])
+	}
+	return report
+}
+
+// Wait until Done or ctx is done, and returns the DeliveryReport.
+func (d *Delivery) Wait(ctx context.Context) DeliveryReport {
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+	}
+	return d.Report()
+}
+
+// SendMessageTracked sends msg like SendMessage, and tracks its delivery to
+// every connected client. The id is the request ID in msg, which views
+// acknowledge with (WaitAcked).
+//
+// If no view would get the message (none connected, or none subscribing to
+// it), nothing is forwarded and ErrNoClients is returned.
+func (f *messageForwarder) SendMessageTracked(msg []byte, id string, wait WaitMode) (*Delivery, error) {
+	return f.send(msg, id, wait, SourceSend)
+}
+
+// track the Delivery until it's done, so that acks & disconnections are
+// reported to it.
+func (f *messageForwarder) track(id string, wait WaitMode, clients []*client) *Delivery {
+	var d *Delivery
+	d = newDelivery(id, wait, clients, func() {
+		f.deliveriesMu.Lock()
+		delete(f.deliveries, d)
+		f.deliveriesMu.Unlock()
+	})
+
+	f.deliveriesMu.Lock()
+	select {
+	case <-d.done:
+	default:
+		f.deliveries[d] = struct{}{}
+	}
+	f.deliveriesMu.Unlock()
+
+	return d
+}
+
+// untrack the Delivery, e.g. the waiting has timed out.
+func (f *messageForwarder) untrack(d *Delivery) {
+	f.deliveriesMu.Lock()
+	delete(f.deliveries, d)
+	f.deliveriesMu.Unlock()
+}
+
+// eachDelivery calls fn for every tracked Delivery.
+func (f *messageForwarder) eachDelivery(fn func(d *Delivery)) {
+	f.deliveriesMu.Lock()
+	deliveries := make([]*Delivery, 0, len(f.deliveries))
+	for d := range f.deliveries {
+		deliveries = append(deliveries, d)
+	}
+	f.deliveriesMu.Unlock()
+
+	for _, d := range deliveries {
+		fn(d)
+	}
+}
+
+// ack the tracked deliveries of the request ID to the client.
+func (f *messageForwarder) ack(c *client, id string) {
+	f.eachDelivery(func(d *Delivery) {
+		if d.id == id {
+			d.acked(c)
+		}
+	})
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// DefaultWaitTimeout is the default timeout of /live2d?wait=...
+const DefaultWaitTimeout = 5 * time.Second
+
+// sendAndWait sends the request and responds the DeliveryReport:
+//
+//	/live2d?wait=delivered|acked&timeout=5s
+//
+// Responds 200 if every view reached the wait state, 502 if any failed,
+// 504 on timeout, and 503 if no view would get it. A speak request queued
+// behind the speech in progress is not waited: 202 is responded.
+func (f *messageForwarder) sendAndWait(c *gin.Context, req live2ddriver.Live2DRequest, wait WaitMode) {
+	if wait != WaitDelivered && wait != WaitAcked {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown wait %q: want %q or %q", wait, WaitDelivered, WaitAcked)})
+		return
+	}
+
+	timeout := DefaultWaitTimeout
+	if t := c.Query("timeout"); t != "" {
+		var err error
+		if timeout, err = time.ParseDuration(t); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.ID == "" {
+		req.ID = newRequestID()
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	d, err := f.send(j, req.ID, wait, SourceHTTP)
+	switch {
+	case errors.Is(err, ErrNoClients):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"id": req.ID, "error": err.Error()})
+		return
+	case errors.Is(err, ErrSpeechQueued):
+		c.JSON(http.StatusAccepted, gin.H{"id": req.ID, "queued": true})
+		return
+	case err != nil:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"id": req.ID, "error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	report := d.Wait(ctx)
+	f.untrack(d)
+
+	switch {
+	case report.OK():
+		c.JSON(http.StatusOK, report)
+	case report.Complete:
+		c.JSON(http.StatusBadGateway, report)
+	default:
+		c.JSON(http.StatusGatewayTimeout, report)
+	}
+}
@@ -0,0 +1,99 @@
+package wsforwarder
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// waitClients waits until n clients are connected to f.
+func waitClients(t *testing.T, f *messageForwarder, n int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if f.Stats().Clients == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("want %d client(s) connected, got %d", n, f.Stats().Clients)
+}
+
+func TestMessageForwarder_SendMessageTracked(t *testing.T) {
+	f := NewMessageForwarder()
+	dial := serveForwarder(t, f)
+
+	t.Run("NoClients", func(t *testing.T) {
+		_, err := f.SendMessageTracked([]byte(`{"id":"1","model":"a.model.json"}`), "1", WaitDelivered)
+		if !errors.Is(err, ErrNoClients) {
+			t.Errorf("SendMessageTracked() error = %v, want ErrNoClients", err)
+		}
+
+		// not subscribing to it is the same
+		dial("?fields=speak")
+		waitClients(t, f, 1)
+		_, err = f.SendMessageTracked([]byte(`{"id":"1","model":"a.model.json"}`), "1", WaitDelivered)
+		if !errors.Is(err, ErrNoClients) {
+			t.Errorf("SendMessageTracked(unsubscribed) error = %v, want ErrNoClients", err)
+		}
+
+		// rejected without a trace
+		r, _ := f.room("")
+		if r.history.seq != 0 || len(r.state.snapshot()) != 0 {
+			t.Errorf("history seq %d, state %q, want untouched", r.history.seq, r.state.snapshot())
+		}
+	})
+
+	ws := dial("?since=0")
+	waitClients(t, f, 2)
+
+	wait := func(d *Delivery, timeout time.Duration) DeliveryReport {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return d.Wait(ctx)
+	}
+
+	t.Run("Delivered", func(t *testing.T) {
+		d, err := f.SendMessageTracked([]byte(`{"id":"2","motion":"shake"}`), "2", WaitDelivered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, ws)
+
+		if report := wait(d, time.Second); !report.OK() || !report.Clients[0].Delivered {
+			t.Errorf("report = %+v, want delivered", report)
+		}
+	})
+
+	t.Run("Acked", func(t *testing.T) {
+		d, err := f.SendMessageTracked([]byte(`{"id":"3","motion":"shake"}`), "3", WaitAcked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, ws)
+
+		if err := websocket.Message.Send(ws, `{"event":"ack","id":"3"}`); err != nil {
+			t.Fatal(err)
+		}
+
+		if report := wait(d, time.Second); !report.OK() || !report.Clients[0].Acked {
+			t.Errorf("report = %+v, want acked", report)
+		}
+	})
+
+	t.Run("AckTimeout", func(t *testing.T) {
+		d, err := f.SendMessageTracked([]byte(`{"id":"4","motion":"shake"}`), "4", WaitAcked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, ws)
+
+		report := wait(d, 100*time.Millisecond)
+		if report.Complete || !report.Clients[0].Delivered || report.Clients[0].Acked {
+			t.Errorf("report = %+v, want delivered but not acked", report)
+		}
+	})
+}
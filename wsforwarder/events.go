@@ -0,0 +1,184 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/ellipsis"
+	"github.com/gin-gonic/gin"
+)
+
+// ViewEventType is the type of ViewEvents.
+type ViewEventType = string
+
+const (
+	// reported by Live2DViews
+
+	EventModelLoaded    ViewEventType = "modelLoaded"    // model: the model src
+	EventMotionFinished ViewEventType = "motionFinished" // motion: the motion group
+	EventSpeakFinished  ViewEventType = "speakFinished"  // audio playback ended. audio: the audio src
+	EventError          ViewEventType = "error"          // error: the error message
+	EventAck            ViewEventType = "ack"            // the request is done. id: the request ID
+
+	// generated by the forwarder
+
+	EventConnected    ViewEventType = "connected"    // a Live2DView connected
+	EventDisconnected ViewEventType = "disconnected" // a Live2DView disconnected
+)
+
+// ViewEvent is an event reported by a Live2DView, i.e. the messages that
+// Live2DViews send back via the websocket connection:
+//
+//	{"event": "motionFinished", "motion": "tap_body"}
+//
+// Event types other than the known ViewEventTypes are passed through as
+// they are, with the unknown fields dropped.
+type ViewEvent struct {
+	Type ViewEventType `json:"event"`
+
+	Model  string `json:"model,omitempty"`  // modelLoaded
+	Motion string `json:"motion,omitempty"` // motionFinished
+	Audio  string `json:"audio,omitempty"`  // speakFinished
+	Error  string `json:"error,omitempty"`  // error
+	ID     string `json:"id,omitempty"`     // ack
+
+	// filled by the forwarder
+
+	Client   string    `json:"client,omitempty"`   // the Live2DView reporting the event
+	ClientID string    `json:"clientId,omitempty"` // id of the Live2DView, see ClientInfo
+	Room     string    `json:"room,omitempty"`     // room of the Live2DView
+	Time     time.Time `json:"time"`               // when the forwarder received the event
+}
+
+// EventBufferSize is the default buffer size of event subscriptions.
+const EventBufferSize = 16
+
+// eventBus dispatches ViewEvents to subscribers.
+//
+// Publishing never blocks: events are dropped for subscribers that are not
+// keeping up.
+type eventBus struct {
+	subscribers map[chan ViewEvent]struct{}
+	mu          sync.RWMutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[chan ViewEvent]struct{}{}}
+}
+
+func (b *eventBus) subscribe(buffer int) (<-chan ViewEvent, func()) {
+	ch := make(chan ViewEvent, buffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+func (b *eventBus) publish(ev ViewEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			verboseLogf("WARN event subscriber is not keeping up, drop event %s from %s.", ev.Type, ev.Client)
+		}
+	}
+}
+
+// Subscribe to the ViewEvents from all connected Live2DViews.
+//
+// Events are dropped if the returned channel is not drained in time.
+// Call cancel to unsubscribe, the channel is closed then.
+func (f *messageForwarder) Subscribe() (events <-chan ViewEvent, cancel func()) {
+	return f.events.subscribe(EventBufferSize)
+}
+
+// handleViewMessage handles a message received from the client: a
+// subscription control message (see Subscription), or a ViewEvent.
+func (f *messageForwarder) handleViewMessage(c *client, msg []byte) {
+	var ctrl struct {
+		Subscribe *Subscription `json:"subscribe"`
+	}
+	if err := json.Unmarshal(msg, &ctrl); err == nil && ctrl.Subscribe != nil {
+		verboseLogf("INFO client %s subscribes: %+v.", c.id, *ctrl.Subscribe)
+		c.subscribe(*ctrl.Subscribe)
+		return
+	}
+
+	var ev ViewEvent
+	if err := json.Unmarshal(msg, &ev); err != nil || ev.Type == "" {
+		log.Printf("WARN unknown message from %s: %s", c.ws.RemoteAddr(), ellipsis.Centering(string(msg), 80))
+		return
+	}
+
+	verboseLogf("INFO view event: %s <- %s.", ellipsis.Centering(string(msg), 80), c.ws.RemoteAddr())
+	f.recordView(c, msg)
+
+	if ev.Type == EventAck && ev.ID != "" {
+		f.ack(c, ev.ID)
+	}
+
+	f.publishEvent(c, ev)
+	f.handleSpeechEvent(c, ev)
+}
+
+// publishEvent fills the forwarder fields of ev and publishes it.
+func (f *messageForwarder) publishEvent(c *client, ev ViewEvent) {
+	ev.Client = c.addr()
+	ev.ClientID = c.id
+	ev.Room = c.room
+	ev.Time = time.Now()
+	f.events.publish(ev)
+	f.forwardEvent(c, ev)
+}
+
+// serveEvents streams ViewEvents as Server-Sent Events:
+//
+//	GET /events?event=motionFinished,speakFinished&room=main
+//
+// The event & room queries are optional to filter the event types & room.
+func (f *messageForwarder) serveEvents(c *gin.Context) {
+	var types map[string]bool
+	if q := c.Query("event"); q != "" {
+		types = map[string]bool{}
+		for _, t := range strings.Split(q, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	room := c.Query("room")
+
+	events, cancel := f.Subscribe()
+	defer cancel()
+
+	c.Status(http.StatusOK)
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev := <-events:
+			if (types == nil || types[ev.Type]) && (room == "" || ev.Room == room) {
+				c.SSEvent(ev.Type, ev)
+			}
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
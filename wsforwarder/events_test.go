@@ -0,0 +1,53 @@
+package wsforwarder
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// nextEvent receives the next event of the type, or fail the test after
+// a second.
+func nextEvent(t *testing.T, events <-chan ViewEvent, typ ViewEventType) ViewEvent {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event in 1s", typ)
+		}
+	}
+}
+
+func TestMessageForwarder_Subscribe(t *testing.T) {
+	f := NewMessageForwarder()
+	dial := serveForwarder(t, f)
+
+	events, cancel := f.Subscribe()
+	defer cancel()
+
+	ws := dial("")
+	connected := nextEvent(t, events, EventConnected)
+	if connected.Client == "" {
+		t.Errorf("connected event without client: %+v", connected)
+	}
+
+	if err := websocket.Message.Send(ws, `{"event":"motionFinished","motion":"tap_body"}`); err != nil {
+		t.Fatal(err)
+	}
+	ev := nextEvent(t, events, EventMotionFinished)
+	if ev.Motion != "tap_body" || ev.Client != connected.Client {
+		t.Errorf("got event %+v, want motionFinished tap_body from %s", ev, connected.Client)
+	}
+
+	ws.Close()
+	if ev := nextEvent(t, events, EventDisconnected); ev.Client != connected.Client {
+		t.Errorf("got event %+v, want disconnected from %s", ev, connected.Client)
+	}
+}
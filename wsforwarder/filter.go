@@ -0,0 +1,273 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"live2ddriver/live2ddriver"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cdfmlr/ellipsis"
+)
+
+// FilterContext is what a Filter knows about a message besides itself.
+type FilterContext struct {
+	Room        string
+	Model       string    // model src of the room: the one the message switches to, or the current one. Empty if unknown.
+	FromEmotion bool      // the motion & expression of the message are mapped from an emotion
+	Time        time.Time // when the message is sent
+}
+
+// Filter filters or transforms the driven Live2DRequests before they are
+// forwarded. Return false to drop the request.
+//
+// Filters are chained in order. The messages of a room go through the
+// chain one by one, never concurrently, in the order they are forwarded.
+type Filter interface {
+	Filter(ctx FilterContext, req live2ddriver.Live2DRequest) (live2ddriver.Live2DRequest, bool)
+}
+
+// FilterFunc is a function as a Filter.
+type FilterFunc func(ctx FilterContext, req live2ddriver.Live2DRequest) (live2ddriver.Live2DRequest, bool)
+
+func (fn FilterFunc) Filter(ctx FilterContext, req live2ddriver.Live2DRequest) (live2ddriver.Live2DRequest, bool) {
+	return fn(ctx, req)
+}
+
+// WithFilters sets the filters of the messages to forward, in order.
+// Default: DefaultFilters. No filters to disable filtering.
+func WithFilters(filters ...Filter) Option {
+	return func(f *messageForwarder) {
+		f.filters = filters
+	}
+}
+
+// DefaultFilters are the built-in rules: OpenMouthAfterEmoMotion.
+func DefaultFilters() []Filter {
+	return []Filter{NewRuleFilter(OpenMouthAfterEmoMotion)}
+}
+
+// filter the driven message by the filters of the forwarder. raw is the
+// message before driving.
+//
+// Messages that are not Live2DRequests are returned as they are. The
+// priority of Live2DRequests is removed after filtering.
+// Returns nil if the message is dropped.
+func (f *messageForwarder) filter(r *room, raw, msg []byte) []byte {
+	var req live2ddriver.Live2DRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return msg
+	}
+	var before struct {
+		Emotion json.RawMessage `json:"emotion"`
+	}
+	_ = json.Unmarshal(raw, &before)
+
+	ctx := FilterContext{
+		Room:        r.name,
+		Model:       req.Model,
+		FromEmotion: len(before.Emotion) > 0 && string(before.Emotion) != "null",
+		Time:        time.Now(),
+	}
+	if ctx.Model == "" {
+		ctx.Model = r.state.currentModel()
+	}
+
+	filtered := req
+	for _, flt := range f.filters {
+		var keep bool
+		if filtered, keep = flt.Filter(ctx, filtered); !keep {
+			return nil
+		}
+	}
+	filtered.Priority = "" // not forwarded
+
+	if reflect.DeepEqual(filtered, req) {
+		return msg
+	}
+	j, err := json.Marshal(filtered)
+	if err != nil {
+		log.Printf("ERROR filter msg %s: json.Marshal: %v", ellipsis.Centering(string(msg), 80), err)
+		return msg
+	}
+	return j
+}
+
+// region rules
+
+// FilterAction is what a FilterRule does to the messages it matches.
+type FilterAction string
+
+const (
+	Drop  FilterAction = "drop"  // drop the message
+	Strip FilterAction = "strip" // remove the matched fields, and drop the message if nothing left
+)
+
+// Match matches Live2DRequests by their fields. A string field matches if
+// the request has the value, or any non-empty value for "*". Empty or false
+// fields match anything.
+type Match struct {
+	Model      string `json:"model,omitempty" yaml:"model"`
+	Motion     string `json:"motion,omitempty" yaml:"motion"`
+	Expression string `json:"expression,omitempty" yaml:"expression"`
+	Speak      bool   `json:"speak,omitempty" yaml:"speak"`     // a speak request
+	Emotion    bool   `json:"emotion,omitempty" yaml:"emotion"` // the motion & expression are mapped from an emotion
+
+	Exact bool `json:"exact,omitempty" yaml:"exact"` // the request has no other fields (model, motion, expression, speak) than the matched ones
+}
+
+// matches reports whether the request matches.
+func (m Match) matches(ctx FilterContext, req live2ddriver.Live2DRequest) bool {
+	ok := matchField(m.Model, req.Model) &&
+		matchField(m.Motion, req.Motion) &&
+		matchField(m.Expression, req.Expression) &&
+		(!m.Speak || req.Speak != nil) &&
+		(!m.Emotion || ctx.FromEmotion)
+	if !ok || !m.Exact {
+		return ok
+	}
+
+	return (m.Model != "" || req.Model == "") &&
+		(m.Motion != "" || req.Motion == "") &&
+		(m.Expression != "" || req.Expression == "") &&
+		(m.Speak || req.Speak == nil)
+}
+
+func matchField(pattern, value string) bool {
+	switch pattern {
+	case "":
+		return true
+	case "*":
+		return value != ""
+	}
+	return value == pattern
+}
+
+// strip removes the matched fields from the request.
+func (m Match) strip(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+	if m.Model != "" {
+		req.Model = ""
+	}
+	if m.Motion != "" {
+		req.Motion = ""
+	}
+	if m.Expression != "" {
+		req.Expression = ""
+	}
+	if m.Speak {
+		req.Speak = nil
+	}
+	return req
+}
+
+// FilterRule suppresses Live2DRequests matching Match, optionally only
+// Within a time After a request matching After, and only for some Models.
+type FilterRule struct {
+	Name        string
+	Models      []string      // substrings of the model srcs to apply the rule to, e.g. "shizuku". Empty for all models.
+	Match       Match         // the requests to suppress
+	After       *Match        // suppress only Within after a request matching After. nil to suppress always.
+	Within      time.Duration //
+	Immediately bool          // suppress only right After: any other request passed in between ends the Within.
+	Action      FilterAction  // Drop or Strip. Default: Drop.
+}
+
+var ErrInvalidFilterRule = errors.New("invalid filter rule")
+
+// Validate the rule.
+func (rule FilterRule) Validate() error {
+	if rule.Match == (Match{}) {
+		return fmt.Errorf("%w %q: empty match", ErrInvalidFilterRule, rule.Name)
+	}
+	if rule.After != nil && rule.Within <= 0 {
+		return fmt.Errorf("%w %q: after requires a positive within", ErrInvalidFilterRule, rule.Name)
+	}
+	switch rule.Action {
+	case "", Drop, Strip:
+	default:
+		return fmt.Errorf("%w %q: unknown action %q: want %q or %q", ErrInvalidFilterRule, rule.Name, rule.Action, Drop, Strip)
+	}
+	return nil
+}
+
+// OpenMouthAfterEmoMotion is the built-in rule: drop a bare flick_head
+// motion (the "open mouth" of shizuku) within a second right after a motion
+// mapped from an emotion, so that it doesn't override the motion.
+// See https://github.com/cdfmlr/muvtuber/issues/35
+var OpenMouthAfterEmoMotion = FilterRule{
+	Name:        "openMouthAfterEmoMotion",
+	Match:       Match{Motion: "flick_head", Exact: true},
+	After:       &Match{Motion: "*", Emotion: true},
+	Within:      time.Second,
+	Immediately: true,
+	Action:      Drop,
+}
+
+// ruleFilter is the Filter of a FilterRule.
+type ruleFilter struct {
+	rule FilterRule
+
+	lastAfter map[string]time.Time // room => when a request matching After passed (the last request, if Immediately)
+	mu        sync.Mutex
+}
+
+// NewRuleFilter returns the Filter of the rule. The rule should be valid.
+func NewRuleFilter(rule FilterRule) Filter {
+	return &ruleFilter{rule: rule, lastAfter: map[string]time.Time{}}
+}
+
+func (f *ruleFilter) Filter(ctx FilterContext, req live2ddriver.Live2DRequest) (live2ddriver.Live2DRequest, bool) {
+	if !f.appliesTo(ctx.Model) {
+		return req, true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rule.Match.matches(ctx, req) && (f.rule.After == nil || ctx.Time.Sub(f.lastAfter[ctx.Room]) < f.rule.Within) {
+		verboseLogf("INFO filter %q: %s message %+v in room %q.", f.rule.Name, f.action(), req, ctx.Room)
+		if f.action() == Drop {
+			return req, false
+		}
+		if req = f.rule.Match.strip(req); isEmptyRequest(req) {
+			return req, false
+		}
+	}
+
+	if f.rule.After != nil && f.rule.After.matches(ctx, req) {
+		f.lastAfter[ctx.Room] = ctx.Time
+	} else if f.rule.Immediately {
+		delete(f.lastAfter, ctx.Room)
+	}
+	return req, true
+}
+
+func (f *ruleFilter) action() FilterAction {
+	if f.rule.Action == "" {
+		return Drop
+	}
+	return f.rule.Action
+}
+
+func (f *ruleFilter) appliesTo(model string) bool {
+	if len(f.rule.Models) == 0 {
+		return true
+	}
+	for _, m := range f.rule.Models {
+		if m != "" && strings.Contains(model, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyRequest reports whether the request has nothing for views to do.
+func isEmptyRequest(req live2ddriver.Live2DRequest) bool {
+	return req.Model == "" && req.Motion == "" && req.Expression == "" && req.Speak == nil && req.Emotion == nil
+}
+
+// endregion rules
@@ -0,0 +1,178 @@
+package wsforwarder
+
+import (
+	"errors"
+	"fmt"
+	"live2ddriver/live2ddriver"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRuleFilter(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) FilterContext {
+		return FilterContext{Room: "r", Model: "shizuku.model.json", Time: start.Add(time.Duration(ms) * time.Millisecond)}
+	}
+	fromEmotion := func(ctx FilterContext) FilterContext {
+		ctx.FromEmotion = true
+		return ctx
+	}
+
+	type step struct {
+		ctx      FilterContext
+		req      live2ddriver.Live2DRequest
+		want     live2ddriver.Live2DRequest
+		wantKeep bool
+	}
+	testCases := []struct {
+		name  string
+		rule  FilterRule
+		steps []step
+	}{
+		{"OpenMouthAfterEmoMotion", OpenMouthAfterEmoMotion, []step{
+			{at(0), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{Motion: "flick_head"}, true},
+			{fromEmotion(at(100)), live2ddriver.Live2DRequest{Motion: "tap_body"}, live2ddriver.Live2DRequest{Motion: "tap_body"}, true},
+			{at(500), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{}, false},
+			{at(600), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{}, false},
+			// any other message in between ends it
+			{at(700), live2ddriver.Live2DRequest{Expression: "f01"}, live2ddriver.Live2DRequest{Expression: "f01"}, true},
+			{at(800), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{Motion: "flick_head"}, true},
+			{fromEmotion(at(900)), live2ddriver.Live2DRequest{Motion: "shake"}, live2ddriver.Live2DRequest{Motion: "shake"}, true},
+			{at(1000), live2ddriver.Live2DRequest{Motion: "flick_head", Expression: "f01"}, live2ddriver.Live2DRequest{Motion: "flick_head", Expression: "f01"}, true},
+			{at(1100), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{Motion: "flick_head"}, true},
+			// not after manual motions
+			{at(1200), live2ddriver.Live2DRequest{Motion: "tap_body"}, live2ddriver.Live2DRequest{Motion: "tap_body"}, true},
+			{at(1300), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{Motion: "flick_head"}, true},
+			// nor after the second
+			{fromEmotion(at(1400)), live2ddriver.Live2DRequest{Motion: "shake"}, live2ddriver.Live2DRequest{Motion: "shake"}, true},
+			{at(2500), live2ddriver.Live2DRequest{Motion: "flick_head"}, live2ddriver.Live2DRequest{Motion: "flick_head"}, true},
+		}},
+		{"StripAfterEmotion", FilterRule{
+			Match:  Match{Motion: "idle"},
+			After:  &Match{Motion: "*", Emotion: true},
+			Within: 300 * time.Millisecond,
+			Action: Strip,
+		}, []step{
+			{at(0), live2ddriver.Live2DRequest{Motion: "shake"}, live2ddriver.Live2DRequest{Motion: "shake"}, true},
+			{at(100), live2ddriver.Live2DRequest{Motion: "idle", Expression: "f01"}, live2ddriver.Live2DRequest{Motion: "idle", Expression: "f01"}, true},
+			{fromEmotion(at(200)), live2ddriver.Live2DRequest{Motion: "happy"}, live2ddriver.Live2DRequest{Motion: "happy"}, true},
+			{at(300), live2ddriver.Live2DRequest{Motion: "idle", Expression: "f01"}, live2ddriver.Live2DRequest{Expression: "f01"}, true},
+			{at(400), live2ddriver.Live2DRequest{Motion: "idle"}, live2ddriver.Live2DRequest{}, false},
+			{at(600), live2ddriver.Live2DRequest{Motion: "idle"}, live2ddriver.Live2DRequest{Motion: "idle"}, true},
+		}},
+		{"OtherModel", FilterRule{
+			Models: []string{"haru"},
+			Match:  Match{Expression: "*"},
+		}, []step{
+			{at(0), live2ddriver.Live2DRequest{Expression: "f01"}, live2ddriver.Live2DRequest{Expression: "f01"}, true},
+		}},
+		{"Always", FilterRule{
+			Models: []string{"shizuku"},
+			Match:  Match{Speak: true},
+		}, []step{
+			{at(0), live2ddriver.Live2DRequest{Speak: &live2ddriver.Speaking{Text: "hi"}}, live2ddriver.Live2DRequest{}, false},
+			{at(0), live2ddriver.Live2DRequest{Motion: "shake"}, live2ddriver.Live2DRequest{Motion: "shake"}, true},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			f := NewRuleFilter(tc.rule)
+			for i, s := range tc.steps {
+				got, keep := f.Filter(s.ctx, s.req)
+				if keep != s.wantKeep || (keep && got != s.want) {
+					t.Errorf("step %d: Filter(%+v) = %+v, %v, want %+v, %v", i, s.req, got, keep, s.want, s.wantKeep)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterRule_Validate(t *testing.T) {
+	for _, rule := range []FilterRule{
+		{Name: "empty"},
+		{Name: "noWithin", Match: Match{Motion: "a"}, After: &Match{Motion: "*"}},
+		{Name: "badAction", Match: Match{Motion: "a"}, Action: "mute"},
+	} {
+		if err := rule.Validate(); !errors.Is(err, ErrInvalidFilterRule) {
+			t.Errorf("Validate(%s) = %v, want ErrInvalidFilterRule", rule.Name, err)
+		}
+	}
+}
+
+func TestMessageForwarder_filters(t *testing.T) {
+	// the emotion is driven into a motion
+	driver := driverFunc(func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+		if req.Emotion != nil {
+			req.Emotion, req.Motion = nil, "happy"
+		}
+		return req
+	})
+	stripIdle := NewRuleFilter(FilterRule{
+		Match:  Match{Motion: "idle"},
+		After:  &Match{Emotion: true},
+		Within: time.Minute,
+		Action: Strip,
+	})
+	f := NewMessageForwarder(WithDriver(driver), WithFilters(append(DefaultFilters(), stripIdle)...))
+	dial := serveForwarder(t, f)
+
+	ws := dial("?since=0")
+	waitClients(t, f, 1)
+
+	f.SendMessage([]byte(`{"emotion": {"emotions": {"happiness": 1}}}`))
+	f.SendMessage([]byte(`{"motion": "flick_head"}`))                // dropped by the built-in rule
+	f.SendMessage([]byte(`{"motion": "idle", "expression": "f01"}`)) // stripped
+	f.SendMessage([]byte(`hello`))                                   // not a Live2DRequest
+
+	for _, want := range []string{
+		`{"seq":1,"motion":"happy"}`,
+		`{"seq":2,"expression":"f01"}`,
+		`hello`,
+	} {
+		if got := receive(t, ws); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestMessageForwarder_filterOrder(t *testing.T) {
+	// concurrent senders: the filters see the messages one by one, in the
+	// order of forwarding (seq)
+	var filtered []string
+	driver := driverFunc(func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+		time.Sleep(time.Millisecond)
+		return req
+	})
+	recordOrder := FilterFunc(func(ctx FilterContext, req live2ddriver.Live2DRequest) (live2ddriver.Live2DRequest, bool) {
+		filtered = append(filtered, req.Motion) // one by one: no locking
+		time.Sleep(time.Millisecond)
+		return req, true
+	})
+	f := NewMessageForwarder(WithDriver(driver), WithFilters(recordOrder))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f.SendMessage([]byte(fmt.Sprintf(`{"motion":"m%d"}`, i)))
+		}(i)
+	}
+	wg.Wait()
+
+	r, _ := f.room("")
+	forwarded, ok := r.history.since(0)
+	if !ok || len(forwarded) != len(filtered) {
+		t.Fatalf("forwarded %d, filtered %d, want the same", len(forwarded), len(filtered))
+	}
+	for i, msg := range forwarded {
+		if want := fmt.Sprintf(`{"seq":%d,"motion":"%s"}`, i+1, filtered[i]); string(msg) != want {
+			t.Errorf("forwarded %s, want %s in the order of filtering", msg, want)
+		}
+	}
+}
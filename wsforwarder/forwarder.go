@@ -8,113 +8,402 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/cdfmlr/ellipsis"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/net/websocket"
 )
 
-// chan buffer size
+// chan buffer size: the default send queue size of clients
 const BufferSize = 8
 
 // messageForwarder forwards messages to connected clients, that are, Live2DViews.
+//
+// Clients are grouped into rooms: messages are forwarded to the clients of
+// the room they address (DefaultRoom if none).
 type messageForwarder struct {
-	msgChans []chan []byte
-	mu       sync.RWMutex // to protect msgChans
-	lastSend struct {
-		msg  []byte
-		time time.Time
-		mu   sync.Mutex
+	rooms     map[string]*room
+	roomsMu   sync.Mutex    // to protect rooms
+	clientSeq atomic.Uint64 // to number clients, see ClientInfo.ID
+
+	// newDriver returns the driver of a new room. nil to forward messages
+	// as they are.
+	newDriver func(room string) live2ddriver.Live2DDriver
+
+	historySize int // per-room history size
+	maxRooms    int // see WithMaxRooms
+
+	// per-client send queue
+	queueSize      int
+	overflowPolicy OverflowPolicy
+	sendTimeout    time.Duration
+
+	disconnected atomic.Uint64 // clients disconnected by the Disconnect policy
+
+	heartbeat heartbeat
+
+	// speech scheduling, see WithSpeechQueue
+	speechQueue     bool
+	speechEstimator SpeechEstimator
+
+	// filters of the driven messages, see WithFilters
+	filters []Filter
+
+	// idle behavior of rooms, see WithIdle. nil to disable.
+	idleOf func(room string) live2ddriver.IdleBehavior
+
+	// recorder of the traffic, see WithRecorder. nil to disable.
+	recorder *Recorder
+
+	// events from Live2DViews
+	events *eventBus
+
+	// tracked deliveries
+	deliveries   map[*Delivery]struct{}
+	deliveriesMu sync.Mutex
+}
+
+// Option configures a messageForwarder.
+type Option func(f *messageForwarder)
+
+// WithDriver makes the forwarder drive every Live2DRequest by the driver
+// before forwarding it to clients. The driver is shared by every room,
+// use WithRoomDriver for independent rooms.
+func WithDriver(driver live2ddriver.Live2DDriver) Option {
+	return func(f *messageForwarder) {
+		f.newDriver = func(string) live2ddriver.Live2DDriver { return driver }
+	}
+}
+
+// WithRoomDriver makes the forwarder drive every Live2DRequest by the
+// driver of the room it addresses. newDriver is called once for every
+// room, on its first use.
+func WithRoomDriver(newDriver func(room string) live2ddriver.Live2DDriver) Option {
+	return func(f *messageForwarder) {
+		f.newDriver = newDriver
+	}
+}
+
+// WithHistorySize sets the number of recent messages kept for resuming
+// reconnecting clients (/live2d?since=<seq>) of every room.
+// Default: HistorySize.
+func WithHistorySize(size int) Option {
+	return func(f *messageForwarder) {
+		f.historySize = size
+	}
+}
+
+// WithMaxRooms caps the number of rooms: messages & clients addressing a
+// new room beyond it are rejected with ErrTooManyRooms. 0 for no cap.
+// Default: MaxRooms.
+func WithMaxRooms(max int) Option {
+	return func(f *messageForwarder) {
+		f.maxRooms = max
+	}
+}
+
+// WithQueueSize sets the size of the per-client send queue.
+// Default: BufferSize.
+func WithQueueSize(size int) Option {
+	return func(f *messageForwarder) {
+		f.queueSize = size
+	}
+}
+
+// WithOverflowPolicy sets what to do when the send queue of a client is
+// full. Default: DropOldest.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(f *messageForwarder) {
+		f.overflowPolicy = policy
+	}
+}
+
+// WithSendTimeout sets how long SendMessage waits for a full send queue
+// before applying the OverflowPolicy. Default: 0, no waiting.
+func WithSendTimeout(timeout time.Duration) Option {
+	return func(f *messageForwarder) {
+		f.sendTimeout = timeout
 	}
 }
 
-func NewMessageForwarder() *messageForwarder {
-	return &messageForwarder{
-		msgChans: []chan []byte{},
+func NewMessageForwarder(opts ...Option) *messageForwarder {
+	f := &messageForwarder{
+		rooms:           map[string]*room{},
+		historySize:     HistorySize,
+		maxRooms:        MaxRooms,
+		events:          newEventBus(),
+		deliveries:      map[*Delivery]struct{}{},
+		queueSize:       BufferSize,
+		overflowPolicy:  DropOldest,
+		speechEstimator: EstimateSpeech,
+		filters:         DefaultFilters(),
+		heartbeat: heartbeat{
+			pingInterval: PingInterval,
+			idleTimeout:  IdleTimeout,
+			writeTimeout: WriteTimeout,
+		},
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
 }
 
-// ForwardMessageTo the WebSocket connection.
+// ForwardMessageTo the WebSocket connection, which joins the room given by
+// the query parameter room (/live2d?room=<room>), or the DefaultRoom.
 //
-// Use SendMessage to send messages.
+// See ForwardMessageToRoom.
+func (f *messageForwarder) ForwardMessageTo(ws *websocket.Conn) {
+	var name string
+	if r := ws.Request(); r != nil {
+		name = r.URL.Query().Get("room")
+	}
+	f.ForwardMessageToRoom(name, ws)
+}
+
+// ForwardMessageToRoom the WebSocket connection, which joins the room.
+// An empty room is the DefaultRoom.
+//
+// Use SendMessage to send messages. Messages from the connection are
+// parsed as ViewEvents, use Subscribe to receive them.
+//
+// Before live messages, the connection gets replayed from the room:
+//
+//   - the missed messages after the sequence number given by the query
+//     parameter since (/live2d?since=<seq>), if they are all still in the
+//     history;
+//   - otherwise, the current state (model & expression), after a gap
+//     notice if since is given.
 //
 // Block until the websocket connection is closed.
-func (f *messageForwarder) ForwardMessageTo(ws *websocket.Conn) {
-	ch := make(chan []byte, BufferSize)
+func (f *messageForwarder) ForwardMessageToRoom(name string, ws *websocket.Conn) {
+	r, err := f.room(name)
+	if err != nil {
+		log.Printf("WARN ForwardMessageTo %s: %v. Close the connection.", ws.RemoteAddr(), err)
+		_ = ws.Close()
+		return
+	}
 
-	// add
+	c := newClient(ws, f.queueSize, f.overflowPolicy)
+	c.id = f.newClientID()
+	c.room = r.name
+	c.heartbeat = f.heartbeat
 
-	f.mu.Lock()
-	f.msgChans = append(f.msgChans, ch)
-	f.mu.Unlock()
+	// add: replay & register atomically, so that no live message is missed
+	// or sent before the replay.
 
-	verboseLogf("Start ForwardMessageTo: %s by chan %v.", ws.RemoteAddr(), ch)
+	r.mu.Lock()
+	c.preload(c.filter(r.replay(ws)))
+	r.clients = append(r.clients, c)
+	r.mu.Unlock()
+	f.startIdle(r)
+
+	verboseLogf("Start ForwardMessageTo: %s (client %s, room %q).", ws.RemoteAddr(), c.id, r.name)
+	f.publishEvent(c, ViewEvent{Type: EventConnected})
 
 	// forward
 
-	forwardMessage(ch, ws) // 阻塞
+	go c.receive(func(msg []byte) {
+		f.handleViewMessage(c, msg)
+	})
+	c.forward() // 阻塞
 
 	// clean up
 
-	close(ch)
+	r.remove(c)
 
-	f.mu.Lock()
-	for i, c := range f.msgChans {
-		if c == ch {
-			f.msgChans = append(f.msgChans[:i], f.msgChans[i+1:]...)
-			break
-		}
+	f.eachDelivery(func(d *Delivery) {
+		d.fail(c, "disconnected")
+	})
+
+	f.publishEvent(c, ViewEvent{Type: EventDisconnected})
+	verboseLogf("Stop ForwardMessageTo: %s (client %s, room %q, sent %d, dropped %d, coalesced %d).",
+		ws.RemoteAddr(), c.id, r.name, c.sent.Load(), c.dropped.Load(), c.coalesced.Load())
+}
+
+// SendMessage to WebSocket clients of the room addressed by the room field
+// of the message (see Live2DRequest), or the DefaultRoom. The room field
+// is not forwarded.
+//
+// The message is numbered (see withSeq) and put into the send queue of
+// every client in the room, projected by the Subscription of the client,
+// without waiting for it to be written. Block at most the send timeout for
+// each client whose queue is full.
+func (f *messageForwarder) SendMessage(msg []byte) {
+	f.sendFrom(msg, SourceSend)
+}
+
+// sendFrom is SendMessage of a message from the source.
+func (f *messageForwarder) sendFrom(msg []byte, source string) {
+	if _, err := f.send(msg, "", "", source); err != nil && err != ErrNothingToForward && err != ErrSpeechQueued {
+		log.Printf("WARN SendMessage (%s): %v. Drop the message.", source, err)
 	}
-	f.mu.Unlock()
+}
+
+// send the message from the source to WebSocket clients. The delivery is
+// tracked if wait is not empty. See SendMessage & SendMessageTracked.
+func (f *messageForwarder) send(msg []byte, id string, wait WaitMode, source string) (*Delivery, error) {
+	// verboseLogf("SendMessage: %s", string(msg))
 
-	verboseLogf("Stop ForwardMessageTo: %s by chan %v.", ws.RemoteAddr(), ch)
+	name, msg, err := splitRoom(msg)
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.room(name)
+	if err != nil {
+		return nil, err
+	}
+	r.idle.touch()
+
+	return f.sendTo(r, msg, id, wait, source)
 }
 
-// ignoreOpenMouthAfterEmoMotion 忽略掉那些紧随情感分析得到动作后的 OpenMouth 动作。
-// 防止情感表情动作被“开口说话”覆盖: https://github.com/cdfmlr/muvtuber/issues/35
+// sendTo sends the message (without the room field) from the source to the
+// room.
 //
-// return true if msg is a OpenMouth after emo-motion, should be ignored.
-func (f *messageForwarder) ignoreOpenMouthAfterEmoMotion(msg []byte) bool {
-	f.lastSend.mu.Lock()
-	defer f.lastSend.mu.Unlock()
+// Messages are driven concurrently: driving may take seconds (e.g. TTS),
+// which should never hold back the other messages of the room. The driven
+// messages of a room are then filtered & forwarded one by one, so that the
+// stateful filters (e.g. the arbiter) see them in the order of forwarding.
+func (f *messageForwarder) sendTo(r *room, msg []byte, id string, wait WaitMode, source string) (*Delivery, error) {
+	raw := msg
+	if msg = f.driveFrom(r, msg, source); msg == nil {
+		return nil, ErrNothingToForward
+	}
 
-	// 一秒之内的连续 motion 消息，且最后一个（当前消息）是 flick_head，
-	// 则判断为可能覆盖情感表情动作的开口说话动作，忽略掉。
-	if (time.Since(f.lastSend.time) < time.Second) &&
-		(string(msg) == `{"motion":"flick_head"}`) &&
-		(strings.Contains(string(f.lastSend.msg), `motion`)) {
+	r.sendToMu.Lock()
+	defer r.sendToMu.Unlock()
 
-		return true
+	var s *speech
+	if f.speechQueue {
+		var queued bool
+		if s, queued = f.queueSpeech(r, raw, msg, id, source); queued {
+			return nil, ErrSpeechQueued
+		}
 	}
+	return f.filterForward(r, s, raw, msg, id, wait, source)
+}
 
-	f.lastSend.time = time.Now()
-	f.lastSend.msg = msg
-	return false
+// driveFrom records & drives the message from the source to the room.
+// Returns nil if there is nothing to forward after driving.
+func (f *messageForwarder) driveFrom(r *room, msg []byte, source string) []byte {
+	f.recordIn(source, r.name, msg)
+
+	driven := r.drive(msg)
+	if driven == nil {
+		verboseLogf("INFO drop msg: nothing to forward after driving.")
+	}
+	return driven
 }
 
-// SendMessage to WebSocket clients.
+// filterForward filters & forwards the driven message. raw is the message
+// before driving. s is the speech of the message if it's the current one
+// of the speech queue: it's finished at once if the message turns out not
+// to be forwarded.
 //
-// Block until message is sent to all clients.
-func (f *messageForwarder) SendMessage(msg []byte) {
-	// verboseLogf("SendMessage: %s", string(msg))
+// Speak requests of the speech queue are filtered when they are forwarded,
+// rather than when they are queued, so that the filters see what's playing
+// by then. r.sendToMu must be held.
+func (f *messageForwarder) filterForward(r *room, s *speech, raw, msg []byte, id string, wait WaitMode, source string) (*Delivery, error) {
+	msg = f.filter(r, raw, msg)
+	if msg == nil {
+		verboseLogf("INFO drop msg: filtered out.")
+		f.finishSpeechLocked(r, s)
+		return nil, ErrNothingToForward
+	}
 
-	// a temporary solution to https://github.com/cdfmlr/muvtuber/issues/35
-	if f.ignoreOpenMouthAfterEmoMotion(msg) {
-		log.Printf("WARN may be a OpenMouth after emo-motion, ignore: %s", string(msg))
-		return
+	d, err := f.forward(r, msg, id, wait, source)
+	if err == ErrNoClients {
+		f.finishSpeechLocked(r, s) // never spoken: don't hold the queue
 	}
+	return d, err
+}
 
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+// forward the (driven) message from the source to WebSocket clients of the
+// room.
+func (f *messageForwarder) forward(r *room, msg []byte, id string, wait WaitMode, source string) (*Delivery, error) {
+	// exclusive: messages are numbered & enqueued to every client in order
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+
+	// number the message & pick the receivers under r.mu, but enqueue
+	// without it: a slow client never blocks joining, leaving & reading
+	// the room. Clients joining in between get the message by the replay.
+	r.mu.Lock()
+	seq := r.history.next()
+	enveloped := withSeq(msg, seq)
+
+	// project the message by the subscription of every client
+	var receivers []*client
+	var projected [][]byte
+	for _, c := range r.clients {
+		if data, ok := c.subscription().project(enveloped); ok {
+			receivers = append(receivers, c)
+			projected = append(projected, data)
+		}
+	}
 
-	for _, ch := range f.msgChans {
-		if ch != nil {
-			ch <- msg
+	// a tracked message nobody would get is rejected, without a trace
+	if wait != "" && len(receivers) == 0 {
+		r.mu.Unlock()
+		return nil, ErrNoClients
+	}
+
+	r.state.update(msg)
+	r.history.append(enveloped)
+	f.recordOut(source, r.name, seq, msg)
+	r.mu.Unlock()
+
+	var d *Delivery
+	var dlvs []*Delivery
+	if wait != "" {
+		d = f.track(id, wait, receivers)
+		dlvs = []*Delivery{d}
+	}
+
+	for i, c := range receivers {
+		err := c.enqueue(outMsg{data: projected[i], dlvs: dlvs}, f.sendTimeout)
+		if err == errSlowClient {
+			f.disconnected.Add(1)
+		}
+		if err != nil && d != nil {
+			d.fail(c, err.Error())
 		}
 	}
+
+	return d, nil
+}
+
+// Stats are the counters of the forwarder.
+type Stats struct {
+	Rooms        int    `json:"rooms"`        // rooms
+	Clients      int    `json:"clients"`      // connected clients
+	Sent         uint64 `json:"sent"`         // messages written to connected clients
+	Dropped      uint64 `json:"dropped"`      // messages dropped by full send queues of connected clients
+	Coalesced    uint64 `json:"coalesced"`    // messages merged by full send queues of connected clients
+	Disconnected uint64 `json:"disconnected"` // clients disconnected by full send queues
+}
+
+// Stats returns the counters of the forwarder, summed over every room.
+func (f *messageForwarder) Stats() Stats {
+	s := Stats{
+		Disconnected: f.disconnected.Load(),
+	}
+	f.eachRoom(func(r *room) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		s.Rooms++
+		s.Clients += len(r.clients)
+		for _, c := range r.clients {
+			s.Sent += c.sent.Load()
+			s.Dropped += c.dropped.Load()
+			s.Coalesced += c.coalesced.Load()
+		}
+	})
+	return s
 }
 
 // ForwardMessageFrom the message channel.
@@ -126,28 +415,10 @@ func (f *messageForwarder) ForwardMessageFrom(msgCh <-chan []byte) {
 	}
 }
 
-// forwardMessage forwards messages from the message channel to the websocket
-// connection.
-//
-// The message channel is expected to receive JSON strings (bytes):
-//
-//	`{"motion": "shake"}`
-//	`{"expression": "f03"}`
-func forwardMessage(msgCh <-chan []byte, ws *websocket.Conn) {
-	for msg := range msgCh {
-		verboseLogf("INFO fwd msg: %s -> %s (chan %v).", ellipsis.Centering(string(msg), 80), ws.RemoteAddr(), msgCh)
-		_, err := ws.Write(msg)
-		if err != nil {
-			verboseLogf("ERROR fwd msg to %s (chan %v) error: %s.", ws.RemoteAddr(), msgCh, err)
-			break
-		}
-	}
-	_ = ws.Close()
-}
-
 // region useful ForwardMessageFrom* methods
 
 // ForwardMessageFromStdin read Live2DRequest from stdin and send it to MessageForwarder.
+// Address a room by the room field: {"room": "brb", ...}.
 //
 // Block until EOF (that is, never).
 func (f *messageForwarder) ForwardMessageFromStdin() {
@@ -157,17 +428,21 @@ func (f *messageForwarder) ForwardMessageFromStdin() {
 	fmt.Printf("Enter a message to send: ")
 	for {
 		scanner.Scan()
-		f.SendMessage(scanner.Bytes())
+		f.sendFrom(scanner.Bytes(), SourceStdin)
 		time.Sleep(time.Millisecond * 200) // 太快了日志和输入提示交错不好看
 		fmt.Printf("Enter a message to send: ")
 	}
 }
 
+// RouteRegister registers extra routes (e.g. admin APIs) to the HTTP server
+// of ForwardMessageFromHTTP.
+type RouteRegister func(router gin.IRouter)
+
 // ForwardMessageFromHTTP read Live2DRequest from HTTP request and send it to MessageForwarder.
 //
 // Block until the HTTP server is closed (that is, never).
-func (f *messageForwarder) ForwardMessageFromHTTP(addr string) error {
-	verboseLogf("(in) Forwarding messages from HTTP (%s/live2d) to WebSocket clients...\n", addr)
+func (f *messageForwarder) ForwardMessageFromHTTP(addr string, routes ...RouteRegister) error {
+	verboseLogf("(in) Forwarding messages from HTTP (%s/live2d[/<room>]) to WebSocket clients...\n", addr)
 
 	router := gin.New()
 	// router.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
@@ -178,20 +453,52 @@ func (f *messageForwarder) ForwardMessageFromHTTP(addr string) error {
 	// 	)
 	// }))
 	router.Use(gin.Recovery())
-	router.Any("/live2d", func(c *gin.Context) {
-		var req live2ddriver.Live2DRequest
-		if err := c.ShouldBind(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	router.Any("/live2d", f.serveLive2D)
+	router.Any("/live2d/:room", f.serveLive2D)
+	router.GET("/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, f.Stats())
+	})
+	router.GET("/events", f.serveEvents)
+	router.GET("/clients", f.serveClients)
+	router.DELETE("/clients/:id", f.serveKick)
+	f.speechRoutes(router)
+	for _, register := range routes {
+		register(router)
+	}
+	return router.Run(addr)
+}
+
+// serveLive2D serves /live2d & /live2d/:room: forward the Live2DRequest to
+// the room given by the path, the query parameter room, or the request.
+func (f *messageForwarder) serveLive2D(c *gin.Context) {
+	var req live2ddriver.Live2DRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if room := c.Param("room"); room != "" {
+		req.Room = room
+	} else if room := c.Query("room"); room != "" {
+		req.Room = room
+	}
+	if req.Room != "" && !ValidRoomName(req.Room) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v: %q", ErrInvalidRoom, req.Room)})
+		return
+	}
+
+	wait := c.Query("wait")
+	if wait == "" {
 		j, err := json.Marshal(req)
 		if err != nil {
 			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
 			return
 		}
-		f.SendMessage(j)
-	})
-	return router.Run(addr)
+		f.sendFrom(j, SourceHTTP)
+		return
+	}
+
+	f.sendAndWait(c, req, wait)
 }
 
 // endregion useful ForwardMessageFrom* methods
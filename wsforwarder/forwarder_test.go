@@ -1,7 +1,10 @@
 package wsforwarder
 
 import (
+	"live2ddriver/live2ddriver"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -69,3 +72,210 @@ func TestMessageForwarder(t *testing.T) {
 
 	client.Close()
 }
+
+func TestMessageForwarder_drive(t *testing.T) {
+	f := NewMessageForwarder(WithDriver(live2ddriver.NewEmotionDriver(
+		live2ddriver.NewStatelessEmoMapper(
+			map[live2ddriver.EmotionsKey]live2ddriver.Motion{"happiness": "tap_body"},
+			map[live2ddriver.PolarityKey]live2ddriver.Expression{"positive": "f04"},
+		),
+	)))
+
+	testCases := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"NotLive2DRequest", `hello`, `hello`},
+		{"NoEmotion", `{"motion": "shake"}`, `{"motion": "shake"}`},
+		{"Emotion", `{"emotion": {"emotions": {"happiness": 1}, "polarity": {"positive": 1}}}`, `{"motion":"tap_body","expression":"f04"}`},
+	}
+
+	r, err := f.room(DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(r.drive([]byte(tc.msg))); got != tc.want {
+				t.Errorf("drive(%s) = %s, want %s", tc.msg, got, tc.want)
+			}
+		})
+	}
+}
+
+// serveForwarder serves the forwarder at a httptest server, and returns a
+// function to dial new Live2DView connections to it.
+func serveForwarder(t *testing.T, f *messageForwarder) (dial func(query string) *websocket.Conn) {
+	t.Helper()
+
+	srv := httptest.NewServer(websocket.Handler(func(c *websocket.Conn) {
+		f.ForwardMessageTo(c)
+	}))
+	t.Cleanup(srv.Close)
+
+	return func(query string) *websocket.Conn {
+		t.Helper()
+
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/live2d"+query, "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+}
+
+// receive a message from ws, or fail the test after a second.
+func receive(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("websocket.Message.Receive: %v", err)
+	}
+	return msg
+}
+
+func TestMessageForwarder_replay(t *testing.T) {
+	f := NewMessageForwarder()
+	dial := serveForwarder(t, f)
+
+	f.SendMessage([]byte(`{"expression":"f00"}`))
+	f.SendMessage([]byte(`{"model":"shizuku.model.json"}`))
+	f.SendMessage([]byte(`{"motion":"tap_body"}`))
+	f.SendMessage([]byte(`{"speak":{"audio":"a.wav","expression":"f04"}}`))
+
+	ws := dial("")
+
+	for _, want := range []string{
+		`{"model":"shizuku.model.json"}`,
+		`{"expression":"f04"}`,
+	} {
+		if got := receive(t, ws); got != want {
+			t.Errorf("replay: got %s, want %s", got, want)
+		}
+	}
+
+	f.SendMessage([]byte(`{"motion":"shake"}`))
+	if got := receive(t, ws); got != `{"seq":5,"motion":"shake"}` {
+		t.Errorf("live: got %s, want %s", got, `{"seq":5,"motion":"shake"}`)
+	}
+}
+
+func TestMessageForwarder_resume(t *testing.T) {
+	f := NewMessageForwarder(WithHistorySize(2))
+	dial := serveForwarder(t, f)
+
+	f.SendMessage([]byte(`{"model":"shizuku.model.json"}`))
+	f.SendMessage([]byte(`{"motion":"tap_body"}`))
+	f.SendMessage([]byte(`{"motion":"shake"}`))
+
+	t.Run("Resume", func(t *testing.T) {
+		ws := dial("?since=2")
+		if got := receive(t, ws); got != `{"seq":3,"motion":"shake"}` {
+			t.Errorf("got %s, want %s", got, `{"seq":3,"motion":"shake"}`)
+		}
+	})
+
+	t.Run("Gap", func(t *testing.T) {
+		ws := dial("?since=0")
+		for _, want := range []string{
+			`{"gap":{"seq":3,"since":0}}`,
+			`{"model":"shizuku.model.json"}`,
+		} {
+			if got := receive(t, ws); got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		}
+	})
+}
+
+func TestMessageForwarder_slowClient(t *testing.T) {
+	f := NewMessageForwarder(WithSendTimeout(time.Second), WithOverflowPolicy(DropNewest))
+	r, err := f.room(DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client that never takes its full queue
+	c := newClient(newTestConn(t), 1, DropNewest)
+	c.id, c.room = "slow", r.name
+	r.mu.Lock()
+	r.clients = append(r.clients, c)
+	r.mu.Unlock()
+	if err := c.enqueue(outMsg{data: []byte("1")}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.SendMessage([]byte(`{"motion":"shake"}`))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the room is not locked while waiting for the slow client
+	start := time.Now()
+	if clients := f.Clients(); len(clients) != 1 {
+		t.Errorf("Clients() = %+v, want the slow one", clients)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Clients() blocked for %v by the slow client", elapsed)
+	}
+
+	<-done
+	if got := c.dropped.Load(); got != 1 {
+		t.Errorf("dropped = %d, want 1 after the send timeout", got)
+	}
+}
+
+func TestMessageForwarder_slowDriver(t *testing.T) {
+	// a driver taking long for some messages, e.g. TTS of a long text
+	release := make(chan struct{})
+	driver := driverFunc(func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+		if req.Motion == "slow" {
+			<-release
+		}
+		return req
+	})
+	f := NewMessageForwarder(WithDriver(driver))
+	r, err := f.room(DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.SendMessage([]byte(`{"motion":"slow"}`))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// other messages of the room are not held back by the slow one
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		f.SendMessage([]byte(`{"motion":"fast"}`))
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("SendMessage blocked by driving another message")
+	}
+
+	close(release)
+	<-done
+	forwarded, _ := r.history.since(0)
+	want := []string{`{"seq":1,"motion":"fast"}`, `{"seq":2,"motion":"slow"}`}
+	if len(forwarded) != len(want) {
+		t.Fatalf("forwarded %q, want %q", forwarded, want)
+	}
+	for i := range want {
+		if string(forwarded[i]) != want[i] {
+			t.Errorf("forwarded %s, want %s", forwarded[i], want[i])
+		}
+	}
+}
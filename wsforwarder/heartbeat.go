@@ -0,0 +1,162 @@
+package wsforwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// heartbeat configures the liveness checking of clients.
+type heartbeat struct {
+	pingInterval time.Duration // send a ping frame every pingInterval. 0 to disable.
+	idleTimeout  time.Duration // evict the client if nothing (including pongs) is read for idleTimeout. 0 to disable.
+	writeTimeout time.Duration // write deadline of every message. 0 to disable.
+}
+
+// default heartbeat
+const (
+	PingInterval = 15 * time.Second
+	IdleTimeout  = 45 * time.Second
+	WriteTimeout = 10 * time.Second
+)
+
+// WithPingInterval sets the interval to ping clients. 0 to disable pinging.
+// Default: PingInterval.
+func WithPingInterval(interval time.Duration) Option {
+	return func(f *messageForwarder) {
+		f.heartbeat.pingInterval = interval
+	}
+}
+
+// WithIdleTimeout sets the time after which a client that has sent nothing
+// (including pongs of pings) is evicted. 0 to disable. Default: IdleTimeout.
+//
+// It works only for connections served by ListenAndServe, where the read
+// activity of connections is tracked. It's checked at every ping, so it
+// requires pinging to be enabled.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(f *messageForwarder) {
+		f.heartbeat.idleTimeout = timeout
+	}
+}
+
+// WithWriteTimeout sets the deadline to write a message to a client.
+// 0 to disable. Default: WriteTimeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(f *messageForwarder) {
+		f.heartbeat.writeTimeout = timeout
+	}
+}
+
+var errIdle = errors.New("idle timeout")
+
+// ping the client. Returns errIdle if the client has been idle for too long.
+func (c *client) ping() error {
+	if c.heartbeat.idleTimeout > 0 {
+		if conn := activityOf(c.ws); conn != nil {
+			if idle := conn.idle(); idle > c.heartbeat.idleTimeout {
+				return fmt.Errorf("%w: nothing read in %v", errIdle, idle.Round(time.Millisecond))
+			}
+		}
+	}
+
+	c.ws.PayloadType = websocket.PingFrame
+	defer func() { c.ws.PayloadType = websocket.TextFrame }()
+
+	return c.write(nil)
+}
+
+// write data to the websocket connection with the write deadline.
+func (c *client) write(data []byte) error {
+	if c.heartbeat.writeTimeout > 0 {
+		_ = c.ws.SetWriteDeadline(time.Now().Add(c.heartbeat.writeTimeout))
+	}
+	_, err := c.ws.Write(data)
+	return err
+}
+
+// region activity tracking
+
+// activityConn is a net.Conn that tracks the time of its last read.
+type activityConn struct {
+	net.Conn
+	lastRead atomic.Int64 // UnixNano
+}
+
+func newActivityConn(conn net.Conn) *activityConn {
+	c := &activityConn{Conn: conn}
+	c.lastRead.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// idle returns the time since the last read.
+func (c *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastRead.Load()))
+}
+
+// activityListener is a net.Listener that accepts activityConns.
+type activityListener struct {
+	net.Listener
+}
+
+func (l activityListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newActivityConn(conn), nil
+}
+
+type activityConnKey struct{}
+
+// withActivityConn is a http.Server.ConnContext that makes the
+// activityConn available to handlers by activityOf.
+func withActivityConn(ctx context.Context, conn net.Conn) context.Context {
+	if ac, ok := conn.(*activityConn); ok {
+		return context.WithValue(ctx, activityConnKey{}, ac)
+	}
+	return ctx
+}
+
+// activityOf returns the activityConn under the websocket connection,
+// or nil if it's not served by ListenAndServe.
+func activityOf(ws *websocket.Conn) *activityConn {
+	r := ws.Request()
+	if r == nil {
+		return nil
+	}
+	ac, _ := r.Context().Value(activityConnKey{}).(*activityConn)
+	return ac
+}
+
+// ListenAndServe is http.ListenAndServe with the read activity of
+// connections tracked, which the idle timeout of clients depends on.
+// Serve the websocket handler of ForwardMessageTo by it.
+func ListenAndServe(addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		ConnContext: withActivityConn,
+	}
+	return srv.Serve(activityListener{l})
+}
+
+// endregion activity tracking
@@ -0,0 +1,60 @@
+package wsforwarder
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestMessageForwarder_heartbeat(t *testing.T) {
+	f := NewMessageForwarder(
+		WithPingInterval(20*time.Millisecond),
+		WithIdleTimeout(100*time.Millisecond),
+	)
+
+	// serve like ListenAndServe
+	srv := httptest.NewUnstartedServer(websocket.Handler(func(c *websocket.Conn) {
+		f.ForwardMessageTo(c)
+	}))
+	srv.Listener = activityListener{srv.Listener}
+	srv.Config.ConnContext = withActivityConn
+	srv.Start()
+	defer srv.Close()
+
+	dial := func() *websocket.Conn {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+
+	events, cancel := f.Subscribe()
+	defer cancel()
+
+	// alive: keeps reading, so that pings are answered with pongs
+	alive := dial()
+	go func() {
+		var msg string
+		for websocket.Message.Receive(alive, &msg) == nil {
+		}
+	}()
+	aliveAddr := nextEvent(t, events, EventConnected).Client
+
+	// dead: never reads, pings are not answered
+	dial()
+	deadAddr := nextEvent(t, events, EventConnected).Client
+
+	if ev := nextEvent(t, events, EventDisconnected); ev.Client != deadAddr {
+		t.Errorf("disconnected %s, want the dead client %s evicted", ev.Client, deadAddr)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := f.Stats().Clients; n != 1 {
+		t.Errorf("%d client(s) connected, want the alive client %s kept", n, aliveAddr)
+	}
+}
@@ -0,0 +1,104 @@
+package wsforwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// HistorySize is the default number of recent messages kept for resuming
+// reconnecting clients.
+const HistorySize = 256
+
+// history is a ring buffer of recently forwarded messages with their
+// sequence numbers.
+//
+// Every forwarded message gets a monotonically increasing sequence number,
+// starting from 1. A reconnecting client tells the last sequence number it
+// got (/live2d?since=<seq>), and gets the missed messages replayed from the
+// history.
+type history struct {
+	seq     uint64   // sequence number of the last message
+	entries [][]byte // ring buffer: the message of seq s is at entries[s % len(entries)]
+}
+
+func newHistory(size int) *history {
+	if size < 1 {
+		size = 1
+	}
+	return &history{entries: make([][]byte, size)}
+}
+
+// next returns the sequence number of the next message.
+func (h *history) next() uint64 {
+	return h.seq + 1
+}
+
+// append the next message to the history: enveloped is the message
+// numbered by next (see withSeq), as it's forwarded.
+func (h *history) append(enveloped []byte) {
+	h.seq++
+	h.entries[h.seq%uint64(len(h.entries))] = enveloped
+}
+
+// oldest returns the sequence number of the oldest message in the history.
+func (h *history) oldest() uint64 {
+	if h.seq < uint64(len(h.entries)) {
+		return 1
+	}
+	return h.seq - uint64(len(h.entries)) + 1
+}
+
+// since returns the messages after the sequence number seq.
+//
+// ok is false if some of the messages after seq are not in the history
+// any more (too old), or seq is from the future (e.g. from a previous run
+// of the forwarder): that's a gap.
+func (h *history) since(seq uint64) (msgs [][]byte, ok bool) {
+	if seq > h.seq || seq+1 < h.oldest() {
+		return nil, false
+	}
+	for s := seq + 1; s <= h.seq; s++ {
+		msgs = append(msgs, h.entries[s%uint64(len(h.entries))])
+	}
+	return msgs, true
+}
+
+// gapNotice is sent to a resuming client instead of the replay, if the
+// messages it missed are not in the history any more:
+//
+//	{"gap": {"since": 12, "seq": 300}}
+//
+// that is, messages after since (12) until seq (300) are lost.
+// The client is resynced with the state replay after the notice.
+func (h *history) gapNotice(since uint64) []byte {
+	j, _ := json.Marshal(map[string]interface{}{
+		"gap": map[string]uint64{"since": since, "seq": h.seq},
+	})
+	return j
+}
+
+// withSeq puts the sequence number into the message as the "seq" field:
+//
+//	{"motion": "shake"} => {"seq":42,"motion": "shake"}
+//
+// It's backward-compatible: clients unaware of it just ignore the field.
+// Messages that are not JSON objects are returned as they are.
+func withSeq(msg []byte, seq uint64) []byte {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) < 2 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return msg
+	}
+
+	body := bytes.TrimSpace(trimmed[1:])
+
+	enveloped := make([]byte, 0, len(trimmed)+24)
+	enveloped = append(enveloped, `{"seq":`...)
+	enveloped = strconv.AppendUint(enveloped, seq, 10)
+	if body[0] != '}' {
+		enveloped = append(enveloped, ',')
+	}
+	enveloped = append(enveloped, body...)
+
+	return enveloped
+}
@@ -0,0 +1,58 @@
+package wsforwarder
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_withSeq(t *testing.T) {
+	testCases := []struct {
+		msg  string
+		want string
+	}{
+		{`{"motion":"shake"}`, `{"seq":42,"motion":"shake"}`},
+		{` { "motion": "shake" } `, `{"seq":42,"motion": "shake" }`},
+		{`{}`, `{"seq":42}`},
+		{`hello`, `hello`},
+		{`["motion"]`, `["motion"]`},
+		{`{"motion":`, `{"motion":`},
+	}
+
+	for _, tc := range testCases {
+		if got := string(withSeq([]byte(tc.msg), 42)); got != tc.want {
+			t.Errorf("withSeq(%s) = %s, want %s", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestHistory_since(t *testing.T) {
+	h := newHistory(3)
+	for _, msg := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`} {
+		h.append(withSeq([]byte(msg), h.next()))
+	}
+
+	testCases := []struct {
+		since  uint64
+		want   string
+		wantOk bool
+	}{
+		{0, "", false}, // seq 1 is gone
+		{1, `{"seq":2,"n":2} {"seq":3,"n":3} {"seq":4,"n":4}`, true},
+		{3, `{"seq":4,"n":4}`, true},
+		{4, "", true},
+		{5, "", false}, // from the future
+	}
+
+	for _, tc := range testCases {
+		msgs, ok := h.since(tc.since)
+
+		var got []string
+		for _, msg := range msgs {
+			got = append(got, string(msg))
+		}
+
+		if ok != tc.wantOk || strings.Join(got, " ") != tc.want {
+			t.Errorf("since(%d) = %v, %v; want %v, %v", tc.since, got, ok, tc.want, tc.wantOk)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"live2ddriver/live2ddriver"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// idleRecheck is how often a room that can't idle (idling disabled, no
+// clients, or speaking) checks again.
+const idleRecheck = time.Second
+
+// WithIdle makes the forwarder play idle behaviors in rooms without input:
+// after the IdleBehavior.After without messages sent to a room,
+// idle motions & expression resets are sent to it, as PriorityIdle
+// requests, until the next message arrives.
+//
+// behaviorOf returns the IdleBehavior of the room, e.g. of its current
+// profile (see live2ddriver.ProfileDriver.Idle). It's called before every
+// idle action, so that it follows the model switching.
+func WithIdle(behaviorOf func(room string) live2ddriver.IdleBehavior) Option {
+	return func(f *messageForwarder) {
+		f.idleOf = behaviorOf
+	}
+}
+
+// idleState tracks the input of a room.
+type idleState struct {
+	lastInput time.Time
+	running   bool // the idle loop of the room, see startIdle
+	mu        sync.Mutex
+}
+
+// touch marks an input to the room, pausing the idling.
+func (s *idleState) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastInput = time.Now()
+}
+
+func (s *idleState) last() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastInput
+}
+
+// startIdle starts the idle loop of the room if it's not running, as a
+// client joins. The loop stops when the room has no clients.
+func (f *messageForwarder) startIdle(r *room) {
+	if f.idleOf == nil {
+		return
+	}
+
+	r.idle.mu.Lock()
+	defer r.idle.mu.Unlock()
+
+	if !r.idle.running {
+		r.idle.running = true
+		go f.idle(r)
+	}
+}
+
+// stopIdle reports whether the idle loop of the room should stop, that is,
+// the room has no clients, and marks it stopped if so. Checked & marked
+// atomically against startIdle, so that no joining client is missed.
+func (r *room) stopIdle() bool {
+	r.idle.mu.Lock()
+	defer r.idle.mu.Unlock()
+
+	r.mu.RLock()
+	empty := len(r.clients) == 0
+	r.mu.RUnlock()
+
+	if empty {
+		r.idle.running = false
+	}
+	return empty
+}
+
+// idle plays the idle behaviors of the room, until it has no clients.
+// See startIdle.
+func (f *messageForwarder) idle(r *room) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	first := true // the next action is the first of the idling
+	var next time.Time
+
+	for {
+		if r.stopIdle() {
+			verboseLogf("INFO room %q: stop idling without clients.", r.name)
+			return
+		}
+
+		b := f.idleOf(r.name)
+		if !b.Enabled {
+			first = true
+			time.Sleep(idleRecheck)
+			continue
+		}
+		b = b.WithDefaults()
+
+		after := time.Duration(b.After)
+		if !r.canIdle() {
+			first = true
+			time.Sleep(minDuration(after, idleRecheck))
+			continue
+		}
+
+		now := time.Now()
+		if idleSince := r.idle.last().Add(after); now.Before(idleSince) {
+			first = true
+			time.Sleep(minDuration(idleSince.Sub(now), idleRecheck))
+			continue
+		}
+		if !first && now.Before(next) {
+			time.Sleep(minDuration(next.Sub(now), idleRecheck))
+			continue
+		}
+
+		if first {
+			verboseLogf("INFO room %q: idle after %v without input.", r.name, after)
+		}
+		f.sendIdle(r, b.Action(rnd, first))
+		first, next = false, now.Add(b.Interval(rnd))
+	}
+}
+
+// canIdle reports whether the room has clients to idle for, and is not
+// speaking.
+func (r *room) canIdle() bool {
+	r.mu.RLock()
+	clients := len(r.clients)
+	r.mu.RUnlock()
+
+	r.speech.mu.Lock()
+	speaking := r.speech.current != nil
+	r.speech.mu.Unlock()
+
+	return clients > 0 && !speaking
+}
+
+// sendIdle sends the idle action to the room, without pausing the idling.
+func (f *messageForwarder) sendIdle(r *room, req live2ddriver.Live2DRequest) {
+	if req.Motion == "" && req.Expression == "" {
+		return
+	}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("ERROR room %q: idle: json.Marshal: %v", r.name, err)
+		return
+	}
+	if _, err := f.sendTo(r, msg, "", "", SourceIdle); err != nil && err != ErrNothingToForward {
+		log.Printf("WARN room %q: idle: %v.", r.name, err)
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,77 @@
+package wsforwarder
+
+import (
+	"live2ddriver/live2ddriver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageForwarder_idle(t *testing.T) {
+	behavior := live2ddriver.IdleBehavior{
+		Enabled:     true,
+		After:       live2ddriver.Duration(200 * time.Millisecond),
+		MinInterval: live2ddriver.Duration(50 * time.Millisecond),
+		MaxInterval: live2ddriver.Duration(50 * time.Millisecond),
+		Motions:     map[string]float64{"idle": 1},
+		Expressions: map[string]float64{"f00": 1},
+	}
+	f := NewMessageForwarder(WithIdle(func(room string) live2ddriver.IdleBehavior {
+		if room != DefaultRoom {
+			return live2ddriver.IdleBehavior{}
+		}
+		return behavior
+	}))
+	dial := serveForwarder(t, f)
+
+	ws := dial("?since=0")
+	waitClients(t, f, 1)
+
+	// idling: the expression is reset first
+	start := time.Now()
+	if got, want := receive(t, ws), `{"seq":1,"motion":"idle","expression":"f00"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("idled after %v, want after 200ms without input", elapsed)
+	}
+	if got, want := receive(t, ws), `{"seq":2,"motion":"idle"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// input pauses the idling
+	f.SendMessage([]byte(`{"motion":"shake"}`))
+	got := receive(t, ws)
+	if got == `{"seq":3,"motion":"idle"}` { // sent before the input
+		got = receive(t, ws)
+	}
+	if !strings.HasSuffix(got, `"motion":"shake"}`) {
+		t.Fatalf("got %s, want the shake", got)
+	}
+	paused := time.Now()
+	if got := receive(t, ws); time.Since(paused) < 100*time.Millisecond || got == "" {
+		t.Errorf("got %s after %v, want idling again after 200ms", got, time.Since(paused))
+	}
+
+	// the idle loop stops without clients, and starts again with them
+	r, _ := f.lookupRoom(DefaultRoom)
+	running := func() bool {
+		r.idle.mu.Lock()
+		defer r.idle.mu.Unlock()
+		return r.idle.running
+	}
+	_ = ws.Close()
+	waitClients(t, f, 0)
+	for i := 0; i < 300 && running(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running() {
+		t.Fatal("idle loop running without clients")
+	}
+
+	ws = dial("?since=0")
+	waitClients(t, f, 1)
+	if !running() {
+		t.Error("idle loop not running after a client joins")
+	}
+}
@@ -0,0 +1,275 @@
+package wsforwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrInvalidReplay is returned by Replay for invalid ReplayOptions.
+var ErrInvalidReplay = errors.New("invalid replay")
+
+// Direction of a recorded message.
+type Direction string
+
+const (
+	DirIn  Direction = "in"  // sent to the forwarder (before driving), or from a view
+	DirOut Direction = "out" // forwarded to the views of the room (driven & filtered)
+)
+
+// Sources of the recorded messages.
+const (
+	SourceSend      = "send"      // SendMessage, SendMessageTracked & ForwardMessageFrom
+	SourceHTTP      = "http"      // /live2d
+	SourceStdin     = "stdin"     // ForwardMessageFromStdin
+	SourceIdle      = "idle"      // the idle behavior, see WithIdle
+	SourceInterrupt = "interrupt" // InterruptSpeech
+	SourceView      = "view"      // events & control messages from views
+	SourceReplay    = "replay"    // Replay
+)
+
+// Record is a recorded message, a line of the JSONL recording.
+//
+// Example:
+//
+//	{"time":"2024-05-01T20:00:00.123+08:00","dir":"in","source":"http","room":"main","msg":{"speak":{"text":"大家好！"}}}
+//	{"time":"2024-05-01T20:00:01.456+08:00","dir":"out","source":"http","room":"main","seq":42,"msg":{"motion":"wave","speak":{...}}}
+type Record struct {
+	Time   time.Time `json:"time"`
+	Dir    Direction `json:"dir"`
+	Source string    `json:"source"`
+	Room   string    `json:"room"`
+	Client string    `json:"client,omitempty"` // the view, of SourceView
+	Seq    uint64    `json:"seq,omitempty"`    // of DirOut, see withSeq
+
+	Msg  json.RawMessage `json:"msg,omitempty"`  // the message, if it's JSON
+	Text string          `json:"text,omitempty"` // the message otherwise
+}
+
+// Message returns the recorded message.
+func (rec Record) Message() []byte {
+	if rec.Msg != nil {
+		return rec.Msg
+	}
+	return []byte(rec.Text)
+}
+
+// Recorder appends Records to a JSONL recording.
+type Recorder struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// OpenRecorder returns a Recorder appending to the file, created if not
+// existing. Close it to close the file.
+func OpenRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(file), nil
+}
+
+// Record appends the record as a line.
+func (rc *Recorder) Record(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	_, err = rc.w.Write(line)
+	return err
+}
+
+// Close the writer if it's an io.Closer.
+func (rc *Recorder) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if c, ok := rc.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WithRecorder records every message sent to the forwarder (DirIn, before
+// driving), every message forwarded to the views (DirOut) and every
+// message from the views (DirIn, SourceView) by the recorder.
+// Default: nil, not recording.
+func WithRecorder(rc *Recorder) Option {
+	return func(f *messageForwarder) {
+		f.recorder = rc
+	}
+}
+
+// record the message, if recording.
+func (f *messageForwarder) record(rec Record, msg []byte) {
+	if f.recorder == nil {
+		return
+	}
+
+	rec.Time = time.Now()
+	if json.Valid(msg) {
+		rec.Msg = json.RawMessage(msg)
+	} else {
+		rec.Text = string(msg)
+	}
+	if err := f.recorder.Record(rec); err != nil {
+		log.Printf("WARN record %s message of room %q: %v.", rec.Dir, rec.Room, err)
+	}
+}
+
+func (f *messageForwarder) recordIn(source, room string, msg []byte) {
+	f.record(Record{Dir: DirIn, Source: source, Room: room}, msg)
+}
+
+func (f *messageForwarder) recordOut(source, room string, seq uint64, msg []byte) {
+	f.record(Record{Dir: DirOut, Source: source, Room: room, Seq: seq}, msg)
+}
+
+func (f *messageForwarder) recordView(c *client, msg []byte) {
+	f.record(Record{Dir: DirIn, Source: SourceView, Room: c.room, Client: c.id}, msg)
+}
+
+// ReadRecords reads a JSONL recording.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(records), err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// LoadRecords reads the JSONL recording file.
+func LoadRecords(path string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ReadRecords(bytes.NewReader(data))
+}
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	// Speed scales the original pacing: 2 for twice as fast. 0 to replay
+	// without pacing, e.g. for regression tests.
+	Speed float64
+	// Dir of the records to replay:
+	//   - DirOut: re-forward what the views got, as is.
+	//   - DirIn: send the inputs again, through the drivers, filters &
+	//     speech queue. Messages from views are skipped.
+	Dir Direction
+	// Room to replay into, rather than the recorded rooms. Empty for the
+	// recorded rooms.
+	Room string
+}
+
+// Validate the ReplayOptions.
+func (o ReplayOptions) Validate() error {
+	if o.Speed < 0 {
+		return fmt.Errorf("%w: negative speed %v", ErrInvalidReplay, o.Speed)
+	}
+	if o.Dir != DirIn && o.Dir != DirOut {
+		return fmt.Errorf("%w: unknown direction %q: want %q or %q", ErrInvalidReplay, o.Dir, DirIn, DirOut)
+	}
+	if o.Room != "" && !ValidRoomName(o.Room) {
+		return fmt.Errorf("%w: %q", ErrInvalidRoom, o.Room)
+	}
+	return nil
+}
+
+// Replay re-forwards the records of the direction to the views of their
+// rooms, at the recorded pacing scaled by the speed. Replayed messages are
+// from SourceReplay, and pause the idling like any other input.
+//
+// Block until every record is replayed, or ctx is done. Returns the number
+// of records replayed.
+func (f *messageForwarder) Replay(ctx context.Context, records []Record, opts ReplayOptions) (int, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+
+	var first time.Time
+	var start time.Time
+	n := 0
+	for _, rec := range records {
+		if rec.Dir != opts.Dir || rec.Source == SourceView {
+			continue
+		}
+
+		if start.IsZero() {
+			first, start = rec.Time, time.Now()
+		} else if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / opts.Speed))
+			if err := sleepUntil(ctx, due); err != nil {
+				return n, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		room := rec.Room
+		if opts.Room != "" {
+			room = opts.Room
+		}
+		r, err := f.room(room)
+		if err != nil {
+			log.Printf("WARN replay record of %v: %v. Skip it.", rec.Time, err)
+			continue
+		}
+		r.idle.touch()
+
+		if opts.Dir == DirOut {
+			_, err = f.forward(r, rec.Message(), "", "", SourceReplay)
+		} else {
+			_, err = f.sendTo(r, rec.Message(), "", "", SourceReplay)
+		}
+		if err != nil && err != ErrNothingToForward && err != ErrSpeechQueued {
+			log.Printf("WARN replay record of %v: %v.", rec.Time, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sleepUntil the time t, or until the ctx is done.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,151 @@
+package wsforwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"live2ddriver/live2ddriver"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// prefixDriver drives motions into room-specific ones.
+func prefixDriver(room string) live2ddriver.Live2DDriver {
+	return driverFunc(func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+		if req.Motion != "" {
+			req.Motion = room + "_" + req.Motion
+		}
+		return req
+	})
+}
+
+// records returns what's recorded by the recorder into the buffer.
+func records(t *testing.T, rc *Recorder, buf *bytes.Buffer) []Record {
+	t.Helper()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	recs, err := ReadRecords(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestMessageForwarder_record(t *testing.T) {
+	var buf bytes.Buffer
+	rc := NewRecorder(&buf)
+	f := NewMessageForwarder(WithRecorder(rc), WithRoomDriver(prefixDriver))
+	dial := serveForwarder(t, f)
+
+	events, cancel := f.Subscribe()
+	defer cancel()
+
+	ws := dial("?since=0&room=brb")
+	waitClients(t, f, 1)
+
+	f.SendMessage([]byte(`{"room":"brb","motion":"wave"}`))
+	receive(t, ws)
+	f.SendMessage([]byte(`hello`)) // to the default room
+	if err := websocket.Message.Send(ws, `{"event":"motionFinished","motion":"brb_wave"}`); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events, EventMotionFinished)
+
+	want := []Record{
+		{Dir: DirIn, Source: SourceSend, Room: "brb", Msg: []byte(`{"motion":"wave"}`)},
+		{Dir: DirOut, Source: SourceSend, Room: "brb", Seq: 1, Msg: []byte(`{"motion":"brb_wave"}`)},
+		{Dir: DirIn, Source: SourceSend, Room: DefaultRoom, Text: "hello"},
+		{Dir: DirOut, Source: SourceSend, Room: DefaultRoom, Seq: 1, Text: "hello"},
+		{Dir: DirIn, Source: SourceView, Room: "brb", Client: f.Clients()[0].ID, Msg: []byte(`{"event":"motionFinished","motion":"brb_wave"}`)},
+	}
+	got := records(t, rc, &buf)
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d records, want %d: %+v", len(got), len(want), got)
+	}
+	for i, rec := range got {
+		if rec.Time.IsZero() {
+			t.Errorf("record %d without time", i)
+		}
+		rec.Time = time.Time{}
+		if string(rec.Message()) != string(want[i].Message()) || rec.Msg == nil != (want[i].Msg == nil) {
+			t.Errorf("record %d message = %s, want %s", i, rec.Message(), want[i].Message())
+		}
+		rec.Msg, rec.Text = nil, ""
+		w := want[i]
+		w.Msg, w.Text = nil, ""
+		if rec.Dir != w.Dir || rec.Source != w.Source || rec.Room != w.Room || rec.Client != w.Client || rec.Seq != w.Seq {
+			t.Errorf("record %d = %+v, want %+v", i, rec, w)
+		}
+	}
+}
+
+// recording is a fixture recorded from brb, where the motions are driven
+// by prefixDriver.
+const recording = `{"time":"2024-05-01T20:00:00Z","dir":"in","source":"http","room":"brb","msg":{"motion":"wave"}}
+{"time":"2024-05-01T20:00:00Z","dir":"out","source":"http","room":"brb","seq":1,"msg":{"motion":"brb_wave"}}
+{"time":"2024-05-01T20:00:00.1Z","dir":"in","source":"view","room":"brb","client":"1","msg":{"event":"motionFinished"}}
+{"time":"2024-05-01T20:00:00.4Z","dir":"in","source":"idle","room":"brb","msg":{"motion":"idle"}}
+{"time":"2024-05-01T20:00:00.4Z","dir":"out","source":"idle","room":"brb","seq":2,"msg":{"motion":"brb_idle"}}
+`
+
+func TestMessageForwarder_Replay(t *testing.T) {
+	recs, err := ReadRecords(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	rc := NewRecorder(&buf)
+	f := NewMessageForwarder(WithRecorder(rc), WithRoomDriver(prefixDriver))
+	dial := serveForwarder(t, f)
+
+	brb := dial("?since=0&room=brb")
+	main := dial("?since=0")
+	waitClients(t, f, 2)
+
+	// out: as is, at the scaled pacing
+	start := time.Now()
+	if n, err := f.Replay(context.Background(), recs, ReplayOptions{Speed: 2, Dir: DirOut}); n != 2 || err != nil {
+		t.Fatalf("Replay(out) = %d, %v, want 2", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replayed in %v, want 400ms / 2", elapsed)
+	}
+	for _, want := range []string{`{"seq":1,"motion":"brb_wave"}`, `{"seq":2,"motion":"brb_idle"}`} {
+		if got := receive(t, brb); got != want {
+			t.Errorf("brb got %s, want %s", got, want)
+		}
+	}
+
+	// in: driven again, into another room, without pacing
+	if n, err := f.Replay(context.Background(), recs, ReplayOptions{Dir: DirIn, Room: DefaultRoom}); n != 2 || err != nil {
+		t.Fatalf("Replay(in) = %d, %v, want 2", n, err)
+	}
+	for _, want := range []string{`{"seq":1,"motion":"default_wave"}`, `{"seq":2,"motion":"default_idle"}`} {
+		if got := receive(t, main); got != want {
+			t.Errorf("default room got %s, want %s", got, want)
+		}
+	}
+
+	// the replays are recorded as well
+	for _, rec := range records(t, rc, &buf) {
+		if rec.Source != SourceReplay {
+			t.Errorf("recorded %+v, want from %s", rec, SourceReplay)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if n, err := f.Replay(ctx, recs, ReplayOptions{Speed: 1, Dir: DirOut}); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("Replay(cancelled) = %d, %v, want context.Canceled", n, err)
+	}
+	for _, opts := range []ReplayOptions{{Speed: -1, Dir: DirOut}, {Speed: 1}} {
+		if _, err := f.Replay(context.Background(), recs, opts); !errors.Is(err, ErrInvalidReplay) {
+			t.Errorf("Replay(%+v) error = %v, want ErrInvalidReplay", opts, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package wsforwarder
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientInfo describes a connected Live2DView.
+type ClientInfo struct {
+	ID          string    `json:"id"`
+	Room        string    `json:"room"`
+	Addr        string    `json:"addr"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+
+	Queue    int `json:"queue"`    // messages waiting in the send queue
+	QueueCap int `json:"queueCap"` // size of the send queue
+
+	Sent      uint64 `json:"sent"`      // messages written to the client
+	BytesSent uint64 `json:"bytesSent"` // bytes of the messages written to the client
+	Dropped   uint64 `json:"dropped"`   // messages dropped by the full send queue
+	Coalesced uint64 `json:"coalesced"` // messages merged by the full send queue
+
+	Subscription Subscription `json:"subscription"`
+
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// ErrNoSuchClient is returned by Kick if no client has the given id.
+var ErrNoSuchClient = errors.New("no such client")
+
+// newClientID returns a unique id for a new client.
+func (f *messageForwarder) newClientID() string {
+	return strconv.FormatUint(f.clientSeq.Add(1), 10)
+}
+
+// info returns the ClientInfo of the client.
+func (c *client) info() ClientInfo {
+	info := ClientInfo{
+		ID:          c.id,
+		Room:        c.room,
+		Addr:        c.addr(),
+		UserAgent:   c.userAgent,
+		ConnectedAt: c.connectedAt,
+		QueueCap:    c.queueCap,
+		Sent:        c.sent.Load(),
+		BytesSent:   c.bytesSent.Load(),
+		Dropped:     c.dropped.Load(),
+		Coalesced:   c.coalesced.Load(),
+	}
+	info.Subscription = c.subscription().Subscription
+
+	c.mu.Lock()
+	info.Queue = len(c.queue)
+	c.mu.Unlock()
+
+	c.lastErr.mu.Lock()
+	if c.lastErr.err != "" {
+		t := c.lastErr.time
+		info.LastError, info.LastErrorTime = c.lastErr.err, &t
+	}
+	c.lastErr.mu.Unlock()
+
+	return info
+}
+
+// Clients returns the ClientInfo of connected clients of every room,
+// in the order they connected.
+func (f *messageForwarder) Clients() []ClientInfo {
+	infos := []ClientInfo{}
+	f.eachRoom(func(r *room) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		for _, c := range r.clients {
+			infos = append(infos, c.info())
+		}
+	})
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// Kick disconnects the client with the given id.
+// Returns ErrNoSuchClient if there is no such client connected.
+func (f *messageForwarder) Kick(id string) error {
+	var target *client
+	f.eachRoom(func(r *room) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+
+		for _, c := range r.clients {
+			if c.id == id {
+				target = c
+			}
+		}
+	})
+
+	if target == nil {
+		return ErrNoSuchClient
+	}
+	target.evict(errors.New("kicked"))
+	return nil
+}
+
+// region HTTP
+
+// serveClients serves GET /clients: the ClientInfo of connected clients.
+// Use /clients?room=<room> to list the clients of a room.
+func (f *messageForwarder) serveClients(c *gin.Context) {
+	clients := f.Clients()
+	if room := c.Query("room"); room != "" {
+		inRoom := []ClientInfo{}
+		for _, info := range clients {
+			if info.Room == room {
+				inRoom = append(inRoom, info)
+			}
+		}
+		clients = inRoom
+	}
+	c.JSON(http.StatusOK, clients)
+}
+
+// serveKick serves DELETE /clients/:id: kick the client.
+func (f *messageForwarder) serveKick(c *gin.Context) {
+	id := c.Param("id")
+	if err := f.Kick(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "id": id})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"kicked": id})
+}
+
+// endregion HTTP
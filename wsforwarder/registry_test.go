@@ -0,0 +1,62 @@
+package wsforwarder
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestMessageForwarder_Clients(t *testing.T) {
+	f := NewMessageForwarder()
+	dial := serveForwarder(t, f)
+
+	ws1 := dial("?since=0") // nothing to replay
+	waitClients(t, f, 1)
+	ws2 := dial("?since=0")
+	waitClients(t, f, 2)
+
+	f.SendMessage([]byte(`{"motion":"shake"}`))
+	msg1, msg2 := receive(t, ws1), receive(t, ws2)
+	if msg1 != msg2 {
+		t.Fatalf("clients received different messages: %q, %q", msg1, msg2)
+	}
+
+	clients := f.Clients()
+	if len(clients) != 2 {
+		t.Fatalf("Clients() = %+v, want 2 clients", clients)
+	}
+	if clients[0].ID == clients[1].ID {
+		t.Errorf("Clients() ids are not unique: %q", clients[0].ID)
+	}
+	for _, c := range clients {
+		if c.Addr == "" || c.ConnectedAt.IsZero() {
+			t.Errorf("Clients() missing metadata: %+v", c)
+		}
+		if c.Sent != 1 || c.BytesSent != uint64(len(msg1)) || c.Queue != 0 || c.QueueCap != BufferSize {
+			t.Errorf("Clients() counters = %+v, want sent 1 (%d bytes), queue 0/%d", c, len(msg1), BufferSize)
+		}
+	}
+
+	t.Run("Kick", func(t *testing.T) {
+		if err := f.Kick("no-such-client"); !errors.Is(err, ErrNoSuchClient) {
+			t.Errorf("Kick(no-such-client) = %v, want ErrNoSuchClient", err)
+		}
+
+		if err := f.Kick(clients[0].ID); err != nil {
+			t.Fatalf("Kick(%q) = %v", clients[0].ID, err)
+		}
+		waitClients(t, f, 1)
+
+		_ = ws1.SetReadDeadline(time.Now().Add(time.Second))
+		var msg string
+		if err := websocket.Message.Receive(ws1, &msg); err == nil {
+			t.Errorf("kicked client still receives messages: %q", msg)
+		}
+
+		if left := f.Clients(); left[0].ID != clients[1].ID {
+			t.Errorf("Clients() after kick = %+v, want %q left", left, clients[1].ID)
+		}
+	})
+}
@@ -0,0 +1,251 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"live2ddriver/live2ddriver"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cdfmlr/ellipsis"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultRoom is the room of clients & messages that address no room.
+const DefaultRoom = "default"
+
+var (
+	// ErrInvalidRoom is returned for messages addressing a room with an
+	// invalid name. See ValidRoomName.
+	ErrInvalidRoom = errors.New("invalid room name")
+	// ErrRoomNotFound is returned by the speech queue APIs for rooms never
+	// connected to or sent to.
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrTooManyRooms is returned for messages & clients addressing a new
+	// room when there are already max rooms. See WithMaxRooms.
+	ErrTooManyRooms = errors.New("too many rooms")
+)
+
+// MaxRooms is the default max number of rooms. Rooms live as long as the
+// forwarder (keeping their state for views to come), so the number is
+// capped against rooms made up by clients & requests.
+const MaxRooms = 64
+
+var roomNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// ValidRoomName reports whether name is a valid room name: 1~64 letters,
+// digits, '_', '.' or '-'.
+func ValidRoomName(name string) bool {
+	return roomNameRegexp.MatchString(name)
+}
+
+// room is a group of clients (Live2DViews) receiving the same messages.
+//
+// Every room keeps its own state, history & driver: rooms are independent
+// scenes driven by the same forwarder.
+type room struct {
+	name string
+
+	clients  []*client
+	history  *history     // recently forwarded messages, for resuming clients
+	mu       sync.RWMutex // to protect clients & history
+	sendMu   sync.Mutex   // to number & enqueue messages in order, see forward
+	sendToMu sync.Mutex   // to filter & forward driven messages one by one, see sendTo
+
+	// driver drives (e.g. emotion => motion & expression) Live2DRequests
+	// before forwarding. nil to forward messages as they are.
+	driver live2ddriver.Live2DDriver
+
+	// sticky state to replay to new clients
+	state viewState
+
+	speech speechQueue
+
+	idle idleState
+}
+
+// room returns the room with the name, created on first use, unless there
+// are already max rooms. An empty name is the DefaultRoom.
+func (f *messageForwarder) room(name string) (*room, error) {
+	if name == "" {
+		name = DefaultRoom
+	}
+	if !ValidRoomName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRoom, name)
+	}
+
+	f.roomsMu.Lock()
+	defer f.roomsMu.Unlock()
+
+	if r, ok := f.rooms[name]; ok {
+		return r, nil
+	}
+	if f.maxRooms > 0 && len(f.rooms) >= f.maxRooms {
+		return nil, fmt.Errorf("%w (max %d): %q", ErrTooManyRooms, f.maxRooms, name)
+	}
+
+	r := &room{
+		name:    name,
+		clients: []*client{},
+		history: newHistory(f.historySize),
+	}
+	if f.newDriver != nil {
+		r.driver = f.newDriver(name)
+	}
+	r.idle.touch()
+	f.rooms[name] = r
+
+	verboseLogf("INFO room %q created.", name)
+	return r, nil
+}
+
+// lookupRoom returns the existing room with the name, without creating it.
+// An empty name is the DefaultRoom.
+func (f *messageForwarder) lookupRoom(name string) (*room, error) {
+	if name == "" {
+		name = DefaultRoom
+	}
+	if !ValidRoomName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRoom, name)
+	}
+
+	f.roomsMu.Lock()
+	defer f.roomsMu.Unlock()
+
+	r, ok := f.rooms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrRoomNotFound, name)
+	}
+	return r, nil
+}
+
+// eachRoom calls fn for every room, in the order of names.
+func (f *messageForwarder) eachRoom(fn func(r *room)) {
+	f.roomsMu.Lock()
+	rooms := make([]*room, 0, len(f.rooms))
+	for _, r := range f.rooms {
+		rooms = append(rooms, r)
+	}
+	f.roomsMu.Unlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+	for _, r := range rooms {
+		fn(r)
+	}
+}
+
+// Rooms returns the names of the rooms, that have been connected to or
+// sent to.
+func (f *messageForwarder) Rooms() []string {
+	var names []string
+	f.eachRoom(func(r *room) {
+		names = append(names, r.name)
+	})
+	return names
+}
+
+// splitRoom takes the room field out of the JSON object msg.
+//
+// Messages without a room field (including those are not JSON objects)
+// are returned as they are, with an empty room.
+func splitRoom(msg []byte) (name string, rest []byte, err error) {
+	if !strings.Contains(string(msg), `"room"`) { // fast path
+		return "", msg, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil || fields == nil {
+		return "", msg, nil
+	}
+	raw, ok := fields["room"]
+	if !ok {
+		return "", msg, nil
+	}
+
+	if err := json.Unmarshal(raw, &name); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrInvalidRoom, raw)
+	}
+	delete(fields, "room")
+
+	rest, err = json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, rest, nil
+}
+
+// replay returns the messages to replay to a new connection.
+// See ForwardMessageTo. r.mu must be held.
+func (r *room) replay(ws *websocket.Conn) [][]byte {
+	var sinceParam string
+	if req := ws.Request(); req != nil {
+		sinceParam = req.URL.Query().Get("since")
+	}
+	if sinceParam == "" {
+		return r.state.snapshot()
+	}
+
+	since, err := strconv.ParseUint(sinceParam, 10, 64)
+	if err != nil {
+		log.Printf("WARN ForwardMessageTo %s: bad since=%q: %v. Replay the state.", ws.RemoteAddr(), sinceParam, err)
+		return r.state.snapshot()
+	}
+
+	if msgs, ok := r.history.since(since); ok {
+		verboseLogf("Resume %s since seq %d in room %q: replay %d message(s).", ws.RemoteAddr(), since, r.name, len(msgs))
+		return msgs
+	}
+
+	log.Printf("WARN resume %s since seq %d in room %q: gap (history: %d~%d). Replay the state.",
+		ws.RemoteAddr(), since, r.name, r.history.oldest(), r.history.seq)
+	return append([][]byte{r.history.gapNotice(since)}, r.state.snapshot()...)
+}
+
+// remove the client from the room.
+func (r *room) remove(c *client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, cc := range r.clients {
+		if cc == c {
+			r.clients = append(r.clients[:i], r.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// drive the message by the driver of the room.
+//
+// Messages that are not Live2DRequests are returned as they are.
+// Returns nil if the driven request turns out to be empty.
+func (r *room) drive(msg []byte) []byte {
+	if r.driver == nil {
+		return msg
+	}
+
+	var req live2ddriver.Live2DRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return msg
+	}
+
+	driven := r.driver.Drive(req)
+	if reflect.DeepEqual(driven, req) {
+		return msg
+	}
+	if reflect.ValueOf(driven).IsZero() {
+		return nil
+	}
+
+	j, err := json.Marshal(driven)
+	if err != nil {
+		log.Printf("ERROR drive msg %s: json.Marshal: %v", ellipsis.Centering(string(msg), 80), err)
+		return msg
+	}
+	return j
+}
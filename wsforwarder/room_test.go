@@ -0,0 +1,110 @@
+package wsforwarder
+
+import (
+	"errors"
+	"live2ddriver/live2ddriver"
+	"testing"
+)
+
+func Test_splitRoom(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      string
+		wantRoom string
+		wantRest string
+		wantErr  bool
+	}{
+		{"NotJSON", `hello`, "", `hello`, false},
+		{"NoRoom", `{"motion": "shake"}`, "", `{"motion": "shake"}`, false},
+		{"RoomInText", `{"speak": {"text": "room"}}`, "", `{"speak": {"text": "room"}}`, false},
+		{"Room", `{"room": "brb", "motion": "shake"}`, "brb", `{"motion":"shake"}`, false},
+		{"BadRoom", `{"room": 1, "motion": "shake"}`, "", ``, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			room, rest, err := splitRoom([]byte(tc.msg))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("splitRoom(%s) error = %v, wantErr %v", tc.msg, err, tc.wantErr)
+			}
+			if room != tc.wantRoom || string(rest) != tc.wantRest {
+				t.Errorf("splitRoom(%s) = %q, %s, want %q, %s", tc.msg, room, rest, tc.wantRoom, tc.wantRest)
+			}
+		})
+	}
+}
+
+// driverFunc is a Live2DDriver function.
+type driverFunc func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest
+
+func (d driverFunc) Drive(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+	return d(req)
+}
+
+func TestMessageForwarder_rooms(t *testing.T) {
+	// every room drives motions into a room-specific one
+	f := NewMessageForwarder(WithRoomDriver(func(room string) live2ddriver.Live2DDriver {
+		return driverFunc(func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+			if req.Motion != "" {
+				req.Motion = room + "_" + req.Motion
+			}
+			return req
+		})
+	}))
+	dial := serveForwarder(t, f)
+
+	main := dial("?since=0")
+	brb := dial("?since=0&room=brb")
+	waitClients(t, f, 2)
+
+	f.SendMessage([]byte(`{"room": "brb", "motion": "wave"}`))
+	f.SendMessage([]byte(`{"motion": "shake"}`))
+
+	if got, want := receive(t, brb), `{"seq":1,"motion":"brb_wave"}`; got != want {
+		t.Errorf("brb got %s, want %s", got, want)
+	}
+	if got, want := receive(t, main), `{"seq":1,"motion":"default_shake"}`; got != want {
+		t.Errorf("default room got %s, want %s", got, want)
+	}
+
+	// a new view of a room gets the state of that room
+	f.SendMessage([]byte(`{"room": "brb", "model": "brb.model.json"}`))
+	if got, want := receive(t, dial("?room=brb")), `{"model":"brb.model.json"}`; got != want {
+		t.Errorf("new brb view got %s, want %s", got, want)
+	}
+
+	if rooms := f.Rooms(); len(rooms) != 2 || rooms[0] != "brb" || rooms[1] != DefaultRoom {
+		t.Errorf("Rooms() = %v, want [brb default]", rooms)
+	}
+
+	if _, err := f.SendMessageTracked([]byte(`{"room": "../etc", "motion": "shake"}`), "1", WaitDelivered); !errors.Is(err, ErrInvalidRoom) {
+		t.Errorf("SendMessageTracked(invalid room) error = %v, want ErrInvalidRoom", err)
+	}
+}
+
+func TestMessageForwarder_maxRooms(t *testing.T) {
+	f := NewMessageForwarder(WithMaxRooms(2))
+
+	// reading never creates rooms
+	if _, err := f.Speech("ghost"); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("Speech(ghost) error = %v, want ErrRoomNotFound", err)
+	}
+	if _, err := f.InterruptSpeech("ghost", []byte(`{"speak":{"audio":"a.wav"}}`)); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("InterruptSpeech(ghost) error = %v, want ErrRoomNotFound", err)
+	}
+	if rooms := f.Rooms(); len(rooms) != 0 {
+		t.Errorf("Rooms() = %v, want none", rooms)
+	}
+
+	f.SendMessage([]byte(`{"room": "a", "motion": "wave"}`))
+	f.SendMessage([]byte(`{"room": "b", "motion": "wave"}`))
+	if _, err := f.SendMessageTracked([]byte(`{"room": "c", "motion": "wave"}`), "1", WaitDelivered); !errors.Is(err, ErrTooManyRooms) {
+		t.Errorf("SendMessageTracked(3rd room) error = %v, want ErrTooManyRooms", err)
+	}
+	if _, err := f.SendMessageTracked([]byte(`{"room": "a", "motion": "shake"}`), "2", WaitDelivered); !errors.Is(err, ErrNoClients) {
+		t.Errorf("SendMessageTracked(existing room) error = %v, want ErrNoClients", err)
+	}
+	if rooms := f.Rooms(); len(rooms) != 2 {
+		t.Errorf("Rooms() = %v, want [a b]", rooms)
+	}
+}
@@ -0,0 +1,392 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"live2ddriver/live2ddriver"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrSpeechQueued is returned by SendMessageTracked if the message is a
+// speak request queued behind the speech in progress: it's forwarded
+// later. See WithSpeechQueue.
+var ErrSpeechQueued = errors.New("speech queued")
+
+// SpeechEstimator estimates how long a speech lasts. A speech is taken as
+// finished after the estimated duration, if no view reports it earlier by
+// a speakFinished event. 0 for unknown.
+type SpeechEstimator func(speak live2ddriver.Speaking) time.Duration
+
+// MaxSpeechDuration caps the estimated duration of a speech, and is the
+// duration of speeches that can not be estimated.
+const MaxSpeechDuration = 30 * time.Second
+
+// SpeechPerRune is the estimated speaking time of a rune of the text.
+const SpeechPerRune = 250 * time.Millisecond
+
+// SpeechLatency is added to the audio duration of a speech for views to
+// load & start playing the audio.
+const SpeechLatency = 500 * time.Millisecond
+
+// EstimateSpeech is the default SpeechEstimator: it's the Duration of the
+// audio (see live2ddriver.NewAudioDriver) if known, otherwise estimated by
+// the length of the text, at least a second.
+func EstimateSpeech(speak live2ddriver.Speaking) time.Duration {
+	if speak.Duration > 0 {
+		return time.Duration(speak.Duration*float64(time.Second)) + SpeechLatency
+	}
+	if speak.Text == "" {
+		return 0
+	}
+	d := time.Duration(utf8.RuneCountInString(speak.Text)) * SpeechPerRune
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// WithSpeechQueue serializes the speak requests of every room, so that
+// audios never overlap: a speak request is held in the queue until the
+// speech in progress finishes (the views report a speakFinished event of
+// its audio, or it has lasted the duration estimated by the estimator).
+//
+// A nil estimator is EstimateSpeech. Default: disabled.
+func WithSpeechQueue(enabled bool, estimator SpeechEstimator) Option {
+	return func(f *messageForwarder) {
+		f.speechQueue = enabled
+		if estimator != nil {
+			f.speechEstimator = estimator
+		}
+	}
+}
+
+// SpeechInfo describes a speech in the queue.
+type SpeechInfo struct {
+	ID    string `json:"id,omitempty"`
+	Audio string `json:"audio,omitempty"`
+	Text  string `json:"text,omitempty"`
+
+	QueuedAt  time.Time     `json:"queuedAt"`
+	StartedAt *time.Time    `json:"startedAt,omitempty"` // when it was forwarded
+	Estimate  time.Duration `json:"estimate"`            // taken as finished after
+}
+
+// SpeechQueueInfo describes the speech queue of a room.
+type SpeechQueueInfo struct {
+	Room    string       `json:"room"`
+	Current *SpeechInfo  `json:"current"` // the speech in progress
+	Pending []SpeechInfo `json:"pending"`
+}
+
+// speech is a queued speak request.
+type speech struct {
+	SpeechInfo
+	msg    []byte // driven, not yet filtered, see filterForward
+	raw    []byte // msg before driving
+	source string // of the message, see Record
+	timer  *time.Timer
+}
+
+// speechQueue is the speech queue of a room.
+type speechQueue struct {
+	current *speech
+	pending []*speech
+	mu      sync.Mutex
+}
+
+// queueSpeech puts the driven speak request msg into the speech queue of
+// the room. raw is the message before driving.
+//
+// Returns false if msg is not a speak request (s is nil), or it's the next
+// to speak (s is the current speech) and should be forwarded at once.
+// r.sendToMu must be held.
+func (f *messageForwarder) queueSpeech(r *room, raw, msg []byte, id, source string) (s *speech, queued bool) {
+	if s = f.newSpeech(raw, msg, id, source); s == nil {
+		return nil, false
+	}
+
+	q := &r.speech
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.current == nil {
+		f.startSpeech(r, s)
+		return s, false
+	}
+
+	q.pending = append(q.pending, s)
+	verboseLogf("INFO room %q: speech queued (%d pending): %s.", r.name, len(q.pending), s.ID)
+	return s, true
+}
+
+// newSpeech returns the speech of the driven speak request msg, or nil if
+// msg is not a speak request.
+func (f *messageForwarder) newSpeech(raw, msg []byte, id, source string) *speech {
+	var req live2ddriver.Live2DRequest
+	if err := json.Unmarshal(msg, &req); err != nil || req.Speak == nil {
+		return nil
+	}
+
+	s := &speech{
+		SpeechInfo: SpeechInfo{
+			ID:       id,
+			Audio:    req.Speak.Audio,
+			Text:     req.Speak.Text,
+			QueuedAt: time.Now(),
+			Estimate: f.speechEstimator(*req.Speak),
+		},
+		msg:    msg,
+		raw:    raw,
+		source: source,
+	}
+	if s.ID == "" {
+		s.ID = req.ID
+	}
+	if s.Estimate <= 0 || s.Estimate > MaxSpeechDuration {
+		s.Estimate = MaxSpeechDuration
+	}
+	return s
+}
+
+// startSpeech makes s the current speech of the room, which finishes at the
+// latest after its estimated duration. r.speech.mu must be held.
+func (f *messageForwarder) startSpeech(r *room, s *speech) {
+	now := time.Now()
+	s.StartedAt = &now
+	s.timer = time.AfterFunc(s.Estimate, func() {
+		verboseLogf("INFO room %q: speech %s timed out after %v.", r.name, s.ID, s.Estimate)
+		f.finishSpeech(r, s)
+	})
+	r.speech.current = s
+}
+
+// finishSpeech finishes the speech s if it's the current one of the room,
+// and forwards the next one.
+func (f *messageForwarder) finishSpeech(r *room, s *speech) {
+	r.sendToMu.Lock()
+	defer r.sendToMu.Unlock()
+
+	f.finishSpeechLocked(r, s)
+}
+
+// finishSpeechLocked is finishSpeech with r.sendToMu held. A nil s is
+// never the current speech.
+func (f *messageForwarder) finishSpeechLocked(r *room, s *speech) {
+	if s == nil {
+		return
+	}
+
+	q := &r.speech
+	q.mu.Lock()
+	if q.current != s {
+		q.mu.Unlock()
+		return
+	}
+	s.timer.Stop()
+	q.current = nil
+	r.idle.touch() // idle after the speech, rather than after it started
+
+	var next *speech
+	if len(q.pending) > 0 {
+		next = q.pending[0]
+		q.pending = q.pending[1:]
+		f.startSpeech(r, next)
+	}
+	q.mu.Unlock()
+
+	if next != nil {
+		_, err := f.filterForward(r, next, next.raw, next.msg, "", "", next.source)
+		if err != nil && err != ErrNothingToForward {
+			log.Printf("WARN room %q: forward speech %s: %v.", r.name, next.ID, err)
+		}
+	}
+}
+
+// handleSpeechEvent finishes the current speech of the room of the client
+// on a speakFinished event of its id or audio.
+func (f *messageForwarder) handleSpeechEvent(c *client, ev ViewEvent) {
+	if !f.speechQueue || ev.Type != EventSpeakFinished {
+		return
+	}
+	r, err := f.lookupRoom(c.room)
+	if err != nil {
+		return
+	}
+
+	r.speech.mu.Lock()
+	current := r.speech.current
+	r.speech.mu.Unlock()
+
+	if current != nil && current.finishedBy(ev) {
+		f.finishSpeech(r, current)
+	}
+}
+
+// finishedBy reports whether the speakFinished event is of the speech: by
+// the request id if the view echoes it, otherwise by the audio src. Views
+// should echo the id of data URI audios, which are too large for view
+// messages (see MaxViewMessageSize).
+func (s *speech) finishedBy(ev ViewEvent) bool {
+	if ev.ID != "" {
+		return ev.ID == s.ID
+	}
+	return ev.Audio != "" && ev.Audio == s.Audio
+}
+
+// Speech returns the speech queue of the room.
+func (f *messageForwarder) Speech(room string) (SpeechQueueInfo, error) {
+	r, err := f.lookupRoom(room)
+	if err != nil {
+		return SpeechQueueInfo{}, err
+	}
+
+	q := &r.speech
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	info := SpeechQueueInfo{Room: r.name, Pending: make([]SpeechInfo, 0, len(q.pending))}
+	if q.current != nil {
+		current := q.current.SpeechInfo
+		info.Current = &current
+	}
+	for _, s := range q.pending {
+		info.Pending = append(info.Pending, s.SpeechInfo)
+	}
+	return info, nil
+}
+
+// ClearSpeech drops the pending speeches of the room. The one in progress
+// is kept. Returns the number of speeches dropped.
+func (f *messageForwarder) ClearSpeech(room string) (int, error) {
+	r, err := f.lookupRoom(room)
+	if err != nil {
+		return 0, err
+	}
+
+	r.speech.mu.Lock()
+	defer r.speech.mu.Unlock()
+
+	n := len(r.speech.pending)
+	r.speech.pending = nil
+	return n, nil
+}
+
+// SkipSpeech finishes the speech in progress of the room at once, and
+// forwards the next one.
+func (f *messageForwarder) SkipSpeech(room string) error {
+	r, err := f.lookupRoom(room)
+	if err != nil {
+		return err
+	}
+
+	r.speech.mu.Lock()
+	current := r.speech.current
+	r.speech.mu.Unlock()
+
+	if current != nil {
+		f.finishSpeech(r, current)
+	}
+	return nil
+}
+
+// InterruptSpeech barges in: drops the pending speeches of the room, and
+// forwards the speak request msg at once, cutting off the one in progress.
+// It's never queued.
+func (f *messageForwarder) InterruptSpeech(room string, msg []byte) (*Delivery, error) {
+	r, err := f.lookupRoom(room)
+	if err != nil {
+		return nil, err
+	}
+	r.idle.touch()
+
+	raw := msg
+	if msg = f.driveFrom(r, msg, SourceInterrupt); msg == nil {
+		return nil, ErrNothingToForward
+	}
+
+	// clear the queue & take it over under the same lock: no other speech
+	// can get in between.
+	r.sendToMu.Lock()
+	defer r.sendToMu.Unlock()
+
+	var s *speech
+	if f.speechQueue {
+		s = f.newSpeech(raw, msg, "", SourceInterrupt)
+	}
+
+	q := &r.speech
+	q.mu.Lock()
+	q.pending = nil
+	if q.current != nil {
+		q.current.timer.Stop()
+		q.current = nil
+	}
+	if s != nil {
+		f.startSpeech(r, s)
+	}
+	q.mu.Unlock()
+
+	return f.filterForward(r, s, raw, msg, "", "", SourceInterrupt)
+}
+
+// region HTTP
+
+// speechRoutes registers the speech queue APIs. The room is given by the
+// query parameter room, or the DefaultRoom. Responds 404 for rooms never
+// connected to or sent to: they are not created here.
+//
+//	GET    /speech: the speech queue
+//	DELETE /speech: drop the pending speeches
+//	POST   /speech/skip: finish the speech in progress
+//	POST   /speech/interrupt: barge in with the Live2DRequest
+func (f *messageForwarder) speechRoutes(router gin.IRouter) {
+	respond := func(c *gin.Context, v interface{}, err error) {
+		if errors.Is(err, ErrRoomNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, v)
+	}
+
+	router.GET("/speech", func(c *gin.Context) {
+		info, err := f.Speech(c.Query("room"))
+		respond(c, info, err)
+	})
+	router.DELETE("/speech", func(c *gin.Context) {
+		n, err := f.ClearSpeech(c.Query("room"))
+		respond(c, gin.H{"cleared": n}, err)
+	})
+	router.POST("/speech/skip", func(c *gin.Context) {
+		err := f.SkipSpeech(c.Query("room"))
+		respond(c, gin.H{"skipped": true}, err)
+	})
+	router.POST("/speech/interrupt", func(c *gin.Context) {
+		var req live2ddriver.Live2DRequest
+		if err := c.ShouldBind(&req); err != nil || req.Speak == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "want a speak request"})
+			return
+		}
+		room := c.Query("room")
+		req.Room = ""
+
+		j, err := json.Marshal(req)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		_, err = f.InterruptSpeech(room, j)
+		respond(c, gin.H{"interrupted": true}, err)
+	})
+}
+
+// endregion HTTP
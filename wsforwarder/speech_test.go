@@ -0,0 +1,191 @@
+package wsforwarder
+
+import (
+	"errors"
+	"live2ddriver/live2ddriver"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestEstimateSpeech(t *testing.T) {
+	testCases := []struct {
+		text string
+		want time.Duration
+	}{
+		{"", 0},
+		{"hi", time.Second},
+		{"你好，今天天气不错。", 10 * SpeechPerRune},
+	}
+	for _, tc := range testCases {
+		if got := EstimateSpeech(live2ddriver.Speaking{Text: tc.text}); got != tc.want {
+			t.Errorf("EstimateSpeech(%q) = %v, want %v", tc.text, got, tc.want)
+		}
+	}
+
+	if got := EstimateSpeech(live2ddriver.Speaking{Text: "hi", Duration: 2.5}); got != 2500*time.Millisecond+SpeechLatency {
+		t.Errorf("EstimateSpeech(2.5s audio) = %v, want 2.5s + SpeechLatency", got)
+	}
+}
+
+func TestMessageForwarder_speechQueue(t *testing.T) {
+	f := NewMessageForwarder(WithSpeechQueue(true, func(speak live2ddriver.Speaking) time.Duration {
+		if speak.Text == "short" {
+			return 100 * time.Millisecond
+		}
+		return time.Minute
+	}))
+	dial := serveForwarder(t, f)
+
+	ws := dial("?since=0")
+	waitClients(t, f, 1)
+
+	// the first speech goes at once, the others wait
+	f.SendMessage([]byte(`{"speak":{"audio":"1.wav"}}`))
+	f.SendMessage([]byte(`{"speak":{"audio":"2.wav","text":"short"}}`))
+	f.SendMessage([]byte(`{"motion":"shake"}`)) // not a speech: never waits
+	_, err := f.SendMessageTracked([]byte(`{"id":"3","speak":{"audio":"3.wav"}}`), "3", WaitDelivered)
+	if !errors.Is(err, ErrSpeechQueued) {
+		t.Errorf("SendMessageTracked() error = %v, want ErrSpeechQueued", err)
+	}
+
+	if got, want := receive(t, ws), `{"seq":1,"speak":{"audio":"1.wav"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := receive(t, ws), `{"seq":2,"motion":"shake"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	info, err := f.Speech("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Current == nil || info.Current.Audio != "1.wav" || len(info.Pending) != 2 {
+		t.Fatalf("Speech() = %+v, want 1.wav in progress, 2 pending", info)
+	}
+
+	// finished by the view
+	if err := websocket.Message.Send(ws, `{"event":"speakFinished","audio":"1.wav"}`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(t, ws), `{"seq":3,"speak":{"audio":"2.wav","text":"short"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// finished by the estimated duration
+	if got, want := receive(t, ws), `{"seq":4,"id":"3","speak":{"audio":"3.wav"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	t.Run("FinishedByID", func(t *testing.T) {
+		f.SendMessage([]byte(`{"id":"d1","speak":{"audio":"data:audio/wav;base64,UklGRg=="}}`))
+		f.SendMessage([]byte(`{"speak":{"audio":"next.wav"}}`))
+		if err := f.SkipSpeech(""); err != nil { // 3.wav
+			t.Fatal(err)
+		}
+		receive(t, ws)
+
+		if err := websocket.Message.Send(ws, `{"event":"speakFinished","id":"d1"}`); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := receive(t, ws), `{"seq":6,"speak":{"audio":"next.wav"}}`; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	})
+
+	t.Run("ClearAndSkip", func(t *testing.T) {
+		f.SendMessage([]byte(`{"speak":{"audio":"4.wav"}}`))
+		f.SendMessage([]byte(`{"speak":{"audio":"5.wav"}}`))
+
+		if n, err := f.ClearSpeech(""); err != nil || n != 2 {
+			t.Errorf("ClearSpeech() = %v, %v, want 2 (4.wav & 5.wav)", n, err)
+		}
+		if err := f.SkipSpeech(""); err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := f.Speech(""); info.Current != nil || len(info.Pending) != 0 {
+			t.Errorf("Speech() = %+v, want empty", info)
+		}
+	})
+
+	t.Run("Interrupt", func(t *testing.T) {
+		f.SendMessage([]byte(`{"speak":{"audio":"6.wav"}}`))
+		f.SendMessage([]byte(`{"speak":{"audio":"7.wav"}}`))
+		receive(t, ws)
+
+		if _, err := f.InterruptSpeech("", []byte(`{"speak":{"audio":"8.wav"}}`)); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := receive(t, ws), `{"seq":8,"speak":{"audio":"8.wav"}}`; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+		if info, _ := f.Speech(""); info.Current == nil || info.Current.Audio != "8.wav" || len(info.Pending) != 0 {
+			t.Errorf("Speech() = %+v, want 8.wav in progress, nothing pending", info)
+		}
+	})
+}
+
+func TestMessageForwarder_speechArbitration(t *testing.T) {
+	f := NewMessageForwarder(
+		WithSpeechQueue(true, nil),
+		WithFilters(NewArbiter(ArbiterConfig{MotionHold: time.Minute})),
+	)
+	dial := serveForwarder(t, f)
+
+	ws := dial("?since=0")
+	waitClients(t, f, 1)
+
+	f.SendMessage([]byte(`{"speak":{"audio":"1.wav"}}`))
+	f.SendMessage([]byte(`{"motion":"wave","speak":{"audio":"2.wav"}}`)) // queued
+	f.SendMessage([]byte(`{"motion":"bow","priority":"manual"}`))
+	receive(t, ws)
+	receive(t, ws)
+
+	// arbitrated when forwarded: the manual motion holds by then
+	if err := f.SkipSpeech(""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(t, ws), `{"seq":3,"speak":{"audio":"2.wav"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMessageForwarder_InterruptSpeech(t *testing.T) {
+	// the interrupt takes long to drive, e.g. by TTS
+	release := make(chan struct{})
+	driver := driverFunc(func(req live2ddriver.Live2DRequest) live2ddriver.Live2DRequest {
+		if req.Speak != nil && req.Speak.Audio == "interrupt.wav" {
+			<-release
+		}
+		return req
+	})
+	f := NewMessageForwarder(WithDriver(driver), WithSpeechQueue(true, nil))
+	dial := serveForwarder(t, f)
+
+	ws := dial("?since=0")
+	waitClients(t, f, 1)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := f.InterruptSpeech("", []byte(`{"speak":{"audio":"interrupt.wav"}}`))
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a speech sent while the interrupt is driven is cut off by it
+	f.SendMessage([]byte(`{"speak":{"audio":"1.wav"}}`))
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatalf("InterruptSpeech() error = %v, want never queued", err)
+	}
+
+	for _, want := range []string{`{"seq":1,"speak":{"audio":"1.wav"}}`, `{"seq":2,"speak":{"audio":"interrupt.wav"}}`} {
+		if got := receive(t, ws); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if info, _ := f.Speech(""); info.Current == nil || info.Current.Audio != "interrupt.wav" || len(info.Pending) != 0 {
+		t.Errorf("Speech() = %+v, want interrupt.wav in progress, nothing pending", info)
+	}
+}
@@ -0,0 +1,71 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"live2ddriver/live2ddriver"
+	"sync"
+)
+
+// viewState is the sticky state of Live2DViews, tracked from the forwarded
+// Live2DRequests. It's replayed to newly connected views, so that a
+// reconnecting view resyncs immediately instead of waiting for the next
+// request.
+//
+// Motions & speaking are one-shot actions, only the model & the expression
+// stick.
+type viewState struct {
+	model      string
+	expression string
+	mu         sync.Mutex
+}
+
+// update the state by a forwarded message.
+// Messages that are not Live2DRequests are ignored.
+func (s *viewState) update(msg []byte) {
+	var req live2ddriver.Live2DRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Model != "" && req.Model != s.model {
+		s.model = req.Model
+		s.expression = "" // expressions belong to the old model
+	}
+
+	if req.Expression != "" {
+		s.expression = req.Expression
+	} else if req.Speak != nil && req.Speak.Expression != "" {
+		s.expression = req.Speak.Expression
+	}
+}
+
+// currentModel returns the model src of the state, empty if unknown.
+func (s *viewState) currentModel() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.model
+}
+
+// snapshot returns the messages to replay the state, in order:
+// model first, and then the expression on it.
+func (s *viewState) snapshot() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs [][]byte
+	for _, req := range []live2ddriver.Live2DRequest{
+		{Model: s.model},
+		{Expression: s.expression},
+	} {
+		if req.Model == "" && req.Expression == "" {
+			continue
+		}
+		if j, err := json.Marshal(req); err == nil {
+			msgs = append(msgs, j)
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,244 @@
+package wsforwarder
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// Subscription is what a client subscribes to:
+//
+//   - Fields: the fields of messages to forward, e.g. "speak.text" or
+//     "model". Messages are projected down to the subscribed fields, and
+//     those with none of them are not forwarded at all. nil or "*" for
+//     all fields.
+//   - Events: the ViewEvents (of other views in the room) to forward,
+//     e.g. "speakFinished". "*" for all events. None by default.
+//
+// Clients subscribe at connect time by query parameters:
+//
+//	/live2d?fields=speak.text,model&events=speakFinished
+//
+// or by a control message via the websocket connection, which replaces
+// the subscription:
+//
+//	{"subscribe": {"fields": ["speak.text"], "events": ["*"]}}
+type Subscription struct {
+	Fields []string `json:"fields"`
+	Events []string `json:"events,omitempty"`
+}
+
+// alwaysForwarded are fields forwarded regardless of the subscription:
+// they are about the forwarding itself, not the view.
+var alwaysForwarded = []string{"seq", "id"}
+
+// gap notices (see history.gapNotice) are forwarded to every client.
+const gapField = "gap"
+
+// fieldTree is the compiled subscribed fields: field => subscribed sub-fields.
+// An empty subtree subscribes to the whole field.
+type fieldTree map[string]fieldTree
+
+// subscription is the compiled Subscription.
+type subscription struct {
+	Subscription
+
+	fields fieldTree // nil: all fields
+	events map[string]bool
+}
+
+// compile the Subscription.
+func (s Subscription) compile() *subscription {
+	sub := &subscription{Subscription: s}
+
+	if s.Fields != nil {
+		sub.fields = fieldTree{}
+		for _, f := range s.Fields {
+			if f == "*" {
+				sub.fields = nil
+				break
+			}
+			sub.fields.add(strings.Split(f, "."))
+		}
+	}
+
+	sub.events = map[string]bool{}
+	for _, e := range s.Events {
+		sub.events[e] = true
+	}
+
+	return sub
+}
+
+// add the field path to the tree.
+func (t fieldTree) add(path []string) {
+	name := strings.TrimSpace(path[0])
+	if name == "" {
+		return
+	}
+
+	sub, ok := t[name]
+	if ok && len(sub) == 0 { // the whole field is subscribed already
+		return
+	}
+	if len(path) == 1 {
+		t[name] = fieldTree{}
+		return
+	}
+	if sub == nil {
+		sub = fieldTree{}
+		t[name] = sub
+	}
+	sub.add(path[1:])
+}
+
+// subscriptionFromQuery parses the Subscription from the query parameters
+// fields & events. Absent parameters are the defaults.
+func subscriptionFromQuery(query url.Values) Subscription {
+	var s Subscription
+	if query.Has("fields") {
+		s.Fields = splitList(query.Get("fields"))
+	}
+	if query.Has("events") {
+		s.Events = splitList(query.Get("events"))
+	}
+	return s
+}
+
+// splitList splits the comma-separated list, dropping the empty items.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// project the message down to the subscribed fields.
+// Returns false if nothing subscribed is in the message.
+//
+// Messages that are not JSON objects are forwarded only if all fields are
+// subscribed.
+func (s *subscription) project(msg []byte) ([]byte, bool) {
+	if s.fields == nil {
+		return msg, true
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil || fields == nil {
+		return nil, false
+	}
+
+	projected, ok := s.fields.project(fields)
+	if gap, isGap := fields[gapField]; isGap {
+		projected[gapField], ok = gap, true
+	}
+	if !ok {
+		return nil, false
+	}
+	for _, f := range alwaysForwarded {
+		if v, has := fields[f]; has {
+			projected[f] = v
+		}
+	}
+
+	j, err := json.Marshal(projected)
+	if err != nil {
+		return nil, false
+	}
+	return j, true
+}
+
+// project the JSON object down to the fields in the tree.
+// Returns false if none of them is in the object.
+func (t fieldTree) project(fields map[string]json.RawMessage) (map[string]json.RawMessage, bool) {
+	projected := map[string]json.RawMessage{}
+
+	for name, sub := range t {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if len(sub) == 0 {
+			projected[name] = v
+			continue
+		}
+
+		var subFields map[string]json.RawMessage
+		if err := json.Unmarshal(v, &subFields); err != nil || subFields == nil {
+			continue
+		}
+		subProjected, ok := sub.project(subFields)
+		if !ok {
+			continue
+		}
+		j, err := json.Marshal(subProjected)
+		if err != nil {
+			continue
+		}
+		projected[name] = j
+	}
+
+	return projected, len(projected) > 0
+}
+
+// wantsEvent reports whether the event type is subscribed.
+func (s *subscription) wantsEvent(typ ViewEventType) bool {
+	return s.events["*"] || s.events[typ]
+}
+
+// subscription of the client.
+func (c *client) subscription() *subscription {
+	return c.sub.Load()
+}
+
+// subscribe replaces the subscription of the client.
+func (c *client) subscribe(s Subscription) {
+	c.sub.Store(s.compile())
+}
+
+// filter projects the messages by the subscription of the client, dropping
+// those with nothing subscribed.
+func (c *client) filter(msgs [][]byte) [][]byte {
+	sub := c.subscription()
+	filtered := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		if m, ok := sub.project(msg); ok {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// forwardEvent forwards the ViewEvent from the client to the other clients
+// in its room that subscribe to it.
+func (f *messageForwarder) forwardEvent(from *client, ev ViewEvent) {
+	r, err := f.lookupRoom(from.room)
+	if err != nil {
+		return
+	}
+
+	// pick the receivers under r.mu, but enqueue without it: a slow client
+	// never blocks joining, leaving & forwarding to the room.
+	var receivers []*client
+	r.mu.RLock()
+	for _, c := range r.clients {
+		if c != from && c.subscription().wantsEvent(ev.Type) {
+			receivers = append(receivers, c)
+		}
+	}
+	r.mu.RUnlock()
+	if len(receivers) == 0 {
+		return
+	}
+
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	for _, c := range receivers {
+		_ = c.enqueue(outMsg{data: j}, f.sendTimeout)
+	}
+}
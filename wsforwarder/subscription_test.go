@@ -0,0 +1,141 @@
+package wsforwarder
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestSubscription_project(t *testing.T) {
+	testCases := []struct {
+		name   string
+		fields []string
+		msg    string
+		want   string // empty for not forwarded
+	}{
+		{"All", nil, `{"seq":1,"motion":"shake"}`, `{"seq":1,"motion":"shake"}`},
+		{"Star", []string{"*"}, `hello`, `hello`},
+		{"None", []string{}, `{"seq":1,"motion":"shake"}`, ``},
+		{"NotJSON", []string{"motion"}, `hello`, ``},
+		{"Field", []string{"model", "motion"}, `{"seq":1,"motion":"shake","expression":"f01"}`, `{"motion":"shake","seq":1}`},
+		{"NotSubscribed", []string{"speak.text"}, `{"seq":1,"motion":"shake"}`, ``},
+		{"SubField", []string{"speak.text"}, `{"seq":2,"id":"x","speak":{"text":"hi","audio":"a.wav"}}`, `{"id":"x","seq":2,"speak":{"text":"hi"}}`},
+		{"SubFieldMissing", []string{"speak.text"}, `{"seq":2,"speak":{"audio":"a.wav"}}`, ``},
+		{"WholeWins", []string{"speak.text", "speak"}, `{"speak":{"text":"hi","audio":"a.wav"}}`, `{"speak":{"text":"hi","audio":"a.wav"}}`},
+		{"Gap", []string{"speak.text"}, `{"gap":{"seq":9,"since":1}}`, `{"gap":{"seq":9,"since":1}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := Subscription{Fields: tc.fields}.compile().project([]byte(tc.msg))
+			if !ok {
+				got = nil
+			}
+			if string(got) != tc.want {
+				t.Errorf("project(%s) by %q = %s, want %s", tc.msg, tc.fields, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMessageForwarder_subscription(t *testing.T) {
+	f := NewMessageForwarder()
+	dial := serveForwarder(t, f)
+
+	view := dial("?since=0")
+	caption := dial("?since=0&fields=speak.text")
+	dashboard := dial("?since=0&events=speakFinished")
+	waitClients(t, f, 3)
+
+	f.SendMessage([]byte(`{"motion":"shake"}`))
+	f.SendMessage([]byte(`{"speak":{"text":"hi","audio":"a.wav"}}`))
+
+	if got, want := receive(t, caption), `{"seq":2,"speak":{"text":"hi"}}`; got != want {
+		t.Errorf("caption got %s, want %s", got, want)
+	}
+	if got, want := receive(t, dashboard), `{"seq":1,"motion":"shake"}`; got != want {
+		t.Errorf("dashboard got %s, want %s", got, want)
+	}
+	receive(t, dashboard)
+
+	t.Run("Events", func(t *testing.T) {
+		receive(t, view)
+		receive(t, view)
+		if err := websocket.Message.Send(view, `{"event":"speakFinished","audio":"a.wav"}`); err != nil {
+			t.Fatal(err)
+		}
+
+		var ev ViewEvent
+		_ = dashboard.SetReadDeadline(time.Now().Add(time.Second))
+		if err := websocket.JSON.Receive(dashboard, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != EventSpeakFinished || ev.Audio != "a.wav" || ev.Room != DefaultRoom {
+			t.Errorf("dashboard got event %+v, want speakFinished of a.wav", ev)
+		}
+	})
+
+	t.Run("ControlMessage", func(t *testing.T) {
+		if err := websocket.Message.Send(caption, `{"subscribe":{"fields":["motion"]}}`); err != nil {
+			t.Fatal(err)
+		}
+		subscribed := func() bool {
+			for _, c := range f.Clients() {
+				if len(c.Subscription.Fields) == 1 && c.Subscription.Fields[0] == "motion" {
+					return true
+				}
+			}
+			return false
+		}
+		for i := 0; i < 100 && !subscribed(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		f.SendMessage([]byte(`{"speak":{"text":"hello"}}`))
+		f.SendMessage([]byte(`{"motion":"nod"}`))
+		if got, want := receive(t, caption), `{"motion":"nod","seq":4}`; got != want {
+			t.Errorf("caption got %s, want %s", got, want)
+		}
+	})
+}
+
+func TestMessageForwarder_forwardEventToSlowClient(t *testing.T) {
+	f := NewMessageForwarder(WithSendTimeout(time.Second), WithOverflowPolicy(DropNewest))
+	r, err := f.room(DefaultRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a dashboard that never takes its full queue
+	slow := newClient(newTestConn(t), 1, DropNewest)
+	slow.id, slow.room = "slow", r.name
+	slow.subscribe(Subscription{Events: []string{"*"}})
+	view := newClient(newTestConn(t), 1, DropNewest)
+	view.id, view.room = "view", r.name
+	r.mu.Lock()
+	r.clients = append(r.clients, slow, view)
+	r.mu.Unlock()
+	if err := slow.enqueue(outMsg{data: []byte("1")}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.forwardEvent(view, ViewEvent{Type: EventMotionFinished})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the room is not locked while waiting for the slow client
+	start := time.Now()
+	r.remove(view)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("leaving the room blocked for %v by the slow client", elapsed)
+	}
+
+	<-done
+	if got := slow.dropped.Load(); got != 1 {
+		t.Errorf("dropped = %d, want 1 after the send timeout", got)
+	}
+}